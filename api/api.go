@@ -1,77 +1,214 @@
 package api
 
 import (
-	"errors"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
 
-	model "github.com/go-skynet/LocalAI/pkg/model"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/compress"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 )
 
-func App(configFile string, loader *model.ModelLoader, threads, ctxSize int, f16 bool, debug, disableMessage bool) *fiber.App {
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	if debug {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+func App(opts ...AppOption) (*fiber.App, error) {
+	options := newOptions(opts...)
+	for _, origin := range options.corsOrigins {
+		if origin == "*" && options.corsCredentials {
+			return nil, fmt.Errorf("the credentials can't be allowed from any origin, list the origins allowed instead")
+		}
 	}
+	loader, debug, logger := options.loader, options.debug, options.logger
 
 	// Return errors as JSON responses
 	app := fiber.New(fiber.Config{
-		DisableStartupMessage: disableMessage,
+		DisableStartupMessage: options.disableMessage,
+		BodyLimit:             options.maxBodySize,
 		// Override default error handler
 		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
-			// Status code defaults to 500
-			code := fiber.StatusInternalServerError
-
-			// Retrieve the custom status code if it's a *fiber.Error
-			var e *fiber.Error
-			if errors.As(err, &e) {
-				code = e.Code
-			}
-
-			// Send custom error page
-			return ctx.Status(code).JSON(
-				ErrorResponse{
-					Error: &APIError{Message: err.Error(), Code: code},
-				},
-			)
+			code, resp := errorResponse(err)
+			return ctx.Status(code).JSON(resp)
 		},
 	})
 
-	cm := make(ConfigMerger)
+	cm := NewConfigMerger()
+	cm.backends = options.backends
+	cm.logger = logger
 	if err := cm.LoadConfigs(loader.ModelPath); err != nil {
-		log.Error().Msgf("error loading config files: %s", err.Error())
+		logger.Error().Msgf("error loading config files: %s", err.Error())
+	}
+
+	if options.configFile != "" {
+		if err := cm.LoadConfigFile(options.configFile); err != nil {
+			logger.Error().Msgf("error loading config file: %s", err.Error())
+		}
 	}
 
-	if configFile != "" {
-		if err := cm.LoadConfigFile(configFile); err != nil {
-			log.Error().Msgf("error loading config file: %s", err.Error())
+	// The model given alone is served with the default parameters, and
+	// used by the requests which don't name one unless there is a default
+	if options.modelFile != "" {
+		c, err := modelFileConfig(loader.ModelPath, options.modelFile)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info().Msgf("Serving %s as %s", options.modelFile, c.Name)
+		cm.Set(c.Name, c)
+		if options.defaultModel == "" {
+			options.defaultModel = c.Name
 		}
 	}
 
 	if debug {
-		for k, v := range cm {
-			log.Debug().Msgf("Model: %s (config: %+v)", k, v)
+		for _, k := range cm.List() {
+			v, _ := cm.Get(k)
+			logger.Debug().Msgf("Model: %s (config: %+v)", k, v)
+		}
+	}
+
+	// The models are preloaded in the background unless strict, /readyz
+	// telling when they are done
+	ready := &atomic.Bool{}
+	switch {
+	case len(options.preloadModels) == 0:
+		ready.Store(true)
+	case options.preloadStrict:
+		if err := preloadModels(cm, options, options.preloadModels); err != nil {
+			return nil, err
+		}
+		ready.Store(true)
+	default:
+		go func() {
+			if err := preloadModels(cm, options, options.preloadModels); err != nil {
+				logger.Error().Msgf("error preloading models: %s", err.Error())
+			}
+			ready.Store(true)
+		}()
+	}
+
+	if options.watchConfigs {
+		watcher, err := cm.Watch(loader.ModelPath)
+		if err != nil {
+			logger.Error().Msgf("error watching config files: %s", err.Error())
+		} else {
+			app.Hooks().OnShutdown(watcher.Close)
 		}
 	}
+
 	// Default middleware config
 	app.Use(recover.New())
-	app.Use(cors.New())
 
-	// openAI compatible API endpoint
-	app.Post("/v1/chat/completions", chatEndpoint(cm, debug, loader, threads, ctxSize, f16))
-	app.Post("/chat/completions", chatEndpoint(cm, debug, loader, threads, ctxSize, f16))
+	// Cross-origin requests are denied by the browsers unless origins are
+	// allowed
+	if len(options.corsOrigins) > 0 {
+		app.Use(cors.New(cors.Config{
+			AllowOrigins:     strings.Join(options.corsOrigins, ","),
+			AllowCredentials: options.corsCredentials,
+		}))
+	}
+
+	// The responses are compressed as the clients accept, but the streams as
+	// the compression would hold their events back
+	if !options.disableCompression {
+		app.Use(compress.New(compress.Config{Next: isStream}))
+	}
+
+	// The probes are neither authenticated nor instrumented
+	app.Get("/healthz", healthEndpoint())
+	app.Get("/readyz", readyEndpoint(cm, options, ready))
+
+	app.Use(requestID(logger))
+	app.Use(instrument())
+
+	if len(options.apiKeys) > 0 {
+		app.Use(apiKeyAuth(options.apiKeys))
+	}
+
+	// openAI compatible API endpoint. The routes are registered with and
+	// without the /v1 prefix, as the clients use either depending on how
+	// their base URL is set
+	app.Post("/v1/chat/completions", chatEndpoint(cm, options))
+	app.Post("/chat/completions", chatEndpoint(cm, options))
+
+	app.Post("/v1/edits", editEndpoint(cm, options))
+	app.Post("/edits", editEndpoint(cm, options))
+
+	app.Post("/v1/embeddings", embeddingsEndpoint(cm, options))
+	app.Post("/embeddings", embeddingsEndpoint(cm, options))
+
+	app.Post("/v1/completions", completionEndpoint(cm, options))
+	app.Post("/completions", completionEndpoint(cm, options))
+
+	app.Post("/v1/completions/batch", batchEndpoint("/v1/completions"))
+	app.Post("/completions/batch", batchEndpoint("/v1/completions"))
+
+	app.Get("/v1/ws", websocketEndpoint(app, logger)...)
+	app.Get("/ws", websocketEndpoint(app, logger)...)
 
-	app.Post("/v1/edits", editEndpoint(cm, debug, loader, threads, ctxSize, f16))
-	app.Post("/edits", editEndpoint(cm, debug, loader, threads, ctxSize, f16))
+	app.Post("/v1/audio/transcriptions", transcriptEndpoint(cm, options))
+	app.Post("/audio/transcriptions", transcriptEndpoint(cm, options))
 
-	app.Post("/v1/completions", completionEndpoint(cm, debug, loader, threads, ctxSize, f16))
-	app.Post("/completions", completionEndpoint(cm, debug, loader, threads, ctxSize, f16))
+	app.Post("/v1/audio/translations", translationEndpoint(cm, options))
+	app.Post("/audio/translations", translationEndpoint(cm, options))
+
+	app.Post("/v1/images/generations", imageEndpoint())
+	app.Post("/images/generations", imageEndpoint())
+
+	app.Post("/v1/moderations", moderationEndpoint(cm, options))
+	app.Post("/moderations", moderationEndpoint(cm, options))
+
+	app.Post("/v1/tokenize", tokenizeEndpoint(cm, options))
+	app.Post("/tokenize", tokenizeEndpoint(cm, options))
+
+	// registered before /models/:model, which would match it
+	app.Get("/models/info", listModelsInfo(loader, cm, options))
 
 	app.Get("/v1/models", listModels(loader, cm))
 	app.Get("/models", listModels(loader, cm))
+	app.Get("/v1/models/:model", getModel(loader, cm))
+	app.Get("/models/:model", getModel(loader, cm))
+
+	app.Get("/version", versionEndpoint(loader))
+
+	app.Get("/metrics", metricsHandler(newMetricsRegistry(loader)))
 
-	return app
+	// Loading configs is open only to the holders of an API key
+	if len(options.apiKeys) > 0 {
+		app.Post("/v1/models/configs", loadConfigEndpoint(cm, options))
+		app.Post("/models/configs", loadConfigEndpoint(cm, options))
+		app.Post("/v1/models/:model/reload", reloadConfigEndpoint(cm, options))
+		app.Post("/models/:model/reload", reloadConfigEndpoint(cm, options))
+	}
+
+	return app, nil
+}
+
+// apiKeyLocal is set on the requests authenticated by their bearer token
+const apiKeyLocal = "apiKey"
+
+// apiKeyAuth rejects the requests without one of the keys as bearer token
+func apiKeyAuth(keys []string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token := bearerToken(c.Get("authorization"))
+		for _, key := range keys {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+				c.Locals(apiKeyLocal, true)
+				return c.Next()
+			}
+		}
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid API key")
+	}
+}
+
+// isStream reports whether the request asks for its response to be streamed
+// as server-sent events
+func isStream(c *fiber.Ctx) bool {
+	if c.Method() != fiber.MethodPost {
+		return false
+	}
+	var request struct {
+		Stream bool `json:"stream"`
+	}
+	return json.Unmarshal(c.Body(), &request) == nil && request.Stream
 }
@@ -1,7 +1,12 @@
 package api_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
 	"os"
 
 	. "github.com/go-skynet/LocalAI/api"
@@ -23,7 +28,9 @@ var _ = Describe("API test", func() {
 	Context("API query", func() {
 		BeforeEach(func() {
 			modelLoader = model.NewModelLoader(os.Getenv("MODELS_PATH"))
-			app = App("", modelLoader, 1, 512, false, true, true)
+			var err error
+			app, err = App(WithModelLoader(modelLoader), WithDebug(true), WithDisableMessage(true))
+			Expect(err).ToNot(HaveOccurred())
 			go app.Listen("127.0.0.1:9090")
 
 			defaultConfig := openai.DefaultConfig("")
@@ -48,11 +55,100 @@ var _ = Describe("API test", func() {
 			Expect(len(models.Models)).To(Equal(3))
 			Expect(models.Models[0].ID).To(Equal("testmodel"))
 		})
+		It("retrieves a single model", func() {
+			resp, err := http.Get("http://127.0.0.1:9090/v1/models/testmodel")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			m := OpenAIModel{}
+			Expect(json.NewDecoder(resp.Body).Decode(&m)).To(Succeed())
+			Expect(m.ID).To(Equal("testmodel"))
+			Expect(m.Object).To(Equal("model"))
+			Expect(m.OwnedBy).ToNot(BeEmpty())
+			Expect(m.Created).ToNot(BeZero())
+		})
+		It("returns 404 retrieving a model which doesn't exist", func() {
+			resp, err := http.Get("http://127.0.0.1:9090/v1/models/foomodel")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+
+			errResp := ErrorResponse{}
+			Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed())
+			Expect(errResp.Error.Message).To(ContainSubstring("foomodel"))
+		})
 		It("can generate completions", func() {
 			resp, err := client.CreateCompletion(context.TODO(), openai.CompletionRequest{Model: "testmodel", Prompt: "abcdedfghikl"})
 			Expect(err).ToNot(HaveOccurred())
 			Expect(len(resp.Choices)).To(Equal(1))
 			Expect(resp.Choices[0].Text).ToNot(BeEmpty())
+			Expect(resp.Usage.PromptTokens).ToNot(BeZero())
+			Expect(resp.Usage.TotalTokens).To(Equal(resp.Usage.PromptTokens + resp.Usage.CompletionTokens))
+			Expect(resp.ID).To(HavePrefix("cmpl-"))
+			Expect(resp.Created).ToNot(BeZero())
+			Expect(resp.Choices[0].FinishReason).To(BeElementOf("stop", "length"))
+		})
+		It("returns a choice per prompt", func() {
+			resp, err := client.CreateCompletion(context.TODO(), openai.CompletionRequest{Model: "testmodel", Prompt: []string{"abcdedfghikl", "mnopqrstuvwxyz"}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(resp.Choices)).To(Equal(2))
+			Expect(resp.Choices[0].Index).To(Equal(0))
+			Expect(resp.Choices[1].Index).To(Equal(1))
+			Expect(resp.Usage.PromptTokens).To(BeNumerically(">", 1))
+		})
+		It("streams completions", func() {
+			stream, err := client.CreateCompletionStream(context.TODO(), openai.CompletionRequest{Model: "testmodel", Prompt: "abcdedfghikl"})
+			Expect(err).ToNot(HaveOccurred())
+			defer stream.Close()
+
+			text := ""
+			finishReason := ""
+			for {
+				resp, err := stream.Recv()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.Object).To(Equal("text_completion"))
+				Expect(resp.ID).To(HavePrefix("cmpl-"))
+				Expect(resp.Choices).To(HaveLen(1))
+				text += resp.Choices[0].Text
+				if resp.Choices[0].FinishReason != "" {
+					finishReason = resp.Choices[0].FinishReason
+				}
+			}
+			Expect(text).ToNot(BeEmpty())
+			Expect(finishReason).To(BeElementOf("stop", "length"))
+		})
+		It("reports the completions cut at max_tokens", func() {
+			resp, err := client.CreateCompletion(context.TODO(), openai.CompletionRequest{Model: "testmodel", Prompt: "abcdedfghikl", MaxTokens: 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Choices[0].FinishReason).To(Equal("length"))
+		})
+
+		It("generates the same completion given the same seed", func() {
+			complete := func() string {
+				body := `{"model": "testmodel", "prompt": "abcdedfghikl", "temperature": 0.9, "max_tokens": 16, "seed": 0}`
+				resp, err := http.Post("http://127.0.0.1:9090/v1/completions", "application/json", bytes.NewBufferString(body))
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				res := OpenAIResponse{}
+				Expect(json.NewDecoder(resp.Body).Decode(&res)).To(Succeed())
+				Expect(res.Choices).To(HaveLen(1))
+				return res.Choices[0].Text
+			}
+			Expect(complete()).To(Equal(complete()))
+		})
+
+		It("doesn't tokenize the texts without the tokenizer of the backend", func() {
+			body := `{"model": "testmodel", "content": "abcdedfghikl"}`
+			resp, err := http.Post("http://127.0.0.1:9090/v1/tokenize", "application/json", bytes.NewBufferString(body))
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNotImplemented))
 		})
 
 		It("can generate chat completions ", func() {
@@ -60,6 +156,8 @@ var _ = Describe("API test", func() {
 			Expect(err).ToNot(HaveOccurred())
 			Expect(len(resp.Choices)).To(Equal(1))
 			Expect(resp.Choices[0].Message.Content).ToNot(BeEmpty())
+			Expect(resp.ID).To(HavePrefix("chatcmpl-"))
+			Expect(resp.Created).ToNot(BeZero())
 		})
 
 		It("can generate completions from model configs", func() {
@@ -87,7 +185,9 @@ var _ = Describe("API test", func() {
 	Context("Config file", func() {
 		BeforeEach(func() {
 			modelLoader = model.NewModelLoader(os.Getenv("MODELS_PATH"))
-			app = App(os.Getenv("CONFIG_FILE"), modelLoader, 1, 512, false, true, true)
+			var err error
+			app, err = App(WithConfigFile(os.Getenv("CONFIG_FILE")), WithModelLoader(modelLoader), WithDebug(true), WithDisableMessage(true))
+			Expect(err).ToNot(HaveOccurred())
 			go app.Listen("127.0.0.1:9090")
 
 			defaultConfig := openai.DefaultConfig("")
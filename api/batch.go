@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// BatchResult is the result of a request of a batch. Response is the body
+// the endpoint replied with on success, Error the one of its failure.
+type BatchResult struct {
+	Index    int             `json:"index"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    *APIError       `json:"error,omitempty"`
+}
+
+// BatchResponse holds the results of a batch, in the order of its requests
+type BatchResponse struct {
+	Object string        `json:"object"`
+	Data   []BatchResult `json:"data"`
+}
+
+// batchEndpoint serves a batch of requests, a JSON array of them, through the
+// handlers of path, so they go through the same authentication, limits and
+// logging as the ones sent alone. The requests run one after the other,
+// waiting for the concurrency limit in turn, and their failures are reported
+// in their result rather than failing the whole batch.
+func batchEndpoint(path string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		requests := []json.RawMessage{}
+		if err := json.Unmarshal(c.Body(), &requests); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("invalid request body: the batch must be an array of requests: %s", err.Error()))
+		}
+		if len(requests) == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "the batch has no requests")
+		}
+
+		results := make([]BatchResult, 0, len(requests))
+		for i, body := range requests {
+			results = append(results, batchRequest(c, path, i, body))
+		}
+		return c.JSON(BatchResponse{Object: "list", Data: results})
+	}
+}
+
+// batchRequest serves the request of the batch at index with the handlers of
+// path, as if it had been sent alone with the headers of the batch
+func batchRequest(c *fiber.Ctx, path string, index int, body []byte) BatchResult {
+	result := BatchResult{Index: index}
+
+	// the results are returned at once, so they can't be streamed
+	stream := struct {
+		Stream bool `json:"stream"`
+	}{}
+	if err := json.Unmarshal(body, &stream); err == nil && stream.Stream {
+		code, resp := errorResponse(invalidParam("stream", "the requests of a batch can't be streamed"))
+		result.Status, result.Error = code, resp.Error
+		return result
+	}
+
+	ctx := innerRequest(c.App(), &c.Request().Header, c.Context().RemoteAddr(), path, body)
+	result.Status = ctx.Response.StatusCode()
+	if result.Status < 400 {
+		result.Response = append(json.RawMessage{}, ctx.Response.Body()...)
+		return result
+	}
+	resp := ErrorResponse{}
+	if err := json.Unmarshal(ctx.Response.Body(), &resp); err != nil || resp.Error == nil {
+		resp.Error = &APIError{Code: result.Status, Message: string(ctx.Response.Body()), Type: "server_error"}
+	}
+	result.Error = resp.Error
+	return result
+}
+
+// innerRequest serves the JSON body with the handlers of path, as a POST
+// request with the headers given, without going through the network. The
+// response is uncompressed, and its body left to the caller.
+func innerRequest(app *fiber.App, header *fasthttp.RequestHeader, addr net.Addr, path string, body []byte) *fasthttp.RequestCtx {
+	req := &fasthttp.Request{}
+	header.CopyTo(&req.Header)
+	req.Header.Del(fiber.HeaderAcceptEncoding)
+	req.Header.SetMethod(fiber.MethodPost)
+	req.Header.SetContentType(fiber.MIMEApplicationJSON)
+	req.SetRequestURI(path)
+	req.SetBody(body)
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(req, addr, nil)
+	app.Handler()(ctx)
+	return ctx
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// cacheHeader tells the cached requests whether their response was cached
+const cacheHeader = "X-Cache"
+
+// responseCache keeps the responses of the deterministic requests in memory,
+// up to size of them, for ttl. The least recently used ones are dropped first.
+// A nil cache doesn't cache anything.
+type responseCache struct {
+	sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cachedResponse struct {
+	key     string
+	resp    OpenAIResponse
+	expires time.Time
+}
+
+// newResponseCache returns a cache of up to size responses, expiring after
+// ttl, or never if it isn't positive. It returns nil when size isn't positive.
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	if size <= 0 {
+		return nil
+	}
+	return &responseCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// responseCacheKey returns the key of the response of the request in the
+// cache, a hash of the endpoint, with or without /v1, of its parameters,
+// extra ones included, and of the prompts given to the model. It is empty for
+// the requests which are not cached: the streamed ones, and the ones which are
+// not deterministic, with neither a temperature of 0 nor a seed.
+func responseCacheKey(c *fiber.Ctx, o *Option, config *Config, input *OpenAIRequest, prompts ...string) string {
+	if o.responseCache == nil || input.Stream || (config.Temperature != 0 && config.Seed == nil) {
+		return ""
+	}
+
+	// the end user doesn't change the response
+	in := *input
+	in.User = ""
+	data, err := json.Marshal(struct {
+		Endpoint string
+		Config   *Config
+		Input    *OpenAIRequest
+		Prompts  []string
+		Extra    map[string]interface{}
+	}{strings.TrimPrefix(c.Route().Path, "/v1"), config, &in, prompts, config.Extra})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the response cached under key, if any and not expired, and
+// tells the client in cacheHeader. The response is given a new ID and
+// creation time, as each response of the API is a new one, and its timings
+// are zeroed, as no token was evaluated to reply it. The requests with an
+// empty key are not cached.
+func (rc *responseCache) get(c *fiber.Ctx, key string) (OpenAIResponse, bool) {
+	if rc == nil || key == "" {
+		return OpenAIResponse{}, false
+	}
+
+	rc.Lock()
+	defer rc.Unlock()
+	if e, ok := rc.entries[key]; ok {
+		cached := e.Value.(*cachedResponse)
+		if rc.ttl <= 0 || time.Now().Before(cached.expires) {
+			rc.lru.MoveToFront(e)
+			c.Set(cacheHeader, "HIT")
+			resp := cached.resp
+			if resp.ID != "" {
+				prefix, _, _ := strings.Cut(resp.ID, "-")
+				resp.ID = newResponseID(prefix + "-")
+			}
+			resp.Created = int(time.Now().Unix())
+			if resp.Timings != nil {
+				resp.Timings = &Timings{}
+			}
+			return resp, true
+		}
+		rc.lru.Remove(e)
+		delete(rc.entries, key)
+	}
+	c.Set(cacheHeader, "MISS")
+	return OpenAIResponse{}, false
+}
+
+// add caches the response under key, unless it is empty
+func (rc *responseCache) add(key string, resp OpenAIResponse) {
+	if rc == nil || key == "" {
+		return
+	}
+
+	rc.Lock()
+	defer rc.Unlock()
+	cached := &cachedResponse{key: key, resp: resp, expires: time.Now().Add(rc.ttl)}
+	if e, ok := rc.entries[key]; ok {
+		e.Value = cached
+		rc.lru.MoveToFront(e)
+		return
+	}
+	rc.entries[key] = rc.lru.PushFront(cached)
+	for rc.lru.Len() > rc.size {
+		oldest := rc.lru.Back()
+		rc.lru.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/valyala/fasthttp"
+)
+
+var _ = Describe("Response cache", func() {
+	var c *fiber.Ctx
+
+	BeforeEach(func() {
+		app := fiber.New()
+		c = app.AcquireCtx(&fasthttp.RequestCtx{})
+		DeferCleanup(app.ReleaseCtx, c)
+	})
+
+	It("drops the least recently used responses", func() {
+		rc := newResponseCache(2, 0)
+		rc.add("a", OpenAIResponse{Model: "a"})
+		rc.add("b", OpenAIResponse{Model: "b"})
+		_, hit := rc.get(c, "a")
+		Expect(hit).To(BeTrue())
+		rc.add("c", OpenAIResponse{Model: "c"})
+
+		_, hit = rc.get(c, "b")
+		Expect(hit).To(BeFalse())
+		resp, hit := rc.get(c, "a")
+		Expect(hit).To(BeTrue())
+		Expect(resp.Model).To(Equal("a"))
+		_, hit = rc.get(c, "c")
+		Expect(hit).To(BeTrue())
+	})
+	It("gives the cached responses a new ID and creation time", func() {
+		rc := newResponseCache(2, 0)
+		rc.add("a", OpenAIResponse{ID: "chatcmpl-1", Created: 1})
+		resp, hit := rc.get(c, "a")
+		Expect(hit).To(BeTrue())
+		Expect(resp.ID).To(HavePrefix("chatcmpl-"))
+		Expect(resp.ID).ToNot(Equal("chatcmpl-1"))
+		Expect(resp.Created).To(BeNumerically(">", 1))
+
+		rc.add("b", OpenAIResponse{Object: "edit"})
+		resp, _ = rc.get(c, "b")
+		Expect(resp.ID).To(BeEmpty())
+	})
+	It("expires the responses", func() {
+		rc := newResponseCache(2, 50*time.Millisecond)
+		rc.add("a", OpenAIResponse{ID: "a"})
+		_, hit := rc.get(c, "a")
+		Expect(hit).To(BeTrue())
+		Eventually(func() bool {
+			_, hit := rc.get(c, "a")
+			return hit
+		}).Should(BeFalse())
+	})
+	It("is disabled without a size", func() {
+		rc := newResponseCache(0, time.Minute)
+		Expect(rc).To(BeNil())
+		rc.add("a", OpenAIResponse{ID: "a"})
+		_, hit := rc.get(c, "a")
+		Expect(hit).To(BeFalse())
+	})
+
+	Context("of the endpoints", func() {
+		var app *fiber.App
+
+		BeforeEach(func() {
+			app, _ = echoApp(map[string]string{
+				"echo.yaml": "name: echo\nbackend: echo\nparameters:\n  model: model.bin\n",
+			}, WithResponseCache(8, time.Minute))
+		})
+
+		complete := func(path, body string) *http.Response {
+			req := httptest.NewRequest("POST", path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+			return resp
+		}
+
+		It("replies the cached response to the deterministic requests", func() {
+			for _, body := range []string{
+				`{"model": "echo", "prompt": "Hi", "temperature": 0}`,
+				`{"model": "echo", "prompt": "Hi", "seed": 42}`,
+			} {
+				Expect(complete("/v1/completions", body).Header.Get(cacheHeader)).To(Equal("MISS"))
+				Expect(complete("/v1/completions", body).Header.Get(cacheHeader)).To(Equal("HIT"))
+				Expect(complete("/completions", body).Header.Get(cacheHeader)).To(Equal("HIT"))
+			}
+			Expect(complete("/v1/completions", `{"model": "echo", "prompt": "Hello", "temperature": 0}`).Header.Get(cacheHeader)).To(Equal("MISS"))
+			Expect(complete("/v1/completions", `{"model": "echo", "prompt": "Hi", "temperature": 0, "top_k": 1}`).Header.Get(cacheHeader)).To(Equal("MISS"))
+		})
+		It("keys the edits on the prompts given to the model", func() {
+			edit := func(instruction string) *http.Response {
+				return complete("/v1/edits", `{"model": "echo", "input": "Hi", "instruction": "`+instruction+`", "temperature": 0}`)
+			}
+			Expect(edit("Be nice").Header.Get(cacheHeader)).To(Equal("MISS"))
+			Expect(edit("Be nice").Header.Get(cacheHeader)).To(Equal("HIT"))
+			Expect(edit("Be rude").Header.Get(cacheHeader)).To(Equal("MISS"))
+		})
+		It("zeroes the timings of the cached responses", func() {
+			timings := func() *Timings {
+				resp := OpenAIResponse{}
+				Expect(json.NewDecoder(complete("/v1/completions", `{"model": "echo", "prompt": "Hi", "temperature": 0, "timings": true}`).Body).Decode(&resp)).To(Succeed())
+				return resp.Timings
+			}
+			Expect(timings().PromptTokens).ToNot(BeZero())
+			Expect(timings()).To(Equal(&Timings{}))
+		})
+		It("doesn't cache the other requests", func() {
+			for i := 0; i < 2; i++ {
+				Expect(complete("/v1/completions", `{"model": "echo", "prompt": "Hi", "temperature": 0.5}`).Header.Get(cacheHeader)).To(BeEmpty())
+			}
+		})
+	})
+})
@@ -1,37 +1,547 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/fsnotify/fsnotify"
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	OpenAIRequest  `yaml:"parameters"`
-	Name           string            `yaml:"name"`
-	StopWords      []string          `yaml:"stopwords"`
-	Cutstrings     []string          `yaml:"cutstrings"`
-	TrimSpace      []string          `yaml:"trimspace"`
-	ContextSize    int               `yaml:"context_size"`
-	F16            bool              `yaml:"f16"`
-	Threads        int               `yaml:"threads"`
-	Debug          bool              `yaml:"debug"`
-	Roles          map[string]string `yaml:"roles"`
-	Backend        string            `yaml:"backend"`
-	TemplateConfig TemplateConfig    `yaml:"template"`
+	OpenAIRequest    `yaml:"parameters" json:"parameters"`
+	Name             string              `yaml:"name" json:"name"`
+	StopWords        []string            `yaml:"stopwords" json:"stopwords"`
+	ReplaceStopWords bool                `yaml:"replace_stopwords" json:"replace_stopwords"`
+	Cutstrings       []string            `yaml:"cutstrings" json:"cutstrings"`
+	TrimSpace        []string            `yaml:"trimspace" json:"trimspace"`
+	ContextSize      int                 `yaml:"context_size" json:"context_size"`
+	F16              bool                `yaml:"f16" json:"f16"`
+	Threads          int                 `yaml:"threads" json:"threads"`
+	Parallel         int                 `yaml:"parallel" json:"parallel"`
+	Debug            bool                `yaml:"debug" json:"debug"`
+	Roles            map[string]string   `yaml:"roles" json:"roles"`
+	Backend          string              `yaml:"backend" json:"backend"`
+	Aliases          []string            `yaml:"aliases" json:"aliases"`
+	Timeout          int                 `yaml:"timeout" json:"timeout"`
+	SystemPrompt     string              `yaml:"system_prompt" json:"system_prompt"`
+	Moderation       map[string][]string `yaml:"moderation" json:"moderation"`
+	MLock            bool                `yaml:"mlock" json:"mlock"`
+	Truncate         string              `yaml:"truncate" json:"truncate"`
+	DownloadURL      string              `yaml:"download_url" json:"download_url"`
+	SHA256           string              `yaml:"sha256" json:"sha256"`
+	TemplateConfig   TemplateConfig      `yaml:"template" json:"template"`
+	// Enabled set to false makes the model unavailable while keeping its
+	// config, e.g. while it is downloaded again. Nil is true
+	Enabled *bool `yaml:"enabled" json:"enabled"`
+	// ExtraParameters lists the extra parameters the requests can set, see
+	// extraParameters
+	ExtraParameters []string `yaml:"extra_parameters" json:"extra_parameters"`
+	// SingleActivePredictions runs the predictions on the model one at a
+	// time, whatever Parallel, on a single instance of the model
+	SingleActivePredictions bool `yaml:"single_active_predictions" json:"single_active_predictions"`
+	// AssistantPrefix is appended as the last line of the chat prompts, e.g.
+	// "### Assistant:", so the model responds as the assistant
+	AssistantPrefix string `yaml:"assistant_prefix" json:"assistant_prefix"`
+	// StreamUsage ends the streams with the usage chunk, whether the request
+	// asked for it in its stream_options or not
+	StreamUsage bool `yaml:"stream_usage" json:"stream_usage"`
+	// RateLimit caps the requests to the model per minute, the ones past it
+	// are rejected with a 429. 0 is unlimited
+	RateLimit int `yaml:"rate_limit" json:"rate_limit"`
+	// PromptCache memoizes the tokens of the prompts of the model, up to
+	// PromptCacheSize of them, see promptCache
+	PromptCache     bool `yaml:"prompt_cache" json:"prompt_cache"`
+	PromptCacheSize int  `yaml:"prompt_cache_size" json:"prompt_cache_size"`
+	// GrammarFile is a file of the GBNF grammar to constrain the predictions
+	// to, rejected as Grammar is
+	GrammarFile string `yaml:"grammar_file" json:"grammar_file"`
+	// MainGPU and TensorSplit split the model across the GPUs. The bindings
+	// of this build don't offload to GPUs, so they are rejected, see Validate
+	MainGPU     *int      `yaml:"main_gpu" json:"main_gpu"`
+	TensorSplit []float64 `yaml:"tensor_split" json:"tensor_split"`
+	// GPULayers, MMap and LowVRAM tune the offloading of the model to the
+	// GPU and its loading, rejected as MainGPU is: the bindings of this build
+	// always load the models with mmap
+	GPULayers int   `yaml:"gpu_layers" json:"gpu_layers"`
+	MMap      *bool `yaml:"mmap" json:"mmap"`
+	LowVRAM   bool  `yaml:"low_vram" json:"low_vram"`
+
+	InputStrings []string `yaml:"-" json:"-"`
+	// Extra holds the extra parameters set by the request
+	Extra map[string]interface{} `yaml:"-" json:"-"`
+
+	// cutstrings holds the compiled Cutstrings, see compileCutstrings
+	cutstrings []*regexp.Regexp
+	// dir is the directory of the file the config was read from, where its
+	// templates are looked up before the models path
+	dir string
+	// file is the file the config was read from, if any, to reload it
+	file string
+	// logger is the logger of the request the config was read for, adding
+	// its id to the lines, see configLogger
+	logger *zerolog.Logger
+	// truncated is the number of tokens of the prompt of the request which
+	// were dropped, or which don't fit, in the context, see promptOverflow
+	truncated int
+	// backends are the backends of the app the config was read for, see
+	// availableBackends
+	backends map[string]BackendFunc
 }
 
 type TemplateConfig struct {
-	Completion string `yaml:"completion"`
-	Chat       string `yaml:"chat"`
-	Edit       string `yaml:"edit"`
+	Completion string `yaml:"completion" json:"completion"`
+	Chat       string `yaml:"chat" json:"chat"`
+	Edit       string `yaml:"edit" json:"edit"`
+	// Strict fails the requests when the templates can't be rendered,
+	// rather than using their input as is
+	Strict bool `yaml:"strict" json:"strict"`
+}
+
+// clone returns a deep copy of the config, so the requests can change their
+// config without changing the one of the merger.
+func (c Config) clone() Config {
+	c.OpenAIRequest = c.OpenAIRequest.clone()
+	c.StopWords = cloneStrings(c.StopWords)
+	c.Cutstrings = cloneStrings(c.Cutstrings)
+	c.TrimSpace = cloneStrings(c.TrimSpace)
+	c.Aliases = cloneStrings(c.Aliases)
+	c.InputStrings = cloneStrings(c.InputStrings)
+	c.ExtraParameters = cloneStrings(c.ExtraParameters)
+	if c.Extra != nil {
+		extra := make(map[string]interface{}, len(c.Extra))
+		for k, v := range c.Extra {
+			extra[k] = v
+		}
+		c.Extra = extra
+	}
+	if c.cutstrings != nil {
+		c.cutstrings = append([]*regexp.Regexp{}, c.cutstrings...)
+	}
+	if c.Roles != nil {
+		roles := make(map[string]string, len(c.Roles))
+		for k, v := range c.Roles {
+			roles[k] = v
+		}
+		c.Roles = roles
+	}
+	if c.Moderation != nil {
+		moderation := make(map[string][]string, len(c.Moderation))
+		for k, v := range c.Moderation {
+			moderation[k] = cloneStrings(v)
+		}
+		c.Moderation = moderation
+	}
+	if c.Enabled != nil {
+		enabled := *c.Enabled
+		c.Enabled = &enabled
+	}
+	return c
+}
+
+// serialized reports whether the predictions on the model run one at a time,
+// queueing behind each other. The requests to the other models still run in
+// parallel. None of the backends is reentrant, so the predictions on an
+// instance of the model are always serialized, see ModelLoader.PredictionLock
+func (c *Config) serialized() bool {
+	return c.SingleActivePredictions || c.Parallel <= 1
+}
+
+// replicas returns the number of instances of the model the predictions run
+// on at once, see ModelLoader.AcquireReplica
+func (c *Config) replicas() int {
+	if c.serialized() || c.Parallel < 1 {
+		return 1
+	}
+	return c.Parallel
+}
+
+// disabled reports whether the config sets enabled to false
+func (c *Config) disabled() bool {
+	return c.Enabled != nil && !*c.Enabled
+}
+
+// availableBackends returns the backends the config can select: the ones of
+// the app it was read for, or the built-in ones for a config read alone
+func (c *Config) availableBackends() map[string]BackendFunc {
+	if c.backends == nil {
+		return backends
+	}
+	return c.backends
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+// modelFileConfig returns the config serving the model file with the default
+// parameters, named after the file without its extension. A relative file
+// missing from the working directory is looked for in the models path. The
+// model is referred to relative to the models path, as in the config files,
+// even when it is out of it.
+func modelFileConfig(modelPath, file string) (Config, error) {
+	if _, err := os.Stat(file); err != nil && !filepath.IsAbs(file) {
+		file = filepath.Join(modelPath, file)
+	}
+	if _, err := os.Stat(file); err != nil {
+		return Config{}, fmt.Errorf("cannot read model file: %w", err)
+	}
+
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return Config{}, err
+	}
+	root, err := filepath.Abs(modelPath)
+	if err != nil {
+		return Config{}, err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return Config{}, err
+	}
+
+	c := Config{
+		Name:          strings.TrimSuffix(filepath.Base(abs), filepath.Ext(abs)),
+		OpenAIRequest: defaultRequest(rel),
+	}
+	if err := c.prepare(filepath.Dir(abs)); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// ConfigMerger holds the model configs by name. It is safe for concurrent
+// use, as configs can be (re)loaded while requests are being served.
+type ConfigMerger struct {
+	configs map[string]Config
+	// aliases maps the aliases to the name of their config
+	aliases map[string]string
+	// defaults holds the settings of the defaults file the config files of
+	// the models path are read over, see LoadConfigs
+	defaults map[string]interface{}
+	// backends are the backends of the app the configs are read for, nil
+	// for the built-in ones
+	backends map[string]BackendFunc
+	// logger logs the configs loaded, reloaded and skipped, nil for the
+	// global logger
+	logger *zerolog.Logger
+	// loaded is set once the configs of the models path are loaded, with
+	// the error they were loaded with, see LoadConfigs
+	loaded  bool
+	loadErr error
+	sync.RWMutex
+}
+
+func NewConfigMerger() *ConfigMerger {
+	return &ConfigMerger{
+		configs: make(map[string]Config),
+		aliases: make(map[string]string),
+	}
+}
+
+// log returns the logger of the merger, see ConfigMerger.logger
+func (cm *ConfigMerger) log() *zerolog.Logger {
+	if cm.logger != nil {
+		return cm.logger
+	}
+	return &log.Logger
+}
+
+// Get returns the config of the model name, if any. The name can be one of
+// the aliases of the config.
+func (cm *ConfigMerger) Get(name string) (Config, bool) {
+	cm.RLock()
+	defer cm.RUnlock()
+	c, exists := cm.configs[name]
+	if !exists {
+		if n, isAlias := cm.aliases[name]; isAlias {
+			c, exists = cm.configs[n]
+		}
+	}
+	return c, exists
+}
+
+// Set adds or replaces the config of the model name.
+func (cm *ConfigMerger) Set(name string, c Config) {
+	cm.Lock()
+	defer cm.Unlock()
+	cm.set(name, c)
 }
 
-type ConfigMerger map[string]Config
+// Delete drops the config of the model name.
+func (cm *ConfigMerger) Delete(name string) {
+	cm.Lock()
+	defer cm.Unlock()
+	cm.delete(name)
+}
+
+// set and delete update the configs along their aliases. The lock must be
+// held.
+func (cm *ConfigMerger) set(name string, c Config) {
+	cm.delete(name)
+	cm.configs[name] = c
+	for _, alias := range c.Aliases {
+		cm.aliases[alias] = name
+	}
+}
+
+func (cm *ConfigMerger) delete(name string) {
+	for _, alias := range cm.configs[name].Aliases {
+		if cm.aliases[alias] == name {
+			delete(cm.aliases, alias)
+		}
+	}
+	delete(cm.configs, name)
+}
+
+// List returns the names of the configured models, sorted.
+func (cm *ConfigMerger) List() []string {
+	cm.RLock()
+	defer cm.RUnlock()
+	names := make([]string, 0, len(cm.configs))
+	for k := range cm.configs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isConfigFile reports whether the file name is a model config file.
+func isConfigFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// unmarshalConfig decodes a config file, as JSON or YAML depending on its
+// extension.
+func unmarshalConfig(file string, data []byte, out interface{}) error {
+	var err error
+	if filepath.Ext(file) == ".json" {
+		err = json.Unmarshal(data, out)
+	} else {
+		err = yaml.Unmarshal(data, out)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal config file %s: %w", file, err)
+	}
+	return nil
+}
+
+// UnmarshalYAML reads the config over the default parameters, so the ones it
+// leaves out keep their default while the ones it sets to zero are honored.
+func (c *Config) UnmarshalYAML(value *yaml.Node) error {
+	type config Config
+	cfg := config{OpenAIRequest: defaultRequest("")}
+	if err := value.Decode(&cfg); err != nil {
+		return err
+	}
+	*c = Config(cfg)
+	return nil
+}
+
+// UnmarshalJSON reads the config over the default parameters, as UnmarshalYAML
+// does.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type config Config
+	cfg := config{OpenAIRequest: defaultRequest("")}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	*c = Config(cfg)
+	return nil
+}
+
+// compileCutstrings compiles the cutstrings regular expressions once, when the
+// config is loaded, so invalid expressions are reported early.
+func (c *Config) compileCutstrings() error {
+	c.cutstrings = make([]*regexp.Regexp, 0, len(c.Cutstrings))
+	for _, cs := range c.Cutstrings {
+		reg, err := regexp.Compile(cs)
+		if err != nil {
+			return fmt.Errorf("invalid cutstring %q in config %q: %w", cs, c.Name, err)
+		}
+		c.cutstrings = append(c.cutstrings, reg)
+	}
+	return nil
+}
+
+// prepare applies the environment overrides to the config once it is decoded,
+// then compiles what it refers to. Its files are relative to dir.
+func (c *Config) prepare(dir string) error {
+	c.dir = dir
+	if err := c.applyEnv(os.Environ()); err != nil {
+		return err
+	}
+	return c.compileCutstrings()
+}
+
+// templateExists reports whether the template is in the directory of the
+// config or in the models path, or is built in
+func (c *Config) templateExists(modelPath, name string) bool {
+	_, ok := c.templateFile(modelPath, name)
+	return ok
+}
+
+// templateFile returns the file of the template as the loader looks it up, in
+// the directory of the config then in the models path. The file is empty for
+// the built-in templates, and ok false when the template is missing.
+func (c *Config) templateFile(modelPath, name string) (file string, ok bool) {
+	for _, dir := range []string{c.dir, modelPath} {
+		if dir == "" {
+			continue
+		}
+		file := filepath.Join(dir, name+".tmpl")
+		if _, err := os.Stat(file); err == nil {
+			return file, true
+		}
+	}
+	_, ok = model.BuiltinTemplates[name]
+	return "", ok
+}
+
+// Validate checks the config against the models path: the model it refers to
+// must exist there, and its templates there or in the directory of the
+// config, the numeric settings must be in range and the cutstrings must
+// compile. All the problems are reported.
+func (c *Config) Validate(modelPath string) error {
+	var err error
+	invalid := func(format string, a ...interface{}) {
+		err = multierror.Append(err, fmt.Errorf(format, a...))
+	}
+
+	if c.Name == "" {
+		invalid("name is required")
+	}
+	// models with a download URL are fetched when first loaded, and the
+	// disabled ones can be missing until enabled again
+	if c.Model != "" && c.DownloadURL == "" && !c.disabled() {
+		if _, serr := os.Stat(filepath.Join(modelPath, c.Model)); serr != nil {
+			invalid("model %q not found in %s", c.Model, modelPath)
+		}
+	}
+	for _, t := range []string{c.TemplateConfig.Completion, c.TemplateConfig.Chat, c.TemplateConfig.Edit} {
+		if t == "" {
+			continue
+		}
+		if !c.templateExists(modelPath, t) {
+			where := modelPath
+			if c.dir != "" && filepath.Clean(c.dir) != filepath.Clean(modelPath) {
+				where = c.dir + " nor " + modelPath
+			}
+			invalid("template %q not found in %s", t+".tmpl", where)
+		}
+	}
+
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"context_size", c.ContextSize},
+		{"threads", c.Threads},
+		{"parallel", c.Parallel},
+		{"timeout", c.Timeout},
+		{"rate_limit", c.RateLimit},
+		{"prompt_cache_size", c.PromptCacheSize},
+		{"top_k", c.TopK},
+		{"batch", c.Batch},
+	} {
+		if field.value < 0 {
+			invalid("%s must not be negative, got %d", field.name, field.value)
+		}
+	}
+	// the settings the backends of this build can't apply are rejected
+	// rather than ignored
+	for _, field := range []struct {
+		name   string
+		set    bool
+		reason string
+	}{
+		{"grammar", c.Grammar != "", noGrammar},
+		{"grammar_file", c.GrammarFile != "", noGrammar},
+		{"main_gpu", c.MainGPU != nil, noGPU},
+		{"tensor_split", len(c.TensorSplit) > 0, noGPU},
+		{"gpu_layers", c.GPULayers != 0, noGPU},
+		{"low_vram", c.LowVRAM, noGPU},
+		{"mmap", c.MMap != nil, "its llama.cpp bindings always load the models with mmap"},
+	} {
+		if field.set {
+			invalid("%s is unsupported by this build, %s", field.name, field.reason)
+		}
+	}
+	if c.Maxtokens < -1 {
+		invalid("max_tokens must be -1 or more, got %d", c.Maxtokens)
+	}
+	if c.Keep < -1 {
+		invalid("n_keep must be -1 or more, got %d", c.Keep)
+	}
+	if c.TopP < 0 || c.TopP > 1 {
+		invalid("top_p must be between 0 and 1, got %g", c.TopP)
+	}
+	switch c.Truncate {
+	case "", "none", "oldest":
+	default:
+		invalid("truncate must be none or oldest, got %q", c.Truncate)
+	}
+	if c.Temperature < 0 {
+		invalid("temperature must not be negative, got %g", c.Temperature)
+	}
+	if c.TFSZ < 0 || c.TFSZ > 1 {
+		invalid("tfs_z must be between 0 and 1, got %g", c.TFSZ)
+	}
+	if c.TypicalP < 0 || c.TypicalP > 1 {
+		invalid("typical_p must be between 0 and 1, got %g", c.TypicalP)
+	}
+	if c.Mirostat < 0 || c.Mirostat > 2 {
+		invalid("mirostat must be 0, 1 or 2, got %d", c.Mirostat)
+	}
+	if c.MirostatTau < 0 || c.MirostatEta < 0 {
+		invalid("mirostat_tau and mirostat_eta must not be negative")
+	}
+	if berr := validateLogitBias(c.LogitBias); berr != nil {
+		invalid("%s", berr.Error())
+	}
+	for _, name := range c.ExtraParameters {
+		if _, ok := extraParameters[name]; !ok {
+			invalid("unknown extra parameter %q, available extra parameters: %s", name, strings.Join(extraParameterNames(), ", "))
+		}
+	}
+	if _, ok := c.availableBackends()[strings.ToLower(c.Backend)]; c.Backend != "" && !ok {
+		invalid("unknown backend %q, available backends: %s", c.Backend, strings.Join(backendNames(c.availableBackends()), ", "))
+	}
+
+	for _, stop := range c.StopWords {
+		if stop == "" {
+			invalid("stopwords must not be empty")
+		}
+	}
+	for _, cs := range c.Cutstrings {
+		if _, cerr := regexp.Compile(cs); cerr != nil {
+			invalid("invalid cutstring %q: %s", cs, cerr.Error())
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid config %q: %w", c.Name, err)
+	}
+	return nil
+}
 
 func ReadConfigFile(file string) ([]*Config, error) {
 	c := &[]*Config{}
@@ -39,8 +549,15 @@ func ReadConfigFile(file string) ([]*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot read config file: %w", err)
 	}
-	if err := yaml.Unmarshal(f, c); err != nil {
-		return nil, fmt.Errorf("cannot unmarshal config file: %w", err)
+	if err := unmarshalConfig(file, f, c); err != nil {
+		return nil, err
+	}
+
+	for _, cc := range *c {
+		if err := cc.prepare(filepath.Dir(file)); err != nil {
+			return nil, err
+		}
+		cc.file = file
 	}
 
 	return *c, nil
@@ -52,51 +569,307 @@ func ReadConfig(file string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot read config file: %w", err)
 	}
-	if err := yaml.Unmarshal(f, c); err != nil {
-		return nil, fmt.Errorf("cannot unmarshal config file: %w", err)
+	if err := unmarshalConfig(file, f, c); err != nil {
+		return nil, err
 	}
 
+	if err := c.prepare(filepath.Dir(file)); err != nil {
+		return nil, err
+	}
+	c.file = file
+
 	return c, nil
 }
 
-func (cm ConfigMerger) LoadConfigFile(file string) error {
+// readConfigs decodes either a config or a list of configs, as JSON or YAML,
+// over the settings of the defaults file, as the config files of the models
+// path are. The files they refer to are relative to dir.
+func (cm *ConfigMerger) readConfigs(data []byte, isJSON bool, dir string) ([]*Config, error) {
+	unmarshal := yaml.Unmarshal
+	if isJSON {
+		unmarshal = json.Unmarshal
+	}
+
+	list := []map[string]interface{}{}
+	if err := unmarshal(data, &list); err != nil {
+		settings := map[string]interface{}{}
+		if err := unmarshal(data, &settings); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal config: %w", err)
+		}
+		list = []map[string]interface{}{settings}
+	}
+
+	cm.RLock()
+	defaults, appBackends := cm.defaults, cm.backends
+	cm.RUnlock()
+
+	configs := []*Config{}
+	for _, settings := range list {
+		data, err := yaml.Marshal(mergeSettings(defaults, settings))
+		if err != nil {
+			return nil, err
+		}
+		c := &Config{}
+		if err := yaml.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal config: %w", err)
+		}
+		if c.Name == "" {
+			return nil, fmt.Errorf("config without a name")
+		}
+		if err := c.prepare(dir); err != nil {
+			return nil, err
+		}
+		c.backends = appBackends
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
+
+func (cm *ConfigMerger) LoadConfigFile(file string) error {
 	c, err := ReadConfigFile(file)
 	if err != nil {
 		return fmt.Errorf("cannot load config file: %w", err)
 	}
 
+	cm.Lock()
+	defer cm.Unlock()
 	for _, cc := range c {
-		cm[cc.Name] = *cc
+		cm.set(cc.Name, *cc)
 	}
 	return nil
 }
 
-func (cm ConfigMerger) LoadConfig(file string) error {
-	c, err := ReadConfig(file)
+func (cm *ConfigMerger) LoadConfig(file string) error {
+	c, err := cm.readConfig(file)
 	if err != nil {
 		return fmt.Errorf("cannot read config file: %w", err)
 	}
 
-	cm[c.Name] = *c
+	cm.Set(c.Name, *c)
 	return nil
 }
 
-func (cm ConfigMerger) LoadConfigs(path string) error {
-	files, err := ioutil.ReadDir(path)
+// LoadConfigs loads the config files found in path and its subdirectories.
+// The models they refer to are relative to path, the templates are looked up
+// in the directory of their config first. When several files declare the same
+// name, the last one in lexical order wins.
+//
+// The configs are read over the settings of the defaults.yaml file of path,
+// if any: the settings they leave out fall back to the ones of the defaults.
+//
+// The merger is reported as loaded once done, with the error returned, see
+// loadState.
+func (cm *ConfigMerger) LoadConfigs(path string) error {
+	err := cm.loadConfigs(path)
+	cm.Lock()
+	cm.loaded, cm.loadErr = true, err
+	cm.Unlock()
+	return err
+}
+
+// loadState returns whether the configs of the models path were loaded, and
+// the error they were loaded with, see LoadConfigs
+func (cm *ConfigMerger) loadState() (bool, error) {
+	cm.RLock()
+	defer cm.RUnlock()
+	return cm.loaded, cm.loadErr
+}
+
+func (cm *ConfigMerger) loadConfigs(path string) error {
+	defaults, err := readDefaults(path)
 	if err != nil {
 		return err
 	}
+	cm.Lock()
+	cm.defaults = defaults
+	cm.Unlock()
 
-	for _, file := range files {
-		// Skip templates, YAML and .keep files
-		if !strings.Contains(file.Name(), ".yaml") {
-			continue
+	// the file each name was loaded from, to report the duplicates
+	loaded := map[string]string{}
+
+	return filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip directories, models, templates, .keep files and the defaults
+		if d.IsDir() || !isConfigFile(d.Name()) || isDefaultsFile(path, file) {
+			return nil
 		}
-		c, err := ReadConfig(filepath.Join(path, file.Name()))
+
+		rel, _ := filepath.Rel(path, file)
+		c, err := cm.readConfig(file)
 		if err == nil {
-			cm[c.Name] = *c
+			err = c.Validate(path)
+		}
+		if err != nil {
+			cm.log().Warn().Msgf("skipping config file %s: %s", rel, err.Error())
+			return nil
+		}
+
+		if previous, exists := loaded[c.Name]; exists {
+			cm.log().Warn().Msgf("config %s of %s overrides the one of %s", c.Name, rel, previous)
+		}
+		loaded[c.Name] = rel
+		cm.Set(c.Name, *c)
+		return nil
+	})
+}
+
+// ReloadConfig reads the config of the model name again, from the file it was
+// loaded from or else from the name.yaml file of modelPath, and replaces it
+// once validated against modelPath. The name can be one of the aliases of the
+// config. It returns an error wrapping os.ErrNotExist when the file is gone.
+func (cm *ConfigMerger) ReloadConfig(name, modelPath string) (*Config, error) {
+	file := filepath.Join(modelPath, name+".yaml")
+	old, exists := cm.Get(name)
+	if exists {
+		name = old.Name
+		if old.file != "" {
+			file = old.file
 		}
 	}
 
-	return nil
+	if _, err := os.Stat(file); err != nil {
+		return nil, fmt.Errorf("cannot reload config %s: %w", name, err)
+	}
+	c, err := cm.readConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Validate(modelPath); err != nil {
+		return nil, err
+	}
+
+	cm.Lock()
+	defer cm.Unlock()
+	// the file may have renamed the model
+	if exists {
+		cm.delete(name)
+	}
+	cm.set(c.Name, *c)
+	return c, nil
+}
+
+// Watch reloads the config files in path and its subdirectories as they are
+// created or changed, and drops the configs of the files which are removed.
+// As with LoadConfigs, the configs are validated against path and the invalid
+// ones are skipped. The watcher stops once it is closed.
+func (cm *ConfigMerger) Watch(path string) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	// Track the config name declared by each file, so it can be dropped when
+	// the file goes away or renames the model.
+	names := map[string]string{}
+	err = filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return watcher.Add(file)
+		}
+		if !isConfigFile(d.Name()) || isDefaultsFile(path, file) {
+			return nil
+		}
+		if c, err := cm.readConfig(file); err == nil {
+			names[file] = c.Name
+		}
+		return nil
+	})
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				cm.handleConfigEvent(watcher, path, event, names)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				cm.log().Error().Msgf("config watcher error: %s", err.Error())
+			}
+		}
+	}()
+
+	return watcher, nil
+}
+
+func (cm *ConfigMerger) handleConfigEvent(watcher *fsnotify.Watcher, path string, event fsnotify.Event, names map[string]string) {
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			cm.watchDir(watcher, path, event.Name, names)
+			return
+		}
+	}
+	if isDefaultsFile(path, event.Name) {
+		return
+	}
+
+	switch {
+	case event.Has(fsnotify.Create), event.Has(fsnotify.Write):
+		if isConfigFile(event.Name) {
+			cm.reloadConfigFile(path, event.Name, names)
+		}
+	case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+		// the event may be the one of a directory, dropping the configs of
+		// the files it held
+		for file, name := range names {
+			if file != event.Name && !strings.HasPrefix(file, event.Name+string(filepath.Separator)) {
+				continue
+			}
+			cm.Delete(name)
+			delete(names, file)
+			cm.log().Info().Msgf("removed config %s of %s", name, file)
+		}
+	}
+}
+
+// watchDir watches the directory dir created in path, and loads the config
+// files already written to it.
+func (cm *ConfigMerger) watchDir(watcher *fsnotify.Watcher, path, dir string, names map[string]string) {
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return watcher.Add(file)
+		}
+		if isConfigFile(d.Name()) {
+			cm.reloadConfigFile(path, file, names)
+		}
+		return nil
+	})
+	if err != nil {
+		cm.log().Error().Msgf("cannot watch %s: %s", dir, err.Error())
+	}
+}
+
+// reloadConfigFile reads the config file of path again and replaces the
+// config it declared, unless it is invalid.
+func (cm *ConfigMerger) reloadConfigFile(path, file string, names map[string]string) {
+	c, err := cm.readConfig(file)
+	if err == nil {
+		err = c.Validate(path)
+	}
+	if err != nil {
+		cm.log().Warn().Msgf("skipping config file %s: %s", file, err.Error())
+		return
+	}
+	cm.Lock()
+	if old, exists := names[file]; exists && old != c.Name {
+		cm.delete(old)
+	}
+	cm.set(c.Name, *c)
+	cm.Unlock()
+	names[file] = c.Name
+	cm.log().Info().Msgf("reloaded config %s from %s", c.Name, file)
 }
@@ -0,0 +1,495 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	llama "github.com/go-skynet/go-llama.cpp"
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+var _ = Describe("Config", func() {
+	var tmpdir string
+
+	BeforeEach(func() {
+		var err error
+		tmpdir, err = os.MkdirTemp("", "localai-config")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpdir)
+	})
+
+	writeFile := func(name, content string) string {
+		file := filepath.Join(tmpdir, name)
+		Expect(os.WriteFile(file, []byte(content), 0600)).To(Succeed())
+		return file
+	}
+
+	Context("cutstrings", func() {
+		It("are compiled when the config is loaded", func() {
+			file := writeFile("foo.yaml", "name: foo\ncutstrings:\n- \"^### Response:\\\\s*\"\n")
+			c, err := ReadConfig(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(Finetune(*c, "", "### Response:  bar")).To(Equal("bar"))
+		})
+		It("fail the load when invalid", func() {
+			file := writeFile("foo.yaml", "name: foo\ncutstrings:\n- \"(\"\n")
+			_, err := ReadConfig(file)
+			Expect(err).To(MatchError(ContainSubstring("invalid cutstring")))
+
+			file = writeFile("list.yaml", "- name: foo\n  cutstrings:\n  - \"(\"\n")
+			_, err = ReadConfigFile(file)
+			Expect(err).To(MatchError(ContainSubstring("invalid cutstring")))
+		})
+	})
+
+	Context("validation", func() {
+		It("reports all the problems of the config", func() {
+			writeFile("model.bin", "")
+			writeFile("chat.tmpl", "{{.Input}}")
+			c := &Config{Name: "foo", ContextSize: 512, TemplateConfig: TemplateConfig{Chat: "chat"}}
+			c.Model = "model.bin"
+			c.TopP = 0.7
+			Expect(c.Validate(tmpdir)).To(Succeed())
+
+			c.Model = "missing.bin"
+			c.TemplateConfig.Completion = "missing"
+			c.ContextSize = -1
+			c.TopP = 2
+			c.Backend = "gpt4all"
+			c.ExtraParameters = []string{"min_p"}
+			c.LogitBias = map[string]float64{"50256": -100, "15043": 5}
+			err := c.Validate(tmpdir)
+			Expect(err).To(MatchError(ContainSubstring(`model "missing.bin" not found`)))
+			Expect(err).To(MatchError(ContainSubstring(`template "missing.tmpl" not found`)))
+			Expect(err).To(MatchError(ContainSubstring("context_size must not be negative")))
+			Expect(err).To(MatchError(ContainSubstring("logit_bias can hold a single bias")))
+			Expect(err).To(MatchError(ContainSubstring("top_p must be between 0 and 1")))
+			Expect(err).To(MatchError(ContainSubstring(`unknown backend "gpt4all", available backends: gpt2, gptj, llama, rwkv, stablelm, whisper`)))
+			Expect(err).To(MatchError(ContainSubstring(`unknown extra parameter "min_p", available extra parameters: f16_kv, penalize_nl, repeat_last_n`)))
+		})
+		It("rejects the settings unsupported by this build", func() {
+			file := writeFile("foo.yaml", "name: foo\ngrammar_file: json.gbnf\nparameters:\n  grammar: 'root ::= \"yes\"'\n")
+			c, err := ReadConfig(file)
+			Expect(err).ToNot(HaveOccurred())
+			err = c.Validate(tmpdir)
+			Expect(err).To(MatchError(ContainSubstring("grammar is unsupported by this build")))
+			Expect(err).To(MatchError(ContainSubstring("grammar_file is unsupported by this build")))
+
+			file = writeFile("bar.yaml", "name: bar\nmain_gpu: 0\ntensor_split: [0.5, 0.5]\n")
+			c, err = ReadConfig(file)
+			Expect(err).ToNot(HaveOccurred())
+			err = c.Validate(tmpdir)
+			Expect(err).To(MatchError(ContainSubstring("main_gpu is unsupported by this build")))
+			Expect(err).To(MatchError(ContainSubstring("tensor_split is unsupported by this build")))
+
+			file = writeFile("baz.yaml", "name: baz\ngpu_layers: 35\nmmap: false\nlow_vram: true\nmlock: true\n")
+			c, err = ReadConfig(file)
+			Expect(err).ToNot(HaveOccurred())
+			err = c.Validate(tmpdir)
+			Expect(err).To(MatchError(ContainSubstring("gpu_layers is unsupported by this build")))
+			Expect(err).To(MatchError(ContainSubstring("mmap is unsupported by this build")))
+			Expect(err).To(MatchError(ContainSubstring("low_vram is unsupported by this build")))
+			Expect(err).ToNot(MatchError(ContainSubstring("mlock")))
+		})
+		It("skips the invalid config files of the models path", func() {
+			writeFile("model.bin", "")
+			writeFile("foo.yaml", "name: foo\nparameters:\n  model: model.bin\n")
+			writeFile("bar.yaml", "name: bar\nparameters:\n  model: missing.bin\n")
+			var buf bytes.Buffer
+			logger := zerolog.New(&buf)
+			cm := NewConfigMerger()
+			cm.logger = &logger
+			Expect(cm.LoadConfigs(tmpdir)).To(Succeed())
+			Expect(cm.List()).To(Equal([]string{"foo"}))
+			Expect(buf.String()).To(ContainSubstring("skipping config file bar.yaml"))
+		})
+		It("accepts the backends added to the app only", func() {
+			writeFile("echo.yaml", "name: echo\nbackend: echo\n")
+			echo := func(*model.ModelLoader, string, []llama.ModelOption, uint32) (interface{}, error) {
+				return nil, nil
+			}
+
+			o := newOptions(WithModelLoader(model.NewModelLoader(tmpdir)), WithBackend("echo", echo))
+			c, err := modelConfig(NewConfigMerger(), o, "echo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Backend).To(Equal("echo"))
+
+			o = newOptions(WithModelLoader(model.NewModelLoader(tmpdir)))
+			_, err = modelConfig(NewConfigMerger(), o, "echo")
+			Expect(err).To(MatchError(ContainSubstring(`unknown backend "echo"`)))
+			Expect(backends).ToNot(HaveKey("echo"))
+		})
+	})
+
+	Context("backend tuning", func() {
+		It("is read from the config", func() {
+			file := writeFile("foo.yaml", "name: foo\nmlock: true\n")
+			c, err := ReadConfig(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.MLock).To(BeTrue())
+			Expect(c.Validate(tmpdir)).To(Succeed())
+		})
+		It("serializes the predictions unless they run in parallel", func() {
+			file := writeFile("foo.yaml", "name: foo\nparallel: 4\nsingle_active_predictions: true\n")
+			c, err := ReadConfig(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.serialized()).To(BeTrue())
+
+			Expect(c.replicas()).To(Equal(1))
+
+			Expect((&Config{}).serialized()).To(BeTrue())
+			Expect((&Config{Parallel: 2}).serialized()).To(BeFalse())
+			Expect((&Config{Parallel: 2}).replicas()).To(Equal(2))
+		})
+	})
+
+	Context("defaults file", func() {
+		It("holds the settings the configs leave out", func() {
+			writeFile("model.bin", "")
+			writeFile("defaults.yaml", "threads: 8\ncontext_size: 1024\nroles:\n  user: \"USER:\"\n  assistant: \"ASSISTANT:\"\nparameters:\n  model: model.bin\n  temperature: 0.2\n")
+			writeFile("foo.yaml", "name: foo\ncontext_size: 2048\nroles:\n  user: \"HUMAN:\"\nparameters:\n  top_k: 10\n")
+			writeFile("bar.json", `{"name": "bar", "parameters": {"temperature": 0}}`)
+			cm := NewConfigMerger()
+			Expect(cm.LoadConfigs(tmpdir)).To(Succeed())
+			Expect(cm.List()).To(Equal([]string{"bar", "foo"}))
+
+			foo, _ := cm.Get("foo")
+			Expect(foo.Threads).To(Equal(8))
+			Expect(foo.ContextSize).To(Equal(2048))
+			Expect(foo.Roles).To(Equal(map[string]string{"user": "HUMAN:", "assistant": "ASSISTANT:"}))
+			Expect(foo.Model).To(Equal("model.bin"))
+			Expect(foo.Temperature).To(Equal(0.2))
+			Expect(foo.TopK).To(Equal(10))
+			Expect(foo.TopP).To(Equal(0.7))
+
+			bar, _ := cm.Get("bar")
+			Expect(bar.ContextSize).To(Equal(1024))
+			Expect(bar.Temperature).To(Equal(0.0))
+		})
+		It("can't name a config", func() {
+			writeFile("defaults.yaml", "name: foo\n")
+			Expect(NewConfigMerger().LoadConfigs(tmpdir)).To(MatchError(ContainSubstring("can't set a name")))
+		})
+	})
+
+	Context("environment", func() {
+		It("overrides the settings of the configs", func() {
+			c := &Config{Name: "gpt-3.5", Threads: 4, ContextSize: 512, OpenAIRequest: OpenAIRequest{Temperature: 0.2}}
+			Expect(c.applyEnv([]string{
+				"LOCALAI_THREADS=8",
+				"LOCALAI_CONTEXT_SIZE=1024",
+				"LOCALAI_GPT_3_5_CONTEXT_SIZE=2048",
+				"LOCALAI_GPT_3_5_TEMPERATURE=0.7",
+				`LOCALAI_GPT_3_5_STOP=["User:", "###"]`,
+				"LOCALAI_GPT_3_5_TEMPLATE=chat: chat",
+				"LOCALAI_BACKEND=llama",
+				"LOCALAI_OTHER_TOP_K=1",
+				"THREADS=2",
+			})).To(Succeed())
+			Expect(c.Threads).To(Equal(8))
+			Expect(c.ContextSize).To(Equal(2048))
+			Expect(c.Temperature).To(Equal(0.7))
+			Expect(c.Stop).To(Equal(StringList{"User:", "###"}))
+			Expect(c.TemplateConfig.Chat).To(Equal("chat"))
+			Expect(c.Backend).To(Equal("llama"))
+			Expect(c.TopK).To(Equal(0))
+		})
+		It("applies when the config is loaded", func() {
+			os.Setenv("LOCALAI_FOO_MLOCK", "false")
+			DeferCleanup(os.Unsetenv, "LOCALAI_FOO_MLOCK")
+			c, err := ReadConfig(writeFile("foo.yaml", "name: foo\nmlock: true\n"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.MLock).To(BeFalse())
+		})
+		It("applies to the models served without a config", func() {
+			os.Setenv("LOCALAI_TOP_K", "7")
+			DeferCleanup(os.Unsetenv, "LOCALAI_TOP_K")
+			os.Setenv("LOCALAI_MODEL_BIN_TEMPERATURE", "0.1")
+			DeferCleanup(os.Unsetenv, "LOCALAI_MODEL_BIN_TEMPERATURE")
+			Expect(os.WriteFile(filepath.Join(tmpdir, "model.bin"), nil, 0600)).To(Succeed())
+
+			c, err := modelConfig(NewConfigMerger(), newOptions(WithModelLoader(model.NewModelLoader(tmpdir))), "model.bin")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.TopK).To(Equal(7))
+			Expect(c.Temperature).To(Equal(0.1))
+
+			fc, err := modelFileConfig(tmpdir, "model.bin")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fc.TopK).To(Equal(7))
+		})
+		It("fails the load when invalid", func() {
+			c := &Config{Name: "foo"}
+			Expect(c.applyEnv([]string{"LOCALAI_FOO_THREADS=many"})).To(MatchError(ContainSubstring("invalid LOCALAI_FOO_THREADS")))
+		})
+	})
+
+	Context("JSON files", func() {
+		It("are read like YAML files", func() {
+			file := writeFile("foo.json", `{"name": "foo", "backend": "gpt2", "context_size": 1024, "parameters": {"model": "foo.bin", "top_k": 10, "stop": "###"}, "template": {"chat": "chat"}}`)
+			c, err := ReadConfig(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Name).To(Equal("foo"))
+			Expect(c.Backend).To(Equal("gpt2"))
+			Expect(c.ContextSize).To(Equal(1024))
+			Expect(c.Model).To(Equal("foo.bin"))
+			Expect(c.TopK).To(Equal(10))
+			Expect(c.Stop).To(Equal(StringList{"###"}))
+			Expect(c.TemplateConfig.Chat).To(Equal("chat"))
+
+			file = writeFile("list.json", `[{"name": "foo"}, {"name": "bar"}]`)
+			cs, err := ReadConfigFile(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cs).To(HaveLen(2))
+		})
+		It("are loaded from the models path along YAML files", func() {
+			writeFile("foo.json", `{"name": "foo"}`)
+			writeFile("bar.yaml", "name: bar\n")
+			writeFile("model.bin", "")
+			cm := NewConfigMerger()
+			Expect(cm.LoadConfigs(tmpdir)).To(Succeed())
+			Expect(cm.List()).To(Equal([]string{"bar", "foo"}))
+		})
+		It("are loaded from the subdirectories of the models path", func() {
+			Expect(os.MkdirAll(filepath.Join(tmpdir, "chat"), 0700)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(tmpdir, "code"), 0700)).To(Succeed())
+			writeFile("chat/foo.yaml", "name: foo\nbackend: llama\n")
+			writeFile("code/bar.json", `{"name": "bar"}`)
+			writeFile("code/foo.yaml", "name: foo\nbackend: gpt2\n")
+			writeFile("code/notes.txt", "")
+			cm := NewConfigMerger()
+			Expect(cm.LoadConfigs(tmpdir)).To(Succeed())
+			Expect(cm.List()).To(Equal([]string{"bar", "foo"}))
+
+			// the last one in lexical order wins
+			c, _ := cm.Get("foo")
+			Expect(c.Backend).To(Equal("gpt2"))
+		})
+		It("name the file when malformed", func() {
+			file := writeFile("foo.json", `{"name": `)
+			_, err := ReadConfig(file)
+			Expect(err).To(MatchError(ContainSubstring(file)))
+
+			file = writeFile("foo.yaml", "name: [\n")
+			_, err = ReadConfig(file)
+			Expect(err).To(MatchError(ContainSubstring(file)))
+		})
+	})
+
+	Context("templates", func() {
+		It("are found in the directory of the config", func() {
+			modelPath := GinkgoT().TempDir()
+			chat := filepath.Join(modelPath, "chat")
+			Expect(os.Mkdir(chat, 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(modelPath, "model.bin"), nil, 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(chat, "turns.tmpl"), nil, 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(chat, "chat.yaml"), []byte("name: chat\nparameters:\n  model: model.bin\ntemplate:\n  chat: turns\n"), 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(modelPath, "root.yaml"), []byte("name: root\nparameters:\n  model: model.bin\ntemplate:\n  chat: turns\n"), 0600)).To(Succeed())
+
+			cm := NewConfigMerger()
+			Expect(cm.LoadConfigs(modelPath)).To(Succeed())
+			_, ok := cm.Get("chat")
+			Expect(ok).To(BeTrue())
+			// the templates of the other directories are not found
+			_, ok = cm.Get("root")
+			Expect(ok).To(BeFalse())
+		})
+		It("give their file, the one of the directory of the config first", func() {
+			modelPath, dir := GinkgoT().TempDir(), GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(modelPath, "turns.tmpl"), nil, 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(modelPath, "chat.tmpl"), nil, 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "chat.tmpl"), nil, 0600)).To(Succeed())
+			c := &Config{dir: dir}
+
+			file, ok := c.templateFile(modelPath, "turns")
+			Expect(ok).To(BeTrue())
+			Expect(file).To(Equal(filepath.Join(modelPath, "turns.tmpl")))
+			file, ok = c.templateFile(modelPath, "chat")
+			Expect(ok).To(BeTrue())
+			Expect(file).To(Equal(filepath.Join(dir, "chat.tmpl")))
+			_, ok = c.templateFile(modelPath, "missing")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("model file", func() {
+		It("is served without a config under its name", func() {
+			modelPath, dir := GinkgoT().TempDir(), GinkgoT().TempDir()
+			file := filepath.Join(dir, "ggml-model-q4_0.bin")
+			Expect(os.WriteFile(file, nil, 0600)).To(Succeed())
+
+			c, err := modelFileConfig(modelPath, file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Name).To(Equal("ggml-model-q4_0"))
+			Expect(c.Temperature).To(Equal(defaultRequest("").Temperature))
+			Expect(filepath.Join(modelPath, c.Model)).To(Equal(file))
+			Expect(c.Validate(modelPath)).To(Succeed())
+		})
+		It("is looked for in the models path", func() {
+			modelPath := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(modelPath, "model.bin"), nil, 0600)).To(Succeed())
+
+			c, err := modelFileConfig(modelPath, "model.bin")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Model).To(Equal("model.bin"))
+
+			_, err = modelFileConfig(modelPath, "missing.bin")
+			Expect(err).To(HaveOccurred())
+		})
+		It("is listed", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "model.bin"), nil, 0600)).To(Succeed())
+			app, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithModelFile(filepath.Join(dir, "model.bin")), WithDisableMessage(true))
+			Expect(err).ToNot(HaveOccurred())
+
+			resp, err := app.Test(httptest.NewRequest("GET", "/v1/models/model", nil))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+		})
+		It("fails the app when missing", func() {
+			_, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithModelFile("missing.bin"), WithDisableMessage(true))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("merger", func() {
+		It("can be read and written concurrently", func() {
+			cm := NewConfigMerger()
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					name := fmt.Sprintf("model-%d", i)
+					cm.Set(name, Config{Name: name})
+					c, exists := cm.Get(name)
+					Expect(exists).To(BeTrue())
+					Expect(c.Name).To(Equal(name))
+					cm.List()
+				}(i)
+			}
+			wg.Wait()
+			Expect(cm.List()).To(HaveLen(50))
+
+			cm.Delete("model-0")
+			_, exists := cm.Get("model-0")
+			Expect(exists).To(BeFalse())
+		})
+	})
+
+	Context("aliases", func() {
+		It("resolve to the config", func() {
+			cm := NewConfigMerger()
+			cm.Set("gpt4all", Config{Name: "gpt4all", Aliases: []string{"gpt-3.5-turbo"}, OpenAIRequest: OpenAIRequest{Model: "ggml-gpt4all-j"}})
+
+			c, exists := cm.Get("gpt-3.5-turbo")
+			Expect(exists).To(BeTrue())
+			Expect(c.Name).To(Equal("gpt4all"))
+			Expect(c.Model).To(Equal("ggml-gpt4all-j"))
+		})
+		It("do not shadow other configs", func() {
+			cm := NewConfigMerger()
+			cm.Set("foo", Config{Name: "foo", Aliases: []string{"bar"}})
+			cm.Set("bar", Config{Name: "bar"})
+
+			c, _ := cm.Get("bar")
+			Expect(c.Name).To(Equal("bar"))
+		})
+		It("are dropped along their config", func() {
+			cm := NewConfigMerger()
+			cm.Set("foo", Config{Name: "foo", Aliases: []string{"bar", "baz"}})
+			cm.Set("foo", Config{Name: "foo", Aliases: []string{"baz"}})
+			_, exists := cm.Get("bar")
+			Expect(exists).To(BeFalse())
+
+			cm.Delete("foo")
+			_, exists = cm.Get("baz")
+			Expect(exists).To(BeFalse())
+		})
+	})
+
+	Context("watcher", func() {
+		It("reloads added, changed and removed config files", func() {
+			writeFile("foo.yaml", "name: foo\nbackend: llama\n")
+			cm := NewConfigMerger()
+			Expect(cm.LoadConfigs(tmpdir)).To(Succeed())
+
+			watcher, err := cm.Watch(tmpdir)
+			Expect(err).ToNot(HaveOccurred())
+			defer watcher.Close()
+
+			backend := func(name string) func() string {
+				return func() string {
+					c, _ := cm.Get(name)
+					return c.Backend
+				}
+			}
+
+			writeFile("foo.yaml", "name: foo\nbackend: gpt2\n")
+			Eventually(backend("foo")).Should(Equal("gpt2"))
+
+			writeFile("bar.yaml", "name: bar\nbackend: rwkv\n")
+			Eventually(backend("bar")).Should(Equal("rwkv"))
+
+			Expect(os.Remove(filepath.Join(tmpdir, "foo.yaml"))).To(Succeed())
+			Eventually(backend("foo")).Should(BeEmpty())
+			Expect(backend("bar")()).To(Equal("rwkv"))
+		})
+		It("skips the invalid config files", func() {
+			writeFile("foo.yaml", "name: foo\nbackend: llama\n")
+			cm := NewConfigMerger()
+			Expect(cm.LoadConfigs(tmpdir)).To(Succeed())
+
+			watcher, err := cm.Watch(tmpdir)
+			Expect(err).ToNot(HaveOccurred())
+			defer watcher.Close()
+
+			writeFile("foo.yaml", "name: foo\nbackend: llama\ntruncate: newest\n")
+			writeFile("bar.yaml", "name: bar\n")
+			Eventually(func() bool {
+				_, exists := cm.Get("bar")
+				return exists
+			}).Should(BeTrue())
+			c, _ := cm.Get("foo")
+			Expect(c.Truncate).To(BeEmpty())
+		})
+		It("watches the subdirectories", func() {
+			Expect(os.Mkdir(filepath.Join(tmpdir, "chat"), 0700)).To(Succeed())
+			cm := NewConfigMerger()
+			Expect(cm.LoadConfigs(tmpdir)).To(Succeed())
+
+			watcher, err := cm.Watch(tmpdir)
+			Expect(err).ToNot(HaveOccurred())
+			defer watcher.Close()
+
+			exists := func(name string) func() bool {
+				return func() bool {
+					_, exists := cm.Get(name)
+					return exists
+				}
+			}
+
+			writeFile(filepath.Join("chat", "foo.yaml"), "name: foo\n")
+			Eventually(exists("foo")).Should(BeTrue())
+
+			Expect(os.Mkdir(filepath.Join(tmpdir, "edit"), 0700)).To(Succeed())
+			writeFile(filepath.Join("edit", "bar.yaml"), "name: bar\n")
+			Eventually(exists("bar")).Should(BeTrue())
+
+			Expect(os.RemoveAll(filepath.Join(tmpdir, "chat"))).To(Succeed())
+			Eventually(exists("foo")).Should(BeFalse())
+			Expect(exists("bar")()).To(BeTrue())
+		})
+	})
+})
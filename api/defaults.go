@@ -0,0 +1,98 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultsFile is the file of the models path holding the settings shared by
+// the configs of the models path
+const defaultsFile = "defaults.yaml"
+
+// isDefaultsFile reports whether file is the defaults file of path
+func isDefaultsFile(path, file string) bool {
+	return filepath.Clean(file) == filepath.Join(path, defaultsFile)
+}
+
+// readDefaults reads the defaults file of path. It returns nil when there is
+// none.
+func readDefaults(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(filepath.Join(path, defaultsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read defaults file: %w", err)
+	}
+	defaults := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &defaults); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal defaults file: %w", err)
+	}
+	if _, named := defaults["name"]; named {
+		return nil, fmt.Errorf("the defaults file can't set a name")
+	}
+	return defaults, nil
+}
+
+// mergeSettings returns the settings of a config over the defaults. The
+// mappings, like parameters or roles, are merged key by key, the other
+// settings of the config replace the ones of the defaults.
+func mergeSettings(defaults, settings map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(defaults)+len(settings))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range settings {
+		d, dIsMap := merged[k].(map[string]interface{})
+		s, sIsMap := v.(map[string]interface{})
+		if dIsMap && sIsMap {
+			v = mergeSettings(d, s)
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// readConfig reads a config file of the models path over the defaults, if
+// any, for the backends of the merger.
+func (cm *ConfigMerger) readConfig(file string) (*Config, error) {
+	cm.RLock()
+	defaults, appBackends := cm.defaults, cm.backends
+	cm.RUnlock()
+	if defaults == nil {
+		c, err := ReadConfig(file)
+		if err != nil {
+			return nil, err
+		}
+		c.backends = appBackends
+		return c, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file: %w", err)
+	}
+	settings := map[string]interface{}{}
+	if err := unmarshalConfig(file, data, &settings); err != nil {
+		return nil, err
+	}
+	if data, err = yaml.Marshal(mergeSettings(defaults, settings)); err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal config file %s: %w", file, err)
+	}
+	if err := c.prepare(filepath.Dir(file)); err != nil {
+		return nil, err
+	}
+	c.file = file
+	c.backends = appBackends
+	return c, nil
+}
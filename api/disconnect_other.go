@@ -0,0 +1,16 @@
+//go:build !unix
+
+package api
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// watchDisconnect doesn't watch the connections, the predictions of the
+// requests whose client went away are only cancelled by their timeout or,
+// for the streams, when writing to the client fails.
+func watchDisconnect(c *fiber.Ctx, cancel context.CancelFunc) (stop func()) {
+	return func() {}
+}
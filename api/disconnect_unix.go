@@ -0,0 +1,55 @@
+//go:build unix
+
+package api
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// watchDisconnect cancels the predictions of the request when its client
+// closes the connection, until the returned stop is called. fasthttp only
+// notices it when reading the next request, so the connection is peeked at
+// while the request is served. The connections which aren't sockets, e.g.
+// the TLS ones or the ones of app.Test, aren't watched.
+func watchDisconnect(c *fiber.Ctx, cancel context.CancelFunc) (stop func()) {
+	conn := c.Context().Conn()
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return func() {}
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1)
+		closed := false
+		// waits until the connection is readable, or the deadline set by
+		// stop passes
+		err := raw.Read(func(fd uintptr) bool {
+			n, _, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				return false
+			}
+			// a pipelined request is left for fasthttp to read
+			closed = n <= 0
+			return true
+		})
+		if err == nil && closed {
+			cancel()
+		}
+	}()
+
+	return func() {
+		_ = conn.SetReadDeadline(time.Now())
+		<-done
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
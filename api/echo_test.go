@@ -0,0 +1,93 @@
+package api
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	llama "github.com/go-skynet/go-llama.cpp"
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// echoModel is a backend replying with the prompt it is given, through the
+// predictions of the llama backend. The words of the prompt are its tokens,
+// streamed to the token callback until it returns false. As on llama, the
+// predictions fail when they run concurrently.
+type echoModel struct {
+	callback   func(string) bool
+	predicting int32
+}
+
+func (m *echoModel) SetTokenCallback(callback func(token string) bool) {
+	m.callback = callback
+}
+
+func (m *echoModel) Predict(text string, opts ...llama.PredictOption) (string, error) {
+	if !atomic.CompareAndSwapInt32(&m.predicting, 0, 1) {
+		return "", errors.New("concurrent predictions")
+	}
+	defer atomic.StoreInt32(&m.predicting, 0)
+	// leave the time for another prediction to overlap
+	time.Sleep(time.Millisecond)
+
+	res := ""
+	for _, token := range strings.SplitAfter(text, " ") {
+		res += token
+		if m.callback != nil && !m.callback(token) {
+			break
+		}
+	}
+	return res, nil
+}
+
+// echoBackend loads an instance of the echo model per replica, see
+// ModelLoader.Replica.
+type echoBackend struct {
+	sync.Mutex
+	models map[string]*echoModel
+}
+
+func (b *echoBackend) load(_ *model.ModelLoader, name string, _ []llama.ModelOption, _ uint32) (interface{}, error) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.models[name]; !ok {
+		b.models[name] = &echoModel{}
+	}
+	return b.models[name], nil
+}
+
+// loaded returns the names of the replicas the echo model was loaded for
+func (b *echoBackend) loaded() []string {
+	b.Lock()
+	defer b.Unlock()
+	names := []string{}
+	for name := range b.models {
+		names = append(names, name)
+	}
+	return names
+}
+
+// echoApp returns an app serving the echo backend, with the configs written
+// to its models path by file name. The configs load the model file model.bin
+// with the backend echo.
+func echoApp(configs map[string]string, opts ...AppOption) (*fiber.App, *echoBackend) {
+	backend := &echoBackend{models: map[string]*echoModel{}}
+
+	dir := GinkgoT().TempDir()
+	Expect(os.WriteFile(filepath.Join(dir, "model.bin"), nil, 0600)).To(Succeed())
+	for file, config := range configs {
+		Expect(os.WriteFile(filepath.Join(dir, file), []byte(config), 0600)).To(Succeed())
+	}
+
+	opts = append([]AppOption{WithModelLoader(model.NewModelLoader(dir)), WithDisableMessage(true), WithBackend("echo", backend.load)}, opts...)
+	app, err := App(opts...)
+	Expect(err).ToNot(HaveOccurred())
+	return app, backend
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of the environment variables overriding the
+// settings of the configs
+const envPrefix = "LOCALAI_"
+
+// applyEnv overrides the settings of the config with the environment
+// variables. LOCALAI_<SETTING> applies to every config, and
+// LOCALAI_<MODEL>_<SETTING> to the config named MODEL, taking precedence.
+// SETTING is the YAML key of the setting, either top level or under
+// parameters, in upper case. MODEL is the name of the config in upper case,
+// the characters other than letters and digits replaced by underscores. The
+// values of the string settings are taken as is, the other ones are YAML, as
+// in the config files.
+func (c *Config) applyEnv(environ []string) error {
+	env := map[string]string{}
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, envPrefix) {
+			env[k] = v
+		}
+	}
+	if len(env) == 0 {
+		return nil
+	}
+
+	fields := c.settings()
+	for _, prefix := range []string{envPrefix, envPrefix + envName(c.Name) + "_"} {
+		for key, field := range fields {
+			value, ok := env[prefix+key]
+			if !ok {
+				continue
+			}
+			if field.Kind() == reflect.String {
+				field.SetString(value)
+				continue
+			}
+			if err := yaml.Unmarshal([]byte(value), field.Addr().Interface()); err != nil {
+				return fmt.Errorf("invalid %s%s: %w", prefix, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// settings returns the fields of the config which can be set from the
+// environment, by their upper case YAML key. The top level settings win over
+// the parameters of the same name.
+func (c *Config) settings() map[string]reflect.Value {
+	fields := map[string]reflect.Value{}
+	addFields(fields, reflect.ValueOf(&c.OpenAIRequest).Elem())
+	addFields(fields, reflect.ValueOf(c).Elem())
+	return fields
+}
+
+func addFields(fields map[string]reflect.Value, v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		key, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if !f.IsExported() || f.Anonymous || key == "" || key == "-" || key == "name" {
+			continue
+		}
+		fields[strings.ToUpper(key)] = v.Field(i)
+	}
+}
+
+// envName returns the name of the config as used in the environment
+// variables
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
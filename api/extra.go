@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	llama "github.com/go-skynet/go-llama.cpp"
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxRepeatLastN caps repeat_last_n, the number of the last tokens the
+// repeat penalty looks back at
+const maxRepeatLastN = 4096
+
+// extraParameters are the parameters of the llama backend which the requests
+// can set without OpenAIRequest knowing them, when the config of the model
+// allows them in extra_parameters. They are the predict options which have no
+// field in the requests, the others being set through their field. Each one
+// turns the JSON value of the parameter into the option of the backend.
+var extraParameters = map[string]func(value interface{}) (llama.PredictOption, error){
+	"repeat_last_n": func(value interface{}) (llama.PredictOption, error) {
+		n, err := intParameter(value)
+		if err != nil || n < -1 || n > maxRepeatLastN {
+			return nil, fmt.Errorf("must be an integer between -1 and %d", maxRepeatLastN)
+		}
+		return llama.SetRepeat(n), nil
+	},
+	"penalize_nl": func(value interface{}) (llama.PredictOption, error) {
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("must be a boolean")
+		}
+		return llama.SetPenalizeNL(b), nil
+	},
+	"f16_kv": func(value interface{}) (llama.PredictOption, error) {
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("must be a boolean")
+		}
+		return func(p *llama.PredictOptions) {
+			p.F16KV = b
+		}, nil
+	},
+}
+
+func intParameter(value interface{}) (int, error) {
+	f, ok := value.(float64)
+	if !ok || f != math.Trunc(f) {
+		return 0, fmt.Errorf("not an integer")
+	}
+	return int(f), nil
+}
+
+// extraParameterNames returns the names of the extra parameters, sorted
+func extraParameterNames() []string {
+	names := make([]string, 0, len(extraParameters))
+	for name := range extraParameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// requestFields holds the JSON keys of OpenAIRequest
+var requestFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(OpenAIRequest{})
+	for i := 0; i < t.NumField(); i++ {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if key != "" && key != "-" {
+			fields[key] = true
+		}
+	}
+	return fields
+}()
+
+// unknownFields returns the fields of the JSON body of the request which
+// OpenAIRequest doesn't know, the null ones excluded. It is empty for the
+// other bodies.
+func unknownFields(c *fiber.Ctx) map[string]interface{} {
+	unknown := map[string]interface{}{}
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		return unknown
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(c.Body(), &fields); err != nil {
+		return unknown
+	}
+	for key, value := range fields {
+		if !requestFields[key] && value != nil {
+			unknown[key] = value
+		}
+	}
+	return unknown
+}
+
+// updateExtra keeps the unknown fields of the request which the config allows
+// in its extra parameters, to forward them to the backend. The other ones are
+// dropped.
+func updateExtra(config *Config, unknown map[string]interface{}) error {
+	allowed := map[string]bool{}
+	for _, name := range config.ExtraParameters {
+		allowed[name] = true
+	}
+
+	for key, value := range unknown {
+		option, known := extraParameters[key]
+		if !allowed[key] || !known {
+			configLogger(config).Debug().Msgf("Dropping the unknown field %s of the request", key)
+			continue
+		}
+		if _, err := option(value); err != nil {
+			return invalidParam(key, "%s %s, got %v", key, err.Error(), value)
+		}
+		if config.Extra == nil {
+			config.Extra = map[string]interface{}{}
+		}
+		config.Extra[key] = value
+	}
+	return nil
+}
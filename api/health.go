@@ -0,0 +1,43 @@
+package api
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// healthEndpoint reports that the process is alive
+func healthEndpoint() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": "ok"})
+	}
+}
+
+// readyEndpoint reports whether the API is ready to serve requests: the configs
+// of the models path are loaded without error, the models to preload are
+// loaded, ready is set once they are, and the models path is readable and
+// holds models or configs to serve. It replies with a 503 otherwise.
+func readyEndpoint(cm *ConfigMerger, o *Option, ready *atomic.Bool) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		loaded, err := cm.loadState()
+		switch {
+		case !loaded:
+			return fiber.NewError(fiber.StatusServiceUnavailable, "the configs are being loaded")
+		case err != nil:
+			return fiber.NewError(fiber.StatusServiceUnavailable, fmt.Sprintf("the configs can't be loaded: %s", err.Error()))
+		case !ready.Load():
+			return fiber.NewError(fiber.StatusServiceUnavailable, "the models are being preloaded")
+		}
+
+		models, err := o.loader.ListModels()
+		if err != nil {
+			return fiber.NewError(fiber.StatusServiceUnavailable, fmt.Sprintf("the models path can't be read: %s", err.Error()))
+		}
+		configs := len(cm.List())
+		if configs == 0 && len(models) == 0 {
+			return fiber.NewError(fiber.StatusServiceUnavailable, "there are no models to serve")
+		}
+		return c.JSON(fiber.Map{"status": "ready", "configs": configs})
+	}
+}
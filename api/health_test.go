@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Probes", func() {
+	status := func(app *fiber.App, path string) int {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		Expect(err).ToNot(HaveOccurred())
+		return resp.StatusCode
+	}
+
+	// modelsPath returns a models path holding a model
+	modelsPath := func() string {
+		dir := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(dir, "model.bin"), nil, 0600)).To(Succeed())
+		return dir
+	}
+	// loaded returns the config merger of the configs loaded from dir
+	loaded := func(dir string) *ConfigMerger {
+		cm := NewConfigMerger()
+		Expect(cm.LoadConfigs(dir)).To(Succeed())
+		return cm
+	}
+
+	It("don't require the API keys", func() {
+		app, err := App(WithModelLoader(model.NewModelLoader(modelsPath())), WithDisableMessage(true), WithAPIKeys("secret"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(status(app, "/healthz")).To(Equal(fiber.StatusOK))
+		Expect(status(app, "/readyz")).To(Equal(fiber.StatusOK))
+		Expect(status(app, "/v1/models")).To(Equal(fiber.StatusUnauthorized))
+	})
+	It("are not ready until the models are preloaded", func() {
+		ready := &atomic.Bool{}
+		dir := modelsPath()
+		o := newOptions(WithModelLoader(model.NewModelLoader(dir)))
+		app := fiber.New()
+		app.Get("/readyz", readyEndpoint(loaded(dir), o, ready))
+
+		Expect(status(app, "/readyz")).To(Equal(fiber.StatusServiceUnavailable))
+		ready.Store(true)
+		Expect(status(app, "/readyz")).To(Equal(fiber.StatusOK))
+	})
+	It("are not ready until the configs are loaded", func() {
+		ready := &atomic.Bool{}
+		ready.Store(true)
+		dir := modelsPath()
+		o := newOptions(WithModelLoader(model.NewModelLoader(dir)))
+		cm := NewConfigMerger()
+		app := fiber.New()
+		app.Get("/readyz", readyEndpoint(cm, o, ready))
+
+		Expect(status(app, "/readyz")).To(Equal(fiber.StatusServiceUnavailable))
+		Expect(cm.LoadConfigs(dir)).To(Succeed())
+		Expect(status(app, "/readyz")).To(Equal(fiber.StatusOK))
+
+		Expect(os.WriteFile(filepath.Join(dir, "defaults.yaml"), []byte("name: foo\n"), 0600)).To(Succeed())
+		Expect(cm.LoadConfigs(dir)).ToNot(Succeed())
+		Expect(status(app, "/readyz")).To(Equal(fiber.StatusServiceUnavailable))
+	})
+	It("are not ready without models to serve", func() {
+		ready := &atomic.Bool{}
+		ready.Store(true)
+		dir := GinkgoT().TempDir()
+		o := newOptions(WithModelLoader(model.NewModelLoader(dir)))
+		app := fiber.New()
+		app.Get("/readyz", readyEndpoint(loaded(dir), o, ready))
+
+		Expect(status(app, "/readyz")).To(Equal(fiber.StatusServiceUnavailable))
+		Expect(os.WriteFile(filepath.Join(dir, "model.bin"), nil, 0600)).To(Succeed())
+		Expect(status(app, "/readyz")).To(Equal(fiber.StatusOK))
+	})
+	It("are not ready without a readable models path", func() {
+		ready := &atomic.Bool{}
+		ready.Store(true)
+		dir := filepath.Join(GinkgoT().TempDir(), "missing")
+		o := newOptions(WithModelLoader(model.NewModelLoader(dir)))
+		cm := NewConfigMerger()
+		cm.Set("foo", Config{Name: "foo"})
+		cm.loaded = true
+		app := fiber.New()
+		app.Get("/readyz", readyEndpoint(cm, o, ready))
+
+		Expect(status(app, "/readyz")).To(Equal(fiber.StatusServiceUnavailable))
+		Expect(os.Mkdir(dir, 0755)).To(Succeed())
+		Expect(status(app, "/readyz")).To(Equal(fiber.StatusOK))
+	})
+})
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxImages is the maximum number of images a request can ask for
+const maxImages = 10
+
+// imageSizes are the sizes of the images the requests can ask for
+var imageSizes = map[string]bool{
+	"256x256":   true,
+	"512x512":   true,
+	"1024x1024": true,
+}
+
+// ImageRequest is the body of the image generation API calls
+type ImageRequest struct {
+	Model          string `json:"model"`
+	Prompt         string `json:"prompt"`
+	N              int    `json:"n"`
+	Size           string `json:"size"`
+	ResponseFormat string `json:"response_format"`
+}
+
+// https://platform.openai.com/docs/api-reference/images/create
+// None of the backends LocalAI is built with generates images, so the valid
+// requests are answered with a 501, rather than a 404 the clients would take
+// for a wrong base URL.
+func imageEndpoint() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		input := new(ImageRequest)
+		if err := c.BodyParser(input); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err.Error()))
+		}
+
+		switch {
+		case input.Prompt == "":
+			return invalidParam("prompt", "a prompt is required")
+		case input.N < 0 || input.N > maxImages:
+			return invalidParam("n", "n must be between 1 and %d, got %d", maxImages, input.N)
+		case input.Size != "" && !imageSizes[input.Size]:
+			return invalidParam("size", "size must be one of 256x256, 512x512 or 1024x1024, got %s", input.Size)
+		case input.ResponseFormat != "" && input.ResponseFormat != "url" && input.ResponseFormat != "b64_json":
+			return invalidParam("response_format", "response_format must be url or b64_json, got %s", input.ResponseFormat)
+		}
+
+		return fiber.NewError(fiber.StatusNotImplemented, "none of the backends of this build generates images")
+	}
+}
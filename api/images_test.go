@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http/httptest"
+	"strings"
+
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Image generations", func() {
+	var app *fiber.App
+
+	BeforeEach(func() {
+		var err error
+		app, err = App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	DescribeTable("are validated, then answered with a 501",
+		func(body string, code int) {
+			req := httptest.NewRequest("POST", "/v1/images/generations", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(code))
+		},
+		Entry("without prompt", `{"model": "sd"}`, fiber.StatusBadRequest),
+		Entry("with an unsupported size", `{"prompt": "a cat", "size": "100x100"}`, fiber.StatusBadRequest),
+		Entry("with too many images", `{"prompt": "a cat", "n": 11}`, fiber.StatusBadRequest),
+		Entry("with an unsupported response format", `{"prompt": "a cat", "response_format": "png"}`, fiber.StatusBadRequest),
+		Entry("valid", `{"prompt": "a cat", "n": 2, "size": "512x512", "response_format": "b64_json"}`, fiber.StatusNotImplemented),
+	)
+})
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// jsonObjectFormat is the response_format type requesting the completions to
+// be a JSON object
+const jsonObjectFormat = "json_object"
+
+// jsonObject returns the JSON object of the prediction. The text around the
+// object, like the markdown code fences or the chatter some models add, is
+// dropped. A prediction without a valid JSON object is an error.
+func jsonObject(prediction string) (string, error) {
+	prediction = strings.TrimSpace(prediction)
+	if isJSONObject(prediction) {
+		return prediction, nil
+	}
+
+	start, end := strings.Index(prediction, "{"), strings.LastIndex(prediction, "}")
+	if start >= 0 && end > start && isJSONObject(prediction[start:end+1]) {
+		return prediction[start : end+1], nil
+	}
+
+	return "", fiber.NewError(fiber.StatusInternalServerError, "the model did not generate a valid JSON object")
+}
+
+func isJSONObject(s string) bool {
+	var object map[string]interface{}
+	return json.Unmarshal([]byte(s), &object) == nil
+}
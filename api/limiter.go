@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// limiter bounds the number of inferences running at once. The requests past
+// the limit wait in a queue of bounded length, the ones which don't fit in it
+// are rejected with a 429. A nil limiter doesn't limit anything.
+type limiter struct {
+	slots chan struct{}
+	queue chan struct{}
+}
+
+// newLimiter returns a limiter running up to max inferences at once, with up
+// to queue requests waiting for them. It returns nil when max isn't positive.
+func newLimiter(max, queue int) *limiter {
+	if max <= 0 {
+		return nil
+	}
+	if queue < 0 {
+		queue = 0
+	}
+	return &limiter{
+		slots: make(chan struct{}, max),
+		queue: make(chan struct{}, queue),
+	}
+}
+
+// acquire waits for a slot to run an inference, until ctx is done. done
+// releases the slot once the inference completes.
+func (l *limiter) acquire(ctx context.Context) (done func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.release(), nil
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}:
+		defer func() { <-l.queue }()
+	default:
+		return nil, fiber.NewError(fiber.StatusTooManyRequests, "too many requests are being served, retry later")
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.release(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *limiter) release() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-l.slots })
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Concurrency limit", func() {
+	It("doesn't limit without a maximum", func() {
+		l := newLimiter(0, 0)
+		for i := 0; i < 3; i++ {
+			_, err := l.acquire(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+		}
+	})
+	It("queues the requests past the limit", func() {
+		l := newLimiter(1, 1)
+		done, err := l.acquire(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+
+		acquired := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			queued, err := l.acquire(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			close(acquired)
+			queued()
+		}()
+		Consistently(acquired, 50*time.Millisecond).ShouldNot(BeClosed())
+
+		done()
+		// releasing twice is harmless
+		done()
+		Eventually(acquired).Should(BeClosed())
+	})
+	It("rejects the requests past the queue with a 429", func() {
+		l := newLimiter(1, 0)
+		done, err := l.acquire(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		defer done()
+
+		_, err = l.acquire(context.Background())
+		code, _ := errorResponse(err)
+		Expect(code).To(Equal(fiber.StatusTooManyRequests))
+	})
+	It("stops waiting when the request is cancelled", func() {
+		l := newLimiter(1, 1)
+		done, err := l.acquire(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		defer done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = l.acquire(ctx)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+
+		// the request left the queue
+		Expect(l.queue).To(BeEmpty())
+	})
+})
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// requestIDHeader carries the id of the request, sent by the client or
+	// else generated, in the request and its response
+	requestIDHeader = "X-Request-Id"
+	// requestIDLocal is set to the id of the request, see requestID
+	requestIDLocal = "requestID"
+	// loggerLocal is set to the logger of the request, see requestID
+	loggerLocal = "logger"
+)
+
+// requestID gives each request an id, the one of its X-Request-Id header if
+// any, to trace it across the log lines of its logger, derived from the one
+// of the app. The id is echoed in the response.
+func requestID(logger *zerolog.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Get(requestIDHeader)
+		if id == "" {
+			id = uuid.New().String()
+		}
+		l := logger.With().Str("request_id", id).Logger()
+		c.Locals(requestIDLocal, id)
+		c.Locals(loggerLocal, &l)
+		c.Set(requestIDHeader, id)
+		return c.Next()
+	}
+}
+
+// requestLogger returns the logger of the request, adding its id to its lines.
+// The requests which weren't given an id are logged with the global logger.
+func requestLogger(c *fiber.Ctx) *zerolog.Logger {
+	if l, ok := c.Locals(loggerLocal).(*zerolog.Logger); ok {
+		return l
+	}
+	return &log.Logger
+}
+
+// configLogger returns the logger of the request the config was read for, see
+// requestLogger
+func configLogger(config *Config) *zerolog.Logger {
+	if config.logger != nil {
+		return config.logger
+	}
+	return &log.Logger
+}
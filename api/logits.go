@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/donomii/go-rwkv.cpp"
+)
+
+// logitsModel is implemented by the models exposing the state and the logits
+// of the tokens they evaluate, which the embeddings and the logprobs are
+// computed from. rwkv is the only backend exposing them, see rwkvLogits.
+type logitsModel interface {
+	// Encode returns the tokens of the text
+	Encode(text string) ([]int, error)
+	// Decode returns the text of the tokens
+	Decode(tokens []int) string
+	// Eval evaluates the token over state, nil for the initial state, and
+	// returns the state following it and the logits of the next token
+	Eval(token int, state []float32) (next []float32, logits []float32, err error)
+	// Embedding returns the embedding of the text evaluated up to state
+	Embedding(state []float32) ([]float32, error)
+}
+
+// logitsModelOf returns the logits model of a loaded model, of the model file
+// file, if its backend exposes them.
+func logitsModelOf(m interface{}, file string) (logitsModel, bool) {
+	switch m := m.(type) {
+	case *rwkv.RwkvState:
+		return &rwkvLogits{state: m, file: file}, true
+	case logitsModel:
+		return m, true
+	}
+	return nil, false
+}
+
+// rwkvLogits evaluates the tokens with the context of a rwkv model, from a
+// state of their own rather than the one of its predictions.
+type rwkvLogits struct {
+	state *rwkv.RwkvState
+	// file is the model file, read for the sizes of the model
+	file string
+}
+
+func (m *rwkvLogits) Encode(text string) ([]int, error) {
+	encoded, err := m.state.Tokenizer.Encode(text)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]int, 0, len(encoded))
+	for _, t := range encoded {
+		tokens = append(tokens, t.ID)
+	}
+	return tokens, nil
+}
+
+func (m *rwkvLogits) Decode(tokens []int) string {
+	return rwkv.DeTokenise(*m.state.Tokenizer, tokens)
+}
+
+func (m *rwkvLogits) Eval(token int, state []float32) ([]float32, []float32, error) {
+	next, logits, _, err := m.state.Context.Eval(int32(token), state)
+	return next, logits, err
+}
+
+// Embedding returns the input of the feed forward network of the last layer
+// for the last token. The state holds 5 vectors of n_embd values per layer,
+// that input being the first one of each layer.
+func (m *rwkvLogits) Embedding(state []float32) ([]float32, error) {
+	nEmbd, nLayer, err := rwkvSizes(m.file)
+	if err != nil {
+		return nil, err
+	}
+	if len(state) != 5*nLayer*nEmbd {
+		return nil, fmt.Errorf("the state of %s has %d values, expected %d", m.file, len(state), 5*nLayer*nEmbd)
+	}
+	start := 5 * (nLayer - 1) * nEmbd
+	return append([]float32{}, state[start:start+nEmbd]...), nil
+}
+
+// rwkvSizes reads the size of the embeddings and the number of layers of a
+// rwkv model file from its header: the magic, the version, the size of the
+// vocabulary, of the embeddings, the number of layers and the data type, as
+// 32 bits integers.
+func rwkvSizes(file string) (nEmbd, nLayer int, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	header := [6]int32{}
+	if err := binary.Read(f, binary.LittleEndian, &header); err != nil {
+		return 0, 0, fmt.Errorf("cannot read the header of %s: %w", file, err)
+	}
+	if header[3] <= 0 || header[4] <= 0 {
+		return 0, 0, fmt.Errorf("invalid header in %s", file)
+	}
+	return int(header[3]), int(header[4]), nil
+}
+
+// embedding returns the embedding of the text for the model, and the number of
+// its tokens. The tokens are evaluated from the initial state, so the ones
+// evaluated before don't change it.
+func embedding(ctx context.Context, m logitsModel, text string) ([]float32, int, error) {
+	tokens, err := m.Encode(text)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(tokens) == 0 {
+		return nil, 0, fmt.Errorf("cannot compute the embedding of an empty input")
+	}
+
+	var state []float32
+	for _, token := range tokens {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		if state, _, err = m.Eval(token, state); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	e, err := m.Embedding(state)
+	if err != nil {
+		return nil, 0, err
+	}
+	return e, len(tokens), nil
+}
+
+// scoreTokens returns the logprobs of the tokens of the completion following
+// the prompt, with the top most likely tokens at each position, preceded by
+// the ones of the tokens of the prompt when echo is set. The tokens are the
+// ones of the completion tokenized alone, scored by evaluating them after the
+// prompt, from the initial state. Their offsets are counted from the start of
+// the prompt.
+func scoreTokens(ctx context.Context, m logitsModel, prompt, completion string, top int, echo bool) (*Logprobs, error) {
+	promptTokens, err := m.Encode(prompt)
+	if err != nil {
+		return nil, err
+	}
+	completionTokens, err := m.Encode(completion)
+	if err != nil {
+		return nil, err
+	}
+
+	logprobs := &Logprobs{
+		Tokens:        []string{},
+		TokenLogprobs: []*float32{},
+		TopLogprobs:   []map[string]float32{},
+		TextOffset:    []int{},
+	}
+	offset := 0
+	tokens := append(promptTokens, completionTokens...)
+	var state, logits []float32
+	for i, token := range tokens {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if i == len(promptTokens) {
+			offset = len(prompt)
+		}
+		if echo || i >= len(promptTokens) {
+			text := m.Decode([]int{token})
+			logprobs.Tokens = append(logprobs.Tokens, text)
+			logprobs.TextOffset = append(logprobs.TextOffset, offset)
+			offset += len(text)
+
+			// the first token has no logprob, there is nothing before it
+			if logits == nil {
+				logprobs.TokenLogprobs = append(logprobs.TokenLogprobs, nil)
+				logprobs.TopLogprobs = append(logprobs.TopLogprobs, nil)
+			} else {
+				if token >= len(logits) {
+					return nil, fmt.Errorf("token %d out of the %d logits of the model", token, len(logits))
+				}
+				l := logSoftmax(logits)
+				logprobs.TokenLogprobs = append(logprobs.TokenLogprobs, &l[token])
+				logprobs.TopLogprobs = append(logprobs.TopLogprobs, topLogprobs(m, l, top))
+			}
+		}
+
+		// the logits following the last token are not needed
+		if i < len(tokens)-1 {
+			if state, logits, err = m.Eval(token, state); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return logprobs, nil
+}
+
+// sum returns the cumulative logprob of the tokens, the log of the probability
+// of the whole text. The tokens without logprob are left out, and missing
+// logprobs rank last.
+func (l *Logprobs) sum() float64 {
+	if l == nil {
+		return math.Inf(-1)
+	}
+	sum := 0.0
+	for _, lp := range l.TokenLogprobs {
+		if lp != nil {
+			sum += float64(*lp)
+		}
+	}
+	return sum
+}
+
+// logSoftmax returns the logprobs of the tokens for their logits
+func logSoftmax(logits []float32) []float32 {
+	max := math.Inf(-1)
+	for _, l := range logits {
+		max = math.Max(max, float64(l))
+	}
+	sum := 0.0
+	for _, l := range logits {
+		sum += math.Exp(float64(l) - max)
+	}
+	logSum := max + math.Log(sum)
+
+	res := make([]float32, len(logits))
+	for i, l := range logits {
+		res[i] = float32(float64(l) - logSum)
+	}
+	return res
+}
+
+// topLogprobs returns the n most likely tokens by their text, with their
+// logprobs
+func topLogprobs(m logitsModel, logprobs []float32, n int) map[string]float32 {
+	top := map[string]float32{}
+	picked := map[int]bool{}
+	for len(top) < n && len(picked) < len(logprobs) {
+		best := -1
+		for id, l := range logprobs {
+			if !picked[id] && (best < 0 || l > logprobs[best]) {
+				best = id
+			}
+		}
+		picked[best] = true
+		text := m.Decode([]int{best})
+		if _, ok := top[text]; !ok {
+			top[text] = logprobs[best]
+		}
+	}
+	return top
+}
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	llama "github.com/go-skynet/go-llama.cpp"
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// wordsModel is a logits model whose tokens are the lengths of the words of
+// the text, up to 4, each length being the one of a word of its own: a, bb,
+// ccc and dddd. Its state counts the tokens evaluated by their value modulo 4,
+// it is its embedding, and it predicts the word following the last one.
+type wordsModel struct{}
+
+func (wordsModel) Encode(text string) ([]int, error) {
+	tokens := []int{}
+	for _, word := range strings.Fields(text) {
+		tokens = append(tokens, len(word))
+	}
+	return tokens, nil
+}
+
+func (wordsModel) Decode(tokens []int) string {
+	text := ""
+	for _, t := range tokens {
+		if t > 0 {
+			text += " " + strings.Repeat(string(rune('a'+t-1)), t)
+		}
+	}
+	return text
+}
+
+func (wordsModel) Eval(token int, state []float32) ([]float32, []float32, error) {
+	next := make([]float32, 4)
+	copy(next, state)
+	next[token%4]++
+	logits := make([]float32, 5)
+	logits[token%4+1] = 2
+	return next, logits, nil
+}
+
+func (wordsModel) Embedding(state []float32) ([]float32, error) {
+	return state, nil
+}
+
+// scoredEchoModel is the echo model, scoring its predictions as the words
+// model
+type scoredEchoModel struct {
+	*echoModel
+	wordsModel
+}
+
+func loadScoredEchoModel(_ *model.ModelLoader, _ string, _ []llama.ModelOption, _ uint32) (interface{}, error) {
+	return scoredEchoModel{echoModel: &echoModel{}}, nil
+}
+
+// rankedModel predicts its candidates in turn, scoring them as the words
+// model
+type rankedModel struct {
+	wordsModel
+	sync.Mutex
+	candidates []string
+	next       int
+}
+
+func (m *rankedModel) SetTokenCallback(func(string) bool) {}
+
+func (m *rankedModel) Predict(string, ...llama.PredictOption) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	candidate := m.candidates[m.next%len(m.candidates)]
+	m.next++
+	return candidate, nil
+}
+
+func loadWordsModel(_ *model.ModelLoader, _ string, _ []llama.ModelOption, _ uint32) (interface{}, error) {
+	return wordsModel{}, nil
+}
+
+var _ = Describe("Embeddings", func() {
+	It("are computed from the initial state", func() {
+		e, tokens, err := embedding(context.Background(), wordsModel{}, "a bb a")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tokens).To(Equal(3))
+		Expect(e).To(Equal([]float32{0, 2, 1, 0}))
+
+		_, _, err = embedding(context.Background(), wordsModel{}, " ")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("are the first state vector of the last layer of the rwkv models", func() {
+		file := filepath.Join(GinkgoT().TempDir(), "rwkv.bin")
+		header := [6]int32{0x67676d66, 100, 50277, 2, 3, 1}
+		f, err := os.Create(file)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(binary.Write(f, binary.LittleEndian, header)).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+
+		state := make([]float32, 5*3*2)
+		for i := range state {
+			state[i] = float32(i)
+		}
+		m := &rwkvLogits{file: file}
+		Expect(m.Embedding(state)).To(Equal([]float32{20, 21}))
+
+		_, err = m.Embedding(state[1:])
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("are served in the order of the inputs", func() {
+		app, _ := echoApp(map[string]string{
+			"words.yaml": "name: words\nbackend: words\nparameters:\n  model: model.bin\n",
+			"echo.yaml":  "name: echo\nbackend: echo\nparameters:\n  model: model.bin\n",
+		}, WithBackend("words", loadWordsModel))
+
+		post := func(body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			rec := httptest.NewRecorder()
+			rec.Code = resp.StatusCode
+			_, err = rec.Body.ReadFrom(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			return rec
+		}
+
+		rec := post(`{"model": "words", "input": ["a bb", "ccc", "dddd e"]}`)
+		Expect(rec.Code).To(Equal(fiber.StatusOK))
+		response := OpenAIResponse{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &response)).To(Succeed())
+		Expect(response.Object).To(Equal("list"))
+		Expect(response.Data).To(Equal([]Item{
+			{Embedding: []float32{0, 1, 1, 0}, Index: 0, Object: "embedding"},
+			{Embedding: []float32{0, 0, 0, 1}, Index: 1, Object: "embedding"},
+			{Embedding: []float32{1, 1, 0, 0}, Index: 2, Object: "embedding"},
+		}))
+		Expect(response.Usage.PromptTokens).To(Equal(5))
+		Expect(response.Usage.TotalTokens).To(Equal(5))
+
+		Expect(post(`{"model": "words"}`).Code).To(Equal(fiber.StatusBadRequest))
+		Expect(post(`{"model": "echo", "input": "a bb"}`).Code).To(Equal(fiber.StatusNotImplemented))
+	})
+})
+
+var _ = Describe("Logprobs", func() {
+	// lp is the logprob of a token of the words model, likely or not
+	lp := func(likely bool) float32 {
+		if likely {
+			return float32(2 - math.Log(math.Exp(2)+4))
+		}
+		return float32(-math.Log(math.Exp(2) + 4))
+	}
+
+	It("score the completion after the prompt", func() {
+		logprobs, err := scoreTokens(context.Background(), wordsModel{}, "a", " bb a", 1, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(logprobs.Tokens).To(Equal([]string{" bb", " a"}))
+		Expect(logprobs.TextOffset).To(Equal([]int{1, 4}))
+		Expect(logprobs.TokenLogprobs).To(HaveLen(2))
+		Expect(*logprobs.TokenLogprobs[0]).To(BeNumerically("~", lp(true), 1e-6))
+		Expect(*logprobs.TokenLogprobs[1]).To(BeNumerically("~", lp(false), 1e-6))
+		Expect(logprobs.TopLogprobs[1]).To(HaveLen(1))
+		Expect(logprobs.TopLogprobs[1][" ccc"]).To(BeNumerically("~", lp(true), 1e-6))
+	})
+
+	It("have no logprob for the first token of a completion without prompt", func() {
+		logprobs, err := scoreTokens(context.Background(), wordsModel{}, "", "a bb", 2, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(logprobs.TextOffset).To(Equal([]int{0, 2}))
+		Expect(logprobs.TokenLogprobs[0]).To(BeNil())
+		Expect(logprobs.TopLogprobs[0]).To(BeNil())
+		Expect(*logprobs.TokenLogprobs[1]).To(BeNumerically("~", lp(true), 1e-6))
+		Expect(logprobs.TopLogprobs[1]).To(HaveLen(2))
+	})
+
+	It("score the prompt before the completion when echoed", func() {
+		logprobs, err := scoreTokens(context.Background(), wordsModel{}, "a bb", " a", 0, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(logprobs.Tokens).To(Equal([]string{" a", " bb", " a"}))
+		Expect(logprobs.TextOffset).To(Equal([]int{0, 2, 4}))
+		Expect(logprobs.TokenLogprobs[0]).To(BeNil())
+		Expect(*logprobs.TokenLogprobs[1]).To(BeNumerically("~", lp(true), 1e-6))
+		Expect(*logprobs.TokenLogprobs[2]).To(BeNumerically("~", lp(false), 1e-6))
+		Expect(logprobs.TopLogprobs[2]).To(BeEmpty())
+	})
+
+	Context("of the completions", func() {
+		var app *fiber.App
+
+		BeforeEach(func() {
+			app, _ = echoApp(map[string]string{
+				"scored.yaml": "name: scored\nbackend: scored\nparameters:\n  model: model.bin\n",
+				"echo.yaml":   "name: echo\nbackend: echo\nparameters:\n  model: model.bin\n",
+			}, WithBackend("scored", loadScoredEchoModel))
+		})
+
+		post := func(body string) (int, []byte) {
+			req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			rec := httptest.NewRecorder()
+			_, err = rec.Body.ReadFrom(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			return resp.StatusCode, rec.Body.Bytes()
+		}
+
+		It("are returned when requested", func() {
+			code, body := post(`{"model": "scored", "prompt": "a bb", "logprobs": 1}`)
+			Expect(code).To(Equal(fiber.StatusOK))
+			response := OpenAIResponse{}
+			Expect(json.Unmarshal(body, &response)).To(Succeed())
+			Expect(response.Choices).To(HaveLen(1))
+			Expect(response.Choices[0].Text).To(Equal("a bb"))
+
+			logprobs := response.Choices[0].Logprobs
+			Expect(logprobs).ToNot(BeNil())
+			Expect(logprobs.Tokens).To(Equal([]string{" a", " bb"}))
+			Expect(logprobs.TextOffset).To(Equal([]int{4, 6}))
+			Expect(*logprobs.TokenLogprobs[0]).To(BeNumerically("~", lp(false), 1e-6))
+			Expect(*logprobs.TokenLogprobs[1]).To(BeNumerically("~", lp(true), 1e-6))
+			Expect(logprobs.TopLogprobs[0]).To(HaveKey(" ccc"))
+		})
+
+		It("include the ones of the echoed prompt", func() {
+			code, body := post(`{"model": "scored", "prompt": "a bb", "logprobs": 0, "echo": true}`)
+			Expect(code).To(Equal(fiber.StatusOK))
+			response := OpenAIResponse{}
+			Expect(json.Unmarshal(body, &response)).To(Succeed())
+			Expect(response.Choices[0].Text).To(Equal("a bba bb"))
+
+			logprobs := response.Choices[0].Logprobs
+			Expect(logprobs.Tokens).To(Equal([]string{" a", " bb", " a", " bb"}))
+			Expect(logprobs.TextOffset).To(Equal([]int{0, 2, 4, 6}))
+			Expect(logprobs.TokenLogprobs[0]).To(BeNil())
+		})
+
+		It("rank the best_of choices", func() {
+			app, _ = echoApp(map[string]string{
+				"ranked.yaml": "name: ranked\nbackend: ranked\nparameters:\n  model: model.bin\n",
+			}, WithBackend("ranked", func(*model.ModelLoader, string, []llama.ModelOption, uint32) (interface{}, error) {
+				return &rankedModel{candidates: []string{" ccc", " bb ccc", " a a", " bb"}}, nil
+			}))
+
+			code, body := post(`{"model": "ranked", "prompt": "a", "n": 2, "best_of": 4}`)
+			Expect(code).To(Equal(fiber.StatusOK))
+			response := OpenAIResponse{}
+			Expect(json.Unmarshal(body, &response)).To(Succeed())
+			Expect(response.Choices).To(HaveLen(2))
+			Expect([]string{response.Choices[0].Text, response.Choices[1].Text}).To(Equal([]string{" bb", " bb ccc"}))
+			Expect(response.Choices[0].Index).To(Equal(0))
+			Expect(response.Choices[0].Logprobs).To(BeNil())
+
+			code, body = post(`{"model": "ranked", "prompt": "a", "best_of": 4, "logprobs": 0}`)
+			Expect(code).To(Equal(fiber.StatusOK))
+			response = OpenAIResponse{}
+			Expect(json.Unmarshal(body, &response)).To(Succeed())
+			Expect(response.Choices).To(HaveLen(1))
+			Expect(response.Choices[0].Text).To(Equal(" bb"))
+			Expect(response.Choices[0].Logprobs.Tokens).To(Equal([]string{" bb"}))
+
+			code, _ = post(`{"model": "ranked", "prompt": "a", "n": 2, "best_of": 1}`)
+			Expect(code).To(Equal(fiber.StatusBadRequest))
+		})
+
+		It("are null when not requested", func() {
+			code, body := post(`{"model": "scored", "prompt": "a bb"}`)
+			Expect(code).To(Equal(fiber.StatusOK))
+			Expect(string(body)).To(ContainSubstring(`"logprobs":null`))
+		})
+
+		It("are rejected when the backend doesn't report them, or when streaming", func() {
+			code, _ := post(`{"model": "echo", "prompt": "a bb", "logprobs": 1}`)
+			Expect(code).To(Equal(fiber.StatusBadRequest))
+			code, _ = post(`{"model": "scored", "prompt": "a bb", "logprobs": 1, "stream": true}`)
+			Expect(code).To(Equal(fiber.StatusBadRequest))
+			code, _ = post(`{"model": "echo", "prompt": "a bb", "best_of": 2}`)
+			Expect(code).To(Equal(fiber.StatusBadRequest))
+		})
+	})
+})
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+const (
+	// modelLocal is set to the name of the model requested, to label the
+	// metrics
+	modelLocal = "model"
+	// usageLocal is set to the TokenUsage of the requests which report it
+	usageLocal = "usage"
+	// userLocal is set to the end user of the requests which name one
+	userLocal = "user"
+)
+
+// the predictions can take minutes, so the buckets go from 100ms to ~7m
+var durationBuckets = prometheus.ExponentialBuckets(0.1, 2, 13)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "localai",
+		Name:      "requests_total",
+		Help:      "Number of requests served, by endpoint, model and status code.",
+	}, []string{"endpoint", "model", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "localai",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve the requests, by endpoint and model.",
+		Buckets:   durationBuckets,
+	}, []string{"endpoint", "model"})
+
+	inferenceDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "localai",
+		Name:      "inference_duration_seconds",
+		Help:      "Time taken to compute the choices of a prompt, by model file.",
+		Buckets:   durationBuckets,
+	}, []string{"model"})
+
+	generatedTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "localai",
+		Name:      "generated_tokens_total",
+		Help:      "Number of tokens generated, by model file.",
+	}, []string{"model"})
+)
+
+// newMetricsRegistry returns the registry of the metrics of an app, which
+// also reports the models loaded by its loader.
+func newMetricsRegistry(loader *model.ModelLoader) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		inferenceDuration,
+		generatedTokens,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "localai",
+			Name:      "loaded_models",
+			Help:      "Number of models loaded in memory.",
+		}, func() float64 {
+			return float64(loader.LoadedModels())
+		}),
+	)
+	return registry
+}
+
+// metricsHandler serves the metrics of the registry in the Prometheus format
+func metricsHandler(registry *prometheus.Registry) fiber.Handler {
+	handler := fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	return func(c *fiber.Ctx) error {
+		handler(c.Context())
+		return nil
+	}
+}
+
+// instrument counts the requests and measures their duration. The endpoints
+// are labeled without the /v1 prefix, so both routes share their metrics. The
+// requests to a model are logged, without their bodies, see debugLog, along
+// with their end user if set. The users don't label the metrics, as there is
+// no bound to their number.
+func instrument() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		endpoint := strings.TrimPrefix(c.Route().Path, "/v1")
+		if endpoint == "/metrics" {
+			return err
+		}
+		modelName, _ := c.Locals(modelLocal).(string)
+
+		code := c.Response().StatusCode()
+		if err != nil {
+			code, _ = errorResponse(err)
+		}
+
+		latency := time.Since(start)
+		requestsTotal.WithLabelValues(endpoint, modelName, strconv.Itoa(code)).Inc()
+		requestDuration.WithLabelValues(endpoint, modelName).Observe(latency.Seconds())
+
+		if modelName != "" {
+			usage, _ := c.Locals(usageLocal).(TokenUsage)
+			event := requestLogger(c).Info()
+			if user, _ := c.Locals(userLocal).(string); user != "" {
+				event = event.Str("user", user)
+			}
+			event.
+				Str("endpoint", endpoint).
+				Str("model", modelName).
+				Int("status", code).
+				Int("prompt_tokens", usage.Prompt).
+				Int("completion_tokens", usage.Completion).
+				Int("tokens", usage.Prompt+usage.Completion).
+				Int64("latency_ms", latency.Milliseconds()).
+				Msg("request served")
+		}
+		return err
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+)
+
+var _ = Describe("Metrics", func() {
+	It("are served in the Prometheus format", func() {
+		app, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true))
+		Expect(err).ToNot(HaveOccurred())
+
+		req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"prompt": "no model"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(fiber.StatusBadRequest))
+
+		resp, err = app.Test(httptest.NewRequest("GET", "/metrics", nil))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring(`localai_requests_total{code="400",endpoint="/completions",model=""}`))
+		Expect(string(body)).To(ContainSubstring("localai_loaded_models 0"))
+	})
+	It("log the end user of the requests", func() {
+		var buf bytes.Buffer
+		app, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true), WithLogger(zerolog.New(&buf)))
+		Expect(err).ToNot(HaveOccurred())
+
+		req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model": "missing", "prompt": "Hi", "user": "user-1234"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(fiber.StatusNotFound))
+		Expect(buf.String()).To(ContainSubstring(`"user":"user-1234"`))
+		Expect(buf.String()).To(ContainSubstring(`"model":"missing"`))
+	})
+	It("log the id of the requests", func() {
+		var buf bytes.Buffer
+		app, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true), WithLogger(zerolog.New(&buf)))
+		Expect(err).ToNot(HaveOccurred())
+
+		req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model": "missing", "prompt": "Hi"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Request-Id", "req-1234")
+		resp, err := app.Test(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.Header.Get("X-Request-Id")).To(Equal("req-1234"))
+		Expect(buf.String()).To(ContainSubstring(`"request_id":"req-1234"`))
+		Expect(buf.String()).To(ContainSubstring(`"latency_ms":`))
+
+		// the requests without an id are given one
+		req = httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model": "missing", "prompt": "Hi"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err = app.Test(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.Header.Get("X-Request-Id")).ToNot(BeEmpty())
+	})
+})
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// moderationCategories are the categories of the OpenAI moderation API, all
+// of them are returned whatever the rules configured.
+var moderationCategories = []string{
+	"hate",
+	"hate/threatening",
+	"self-harm",
+	"sexual",
+	"sexual/minors",
+	"violence",
+	"violence/graphic",
+}
+
+// https://platform.openai.com/docs/api-reference/moderations
+type ModerationRequest struct {
+	Input StringList `json:"input"`
+	Model string     `json:"model"`
+}
+
+type ModerationResult struct {
+	Flagged        bool               `json:"flagged"`
+	Categories     map[string]bool    `json:"categories"`
+	CategoryScores map[string]float64 `json:"category_scores"`
+}
+
+type ModerationResponse struct {
+	ID      string             `json:"id"`
+	Model   string             `json:"model"`
+	Results []ModerationResult `json:"results"`
+}
+
+// moderate flags the text in the categories of the rules, which map the
+// categories to the keywords flagging them, matched case insensitively.
+func moderate(text string, rules map[string][]string) ModerationResult {
+	result := ModerationResult{
+		Categories:     map[string]bool{},
+		CategoryScores: map[string]float64{},
+	}
+	for _, category := range moderationCategories {
+		result.Categories[category] = false
+		result.CategoryScores[category] = 0
+	}
+
+	text = strings.ToLower(text)
+	for category, keywords := range rules {
+		for _, keyword := range keywords {
+			if keyword != "" && strings.Contains(text, strings.ToLower(keyword)) {
+				result.Categories[category] = true
+				result.CategoryScores[category] = 1
+				result.Flagged = true
+				break
+			}
+		}
+	}
+	return result
+}
+
+// moderationEndpoint classifies the input with the moderation rules of the
+// model config. Without a config, or rules, nothing is flagged.
+func moderationEndpoint(cm *ConfigMerger, o *Option) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		input := new(ModerationRequest)
+		if err := c.BodyParser(input); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err.Error()))
+		}
+		if len(input.Input) == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "input is required")
+		}
+
+		var rules map[string][]string
+		if config, exists := cm.Get(input.Model); exists {
+			rules = config.Moderation
+		}
+		if len(rules) == 0 {
+			requestLogger(c).Debug().Msgf("No moderation rules for model %q, nothing is flagged", input.Model)
+		}
+
+		resp := ModerationResponse{
+			ID:    newResponseID("modr-"),
+			Model: input.Model,
+		}
+		for _, text := range input.Input {
+			resp.Results = append(resp.Results, moderate(text, rules))
+		}
+
+		return c.JSON(resp)
+	}
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Moderation", func() {
+	moderations := func(app *fiber.App, body string) ModerationResponse {
+		req := httptest.NewRequest("POST", "/v1/moderations", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+
+		moderation := ModerationResponse{}
+		Expect(json.NewDecoder(resp.Body).Decode(&moderation)).To(Succeed())
+		return moderation
+	}
+
+	It("flags the inputs matching the rules of the model", func() {
+		result := moderate("I will HURT you", map[string][]string{"violence": {"hurt", "kill"}})
+		Expect(result.Flagged).To(BeTrue())
+		Expect(result.Categories["violence"]).To(BeTrue())
+		Expect(result.CategoryScores["violence"]).To(Equal(1.0))
+		Expect(result.Categories["hate"]).To(BeFalse())
+
+		Expect(moderate("hello", map[string][]string{"violence": {"hurt"}}).Flagged).To(BeFalse())
+	})
+	It("flags nothing without rules", func() {
+		app, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true))
+		Expect(err).ToNot(HaveOccurred())
+
+		moderation := moderations(app, `{"model": "text-moderation-latest", "input": ["I will hurt you", "hello"]}`)
+		Expect(moderation.ID).To(HavePrefix("modr-"))
+		Expect(moderation.Results).To(HaveLen(2))
+		for _, result := range moderation.Results {
+			Expect(result.Flagged).To(BeFalse())
+			Expect(result.Categories).To(HaveLen(len(moderationCategories)))
+		}
+	})
+})
@@ -3,16 +3,24 @@ package api
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	model "github.com/go-skynet/LocalAI/pkg/model"
+	whisper "github.com/go-skynet/LocalAI/pkg/whisper"
 	"github.com/gofiber/fiber/v2"
-	"github.com/rs/zerolog/log"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
 	"github.com/valyala/fasthttp"
+	"gopkg.in/yaml.v3"
 )
 
 // APIError provides error information returned by the OpenAI API.
@@ -27,6 +35,33 @@ type ErrorResponse struct {
 	Error *APIError `json:"error,omitempty"`
 }
 
+// errorResponse wraps err in the OpenAI error envelope. The status code is
+// the one of the *fiber.Error in the chain, if any, 400 for the invalid
+// parameters, naming them, and 500 otherwise.
+func errorResponse(err error) (int, ErrorResponse) {
+	code := fiber.StatusInternalServerError
+	var e *fiber.Error
+	if errors.As(err, &e) {
+		code = e.Code
+	}
+
+	var param *string
+	var pe *paramError
+	if errors.As(err, &pe) {
+		code = fiber.StatusBadRequest
+		param = &pe.param
+	}
+
+	errType := "server_error"
+	if code >= 400 && code < 500 {
+		errType = "invalid_request_error"
+	}
+
+	return code, ErrorResponse{
+		Error: &APIError{Message: err.Error(), Code: code, Param: param, Type: errType},
+	}
+}
+
 type OpenAIUsage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
@@ -39,50 +74,294 @@ type OpenAIResponse struct {
 	ID      string      `json:"id,omitempty"`
 	Model   string      `json:"model,omitempty"`
 	Choices []Choice    `json:"choices,omitempty"`
+	Data    []Item      `json:"data,omitempty"`
 	Usage   OpenAIUsage `json:"usage"`
+	// Timings is set when the request asks for them, it is not part of the
+	// OpenAI API
+	Timings *Timings `json:"timings,omitempty"`
+}
+
+// Item is an embedding of the response of the embeddings API call, Index being
+// the one of its input.
+type Item struct {
+	Embedding []float32 `json:"embedding"`
+	Index     int       `json:"index"`
+	Object    string    `json:"object"`
+}
+
+// Timings reports how long the prompt took to evaluate and the completion to
+// generate, in milliseconds, and their speed in tokens per second. The prompt
+// is timed until the first token, by the backends streaming their tokens
+// only, the other ones time the whole prediction as the completion.
+type Timings struct {
+	PromptTokens       int     `json:"prompt_n"`
+	PromptMS           float64 `json:"prompt_ms"`
+	PromptPerSecond    float64 `json:"prompt_per_second"`
+	PredictedTokens    int     `json:"predicted_n"`
+	PredictedMS        float64 `json:"predicted_ms"`
+	PredictedPerSecond float64 `json:"predicted_per_second"`
+}
+
+// DryRunResponse holds the prompts a request with dry_run would give the
+// model. Template is the name of the template they were rendered with,
+// "inline" for the one of the request, and TemplateFile its file, empty for
+// the built-in ones. TemplateFound is false when the template is missing, and
+// the input was used as is.
+type DryRunResponse struct {
+	Object        string   `json:"object"`
+	Model         string   `json:"model"`
+	Prompts       []string `json:"prompts"`
+	Template      string   `json:"template"`
+	TemplateFile  string   `json:"template_file,omitempty"`
+	TemplateFound bool     `json:"template_found"`
+}
+
+// PromptTemplateData is the data available to the prompt templates
+type PromptTemplateData struct {
+	Input string
+	// Instruction is set by the edit API calls
+	Instruction string
+	// Suffix is set by the completion API calls asking to fill in the middle
+	Suffix string
+	// Messages and SystemPrompt are set by the chat API calls, for the
+	// templates rendering the turns themselves rather than using Input.
+	// Messages include the system ones, with the roles sent.
+	Messages     []Message
+	SystemPrompt string
+	// AssistantPrefix is the assistant_prefix of the config, which Input
+	// ends with, for the templates rendering the turns to end with it too
+	AssistantPrefix string
+}
+
+// TokenizeResponse holds the ids of the tokens of a text, and their count
+type TokenizeResponse struct {
+	Tokens []int `json:"tokens"`
+	Count  int   `json:"count"`
 }
 
 type Choice struct {
-	Index        int      `json:"index,omitempty"`
+	Index        int      `json:"index"`
 	FinishReason string   `json:"finish_reason,omitempty"`
 	Message      *Message `json:"message,omitempty"`
 	Delta        *Message `json:"delta,omitempty"`
 	Text         string   `json:"text,omitempty"`
+
+	// Logprobs is null unless requested by a completion call
+	Logprobs *Logprobs `json:"logprobs"`
+}
+
+// Logprobs holds the logprobs of the tokens of a completion choice, and the
+// most likely tokens at each position. TextOffset is the position of each
+// token in the prompt followed by the completion. A token has no logprob when
+// no token is before it.
+type Logprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []*float32           `json:"token_logprobs"`
+	TopLogprobs   []map[string]float32 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
 }
 
 type Message struct {
-	Role    string `json:"role,omitempty" yaml:"role"`
+	Role string `json:"role,omitempty" yaml:"role"`
+	// Content is the text of the message. The requests can give it as an
+	// array of text parts, see UnmarshalJSON
 	Content string `json:"content,omitempty" yaml:"content"`
 }
 
 type OpenAIModel struct {
-	ID     string `json:"id"`
-	Object string `json:"object"`
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created,omitempty"`
+	OwnedBy string `json:"owned_by,omitempty"`
+}
+
+// StringList is a list of strings which can be given either as a single
+// string or as an array of strings, e.g. the "stop" and "prompt" parameters.
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*l = nil
+		return nil
+	}
+
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = StringList{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("expected a string or an array of strings: %w", err)
+	}
+	*l = list
+	return nil
+}
+
+func (l *StringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var single string
+		if err := value.Decode(&single); err != nil {
+			return err
+		}
+		*l = StringList{single}
+		return nil
+	}
+
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return fmt.Errorf("expected a string or a list of strings: %w", err)
+	}
+	*l = list
+	return nil
+}
+
+// ContentPart is a part of the content of a message. Only the text parts are
+// supported, as none of the backends is multimodal.
+type ContentPart struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// UnmarshalJSON reads the content of the message either as a string or as an
+// array of text parts, joined by newlines into Content.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var message struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+	*m = Message{Role: message.Role}
+	if len(message.Content) == 0 || bytes.Equal(message.Content, []byte("null")) {
+		return nil
+	}
+
+	if err := json.Unmarshal(message.Content, &m.Content); err == nil {
+		return nil
+	}
+
+	var parts []ContentPart
+	if err := json.Unmarshal(message.Content, &parts); err != nil {
+		return fmt.Errorf("expected a string or an array of content parts: %w", err)
+	}
+	texts := []string{}
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			return invalidParam("messages", "image_url content parts are unsupported, none of the backends of this build is multimodal")
+		default:
+			return fmt.Errorf("unsupported content part type %q", part.Type)
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+// ResponseFormat is the format of the response, given either as a string or
+// as an object with its type, as the chat endpoint does.
+type ResponseFormat struct {
+	Type string `json:"type" yaml:"type"`
+}
+
+func (f *ResponseFormat) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*f = ResponseFormat{}
+		return nil
+	}
+
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*f = ResponseFormat{Type: single}
+		return nil
+	}
+
+	type format ResponseFormat
+	var object format
+	if err := json.Unmarshal(data, &object); err != nil {
+		return fmt.Errorf("expected a string or an object with a type: %w", err)
+	}
+	*f = ResponseFormat(object)
+	return nil
+}
+
+func (f *ResponseFormat) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&f.Type)
+	}
+
+	type format ResponseFormat
+	var object format
+	if err := value.Decode(&object); err != nil {
+		return fmt.Errorf("expected a string or an object with a type: %w", err)
+	}
+	*f = ResponseFormat(object)
+	return nil
 }
 
 type OpenAIRequest struct {
 	Model string `json:"model" yaml:"model"`
 
-	// Prompt is read only by completion API calls
-	Prompt interface{} `json:"prompt" yaml:"prompt"`
+	// Prompt is read only by completion API calls, one choice is returned
+	// per prompt
+	Prompt StringList `json:"prompt" yaml:"prompt"`
+	// Suffix follows the completion, for fill-in-the-middle completions
+	Suffix string `json:"suffix" yaml:"-"`
 
 	// Edit endpoint
 	Instruction string `json:"instruction" yaml:"instruction"`
-	Input       string `json:"input" yaml:"input"`
 
-	Stop interface{} `json:"stop" yaml:"stop"`
+	// Content is read only by the tokenize endpoint
+	Content string `json:"content" yaml:"-"`
+
+	// ResponseFormat is json_object to get the completions as a JSON object
+	ResponseFormat ResponseFormat `json:"response_format" yaml:"response_format"`
+
+	// Input is read by the edit and embeddings API calls
+	Input interface{} `json:"input" yaml:"input"`
+
+	Stop StringList `json:"stop" yaml:"stop"`
 
 	// Messages is read only by chat/completion API calls
 	Messages []Message `json:"messages" yaml:"messages"`
 
 	Stream bool `json:"stream"`
 	Echo   bool `json:"echo"`
+
+	// LogProbs is the number of most likely tokens to return along with the
+	// logprobs of the generated ones. It is read only by completion API
+	// calls
+	LogProbs *int `json:"logprobs" yaml:"-"`
+
+	// BestOf is the number of choices generated to return the N with the
+	// highest logprob. It is read only by completion API calls
+	BestOf int `json:"best_of" yaml:"-"`
+
+	// StreamOptions is read only by streamed API calls
+	StreamOptions *StreamOptions `json:"stream_options" yaml:"-"`
+
+	// Template is a prompt template rendered in place of the one of the
+	// config, when the server allows inline templates
+	Template string `json:"template" yaml:"-"`
+
+	// DryRun returns the prompts rendered for the model, see
+	// DryRunResponse, without running it. It is read by the completion,
+	// chat and edit API calls
+	DryRun bool `json:"dry_run" yaml:"-"`
+
 	// Common options between all the API calls
 	TopP        float64 `json:"top_p" yaml:"top_p"`
 	TopK        int     `json:"top_k" yaml:"top_k"`
 	Temperature float64 `json:"temperature" yaml:"temperature"`
 	Maxtokens   int     `json:"max_tokens" yaml:"max_tokens"`
 
+	FrequencyPenalty float64 `json:"frequency_penalty" yaml:"frequency_penalty"`
+	PresencePenalty  float64 `json:"presence_penalty" yaml:"presence_penalty"`
+
 	N int `json:"n"`
 
 	// Custom parameters - not present in the OpenAI API
@@ -90,11 +369,119 @@ type OpenAIRequest struct {
 	F16           bool    `json:"f16" yaml:"f16"`
 	IgnoreEOS     bool    `json:"ignore_eos" yaml:"ignore_eos"`
 	RepeatPenalty float64 `json:"repeat_penalty" yaml:"repeat_penalty"`
-	Keep          int     `json:"n_keep" yaml:"n_keep"`
 
-	Seed int `json:"seed" yaml:"seed"`
+	// Keep is the number of tokens at the start of the prompt kept when the
+	// context is full and the backend discards the older tokens, -1 keeps the
+	// whole prompt. 0 leaves the default of the backend
+	Keep int `json:"n_keep" yaml:"n_keep"`
+
+	// TFSZ is the z of the tail free sampling, and TypicalP the p of the
+	// locally typical sampling. 0 disables them, as 1 does
+	TFSZ     float64 `json:"tfs_z" yaml:"tfs_z"`
+	TypicalP float64 `json:"typical_p" yaml:"typical_p"`
+
+	// Mirostat is the version of the mirostat sampling, 1 or 2, which
+	// targets the perplexity tau at the learning rate eta. 0 disables it
+	Mirostat    int     `json:"mirostat" yaml:"mirostat"`
+	MirostatTau float64 `json:"mirostat_tau" yaml:"mirostat_tau"`
+	MirostatEta float64 `json:"mirostat_eta" yaml:"mirostat_eta"`
+
+	// Seed is nil when not set, letting the backend pick a random seed
+	Seed *int `json:"seed" yaml:"seed"`
+
+	// LogitBias maps the ids of tokens to the bias added to their logits
+	// before sampling, from -100 to 100
+	LogitBias map[string]float64 `json:"logit_bias" yaml:"logit_bias"`
+
+	// Grammar is a GBNF grammar to constrain the predictions to. None of the
+	// backends of this build enforces one, so it is rejected, see
+	// validateRequest
+	Grammar string `json:"grammar" yaml:"grammar"`
+
+	// User identifies the end user of the client, it is only logged
+	User string `json:"user" yaml:"-"`
+
+	// Timings adds the Timings of the prediction to the response
+	Timings bool `json:"timings" yaml:"-"`
+
+	// set holds the keys of the JSON body of the request, telling the
+	// parameters set to zero from the ones left out
+	set map[string]bool
+}
+
+// StreamOptions are the options of the streamed responses
+type StreamOptions struct {
+	// IncludeUsage asks for a last chunk holding the token usage of the
+	// request, with no choices
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// clone returns a deep copy of the parameters, the input excepted as it is
+// only read
+func (r OpenAIRequest) clone() OpenAIRequest {
+	r.Prompt = StringList(cloneStrings(r.Prompt))
+	r.Stop = StringList(cloneStrings(r.Stop))
+	if r.Messages != nil {
+		r.Messages = append([]Message{}, r.Messages...)
+	}
+	if r.Seed != nil {
+		seed := *r.Seed
+		r.Seed = &seed
+	}
+	if r.StreamOptions != nil {
+		options := *r.StreamOptions
+		r.StreamOptions = &options
+	}
+	if r.LogitBias != nil {
+		bias := make(map[string]float64, len(r.LogitBias))
+		for k, v := range r.LogitBias {
+			bias[k] = v
+		}
+		r.LogitBias = bias
+	}
+	if r.set != nil {
+		set := make(map[string]bool, len(r.set))
+		for k, v := range r.set {
+			set[k] = v
+		}
+		r.set = set
+	}
+	return r
+}
+
+// isSet reports whether the request sets the parameter, even to zero
+func (r *OpenAIRequest) isSet(key string) bool {
+	return r.set[key]
+}
+
+func timings(u TokenUsage) *Timings {
+	perSecond := func(tokens int, d time.Duration) float64 {
+		if tokens == 0 || d <= 0 {
+			return 0
+		}
+		return float64(tokens) / d.Seconds()
+	}
+	return &Timings{
+		PromptTokens:       u.Prompt,
+		PromptMS:           float64(u.PromptDuration) / float64(time.Millisecond),
+		PromptPerSecond:    perSecond(u.Prompt, u.PromptDuration),
+		PredictedTokens:    u.Completion,
+		PredictedMS:        float64(u.CompletionDuration) / float64(time.Millisecond),
+		PredictedPerSecond: perSecond(u.Completion, u.CompletionDuration),
+	}
+}
+
+func usage(u TokenUsage) OpenAIUsage {
+	return OpenAIUsage{
+		PromptTokens:     u.Prompt,
+		CompletionTokens: u.Completion,
+		TotalTokens:      u.Prompt + u.Completion,
+	}
 }
 
+// defaultRequest holds the defaults of the parameters. They are overridden by
+// the ones of the model config, which are overridden by the ones of the
+// request.
 func defaultRequest(modelFile string) OpenAIRequest {
 	return OpenAIRequest{
 		TopP:        0.7,
@@ -105,46 +492,104 @@ func defaultRequest(modelFile string) OpenAIRequest {
 	}
 }
 
+// debugLog returns the event logging the bodies of the requests and responses
+// for the model. They can hold sensitive prompts, so they are logged only when
+// debugging the model, with debug: true in its config or --debug for all.
+func debugLog(config *Config) *zerolog.Event {
+	if !config.Debug {
+		return nil
+	}
+	l := configLogger(config).Level(zerolog.DebugLevel)
+	return l.Debug()
+}
+
+// stopWords returns a new list of the stopwords followed by more, without the
+// empty and duplicated ones. The config stopwords are never appended to in
+// place, as their backing array is shared with the config of the merger.
+func stopWords(stopWords []string, more ...string) []string {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, list := range [][]string{stopWords, more} {
+		for _, stop := range list {
+			if stop != "" && !seen[stop] {
+				seen[stop] = true
+				res = append(res, stop)
+			}
+		}
+	}
+	return res
+}
+
+// updateConfig overrides the parameters of the config with the ones of the
+// request. The sampling parameters are overridden when the request sets them,
+// even to zero, e.g. "temperature": 0. The other ones only when not zero.
 func updateConfig(config *Config, input *OpenAIRequest) {
 	if input.Echo {
 		config.Echo = input.Echo
 	}
-	if input.TopK != 0 {
+	if input.TopK != 0 || input.isSet("top_k") {
 		config.TopK = input.TopK
 	}
-	if input.TopP != 0 {
+	if input.TopP != 0 || input.isSet("top_p") {
 		config.TopP = input.TopP
 	}
 
-	if input.Temperature != 0 {
+	if input.Temperature != 0 || input.isSet("temperature") {
 		config.Temperature = input.Temperature
 	}
 
-	if input.Maxtokens != 0 {
+	if input.Maxtokens != 0 || input.isSet("max_tokens") {
 		config.Maxtokens = input.Maxtokens
 	}
 
-	switch stop := input.Stop.(type) {
-	case string:
-		if stop != "" {
-			config.StopWords = append(config.StopWords, stop)
-		}
-	case []interface{}:
-		for _, pp := range stop {
-			if s, ok := pp.(string); ok {
-				config.StopWords = append(config.StopWords, s)
-			}
+	if len(input.LogitBias) > 0 {
+		config.LogitBias = input.LogitBias
+	}
+
+	if len(input.Stop) > 0 {
+		if config.ReplaceStopWords {
+			config.StopWords = stopWords(input.Stop)
+		} else {
+			config.StopWords = stopWords(config.StopWords, input.Stop...)
 		}
 	}
 
-	if input.RepeatPenalty != 0 {
+	if input.RepeatPenalty != 0 || input.isSet("repeat_penalty") {
 		config.RepeatPenalty = input.RepeatPenalty
 	}
 
+	if input.FrequencyPenalty != 0 || input.isSet("frequency_penalty") {
+		config.FrequencyPenalty = input.FrequencyPenalty
+	}
+
+	if input.PresencePenalty != 0 || input.isSet("presence_penalty") {
+		config.PresencePenalty = input.PresencePenalty
+	}
+
 	if input.Keep != 0 {
 		config.Keep = input.Keep
 	}
 
+	if input.TFSZ != 0 {
+		config.TFSZ = input.TFSZ
+	}
+
+	if input.TypicalP != 0 {
+		config.TypicalP = input.TypicalP
+	}
+
+	if input.Mirostat != 0 || input.isSet("mirostat") {
+		config.Mirostat = input.Mirostat
+	}
+
+	if input.MirostatTau != 0 {
+		config.MirostatTau = input.MirostatTau
+	}
+
+	if input.MirostatEta != 0 {
+		config.MirostatEta = input.MirostatEta
+	}
+
 	if input.Batch != 0 {
 		config.Batch = input.Batch
 	}
@@ -157,305 +602,1199 @@ func updateConfig(config *Config, input *OpenAIRequest) {
 		config.IgnoreEOS = input.IgnoreEOS
 	}
 
-	if input.Seed != 0 {
+	if input.Seed != nil {
 		config.Seed = input.Seed
 	}
+
+	if input.Template != "" {
+		config.Template = input.Template
+	}
+
+	if input.ResponseFormat.Type != "" {
+		config.ResponseFormat = input.ResponseFormat
+	}
+
+	switch inputs := input.Input.(type) {
+	case string:
+		if inputs != "" {
+			config.InputStrings = append(config.InputStrings, inputs)
+		}
+	case []interface{}:
+		for _, pp := range inputs {
+			if s, ok := pp.(string); ok {
+				config.InputStrings = append(config.InputStrings, s)
+			}
+		}
+	}
+}
+
+// newResponseID returns a unique response id, prefixed as in the OpenAI API,
+// e.g. "chatcmpl-" or "cmpl-"
+func newResponseID(prefix string) string {
+	return prefix + uuid.New().String()
+}
+
+// bearerToken returns the token of an "Authorization: Bearer <token>" header value
+func bearerToken(header string) string {
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(header), "Bearer "))
 }
 
-func readConfig(cm ConfigMerger, c *fiber.Ctx, loader *model.ModelLoader, debug bool, threads, ctx int, f16 bool) (*Config, *OpenAIRequest, error) {
+func readConfig(cm *ConfigMerger, c *fiber.Ctx, o *Option) (*Config, *OpenAIRequest, error) {
+	loader := o.loader
 	input := new(OpenAIRequest)
 	// Get input data from the request body
 	if err := c.BodyParser(input); err != nil {
+		// the invalid parameters found while decoding are named
+		var pe *paramError
+		if errors.As(err, &pe) {
+			return nil, nil, err
+		}
+		return nil, nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err.Error()))
+	}
+	input.set = requestKeys(c)
+	c.Locals(userLocal, input.User)
+	if err := validateRequest(input); err != nil {
 		return nil, nil, err
 	}
+	if input.Template != "" && !o.inlineTemplates {
+		return nil, nil, invalidParam("template", "inline templates are not allowed by the server")
+	}
 
 	modelFile := input.Model
-	received, _ := json.Marshal(input)
 
-	log.Debug().Msgf("Request received: %s", string(received))
+	// Set model from bearer token, if available and not used as API key
+	bearer := bearerToken(c.Get("authorization"))
+	bearerExists := bearer != "" && c.Locals(apiKeyLocal) == nil && loader.ExistsInModelPath(bearer)
 
-	// Set model from bearer token, if available
-	bearer := strings.TrimLeft(c.Get("authorization"), "Bearer ")
-	bearerExists := bearer != "" && loader.ExistsInModelPath(bearer)
-
-	// If no model was specified, take the first available
+	// If no model was specified, take the default one or the first available
 	if modelFile == "" && !bearerExists {
-		models, _ := loader.ListModels()
-		if len(models) > 0 {
+		if o.defaultModel != "" {
+			modelFile = o.defaultModel
+			requestLogger(c).Debug().Msgf("No model specified, using the default: %s", modelFile)
+		} else if models, _ := loader.ListModels(); len(models) > 0 {
 			modelFile = models[0]
-			log.Debug().Msgf("No model specified, using: %s", modelFile)
+			requestLogger(c).Debug().Msgf("No model specified, using: %s", modelFile)
 		} else {
-			log.Debug().Msgf("No model specified, returning error")
-			return nil, nil, fmt.Errorf("no model specified")
+			requestLogger(c).Debug().Msgf("No model specified, returning error")
+			return nil, nil, fiber.NewError(fiber.StatusBadRequest, "no model specified")
 		}
 	}
 
 	// If a model is found in bearer token takes precedence
 	if bearerExists {
-		log.Debug().Msgf("Using model from bearer token: %s", bearer)
+		requestLogger(c).Debug().Msgf("Using model from bearer token: %s", bearer)
 		modelFile = bearer
 	}
 
+	c.Locals(modelLocal, modelFile)
+
+	config, err := modelConfig(cm, o, modelFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.logger = requestLogger(c)
+
+	if config.disabled() {
+		return nil, nil, fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("The model '%s' is disabled", modelFile))
+	}
+
+	// The model must be either a config or a file of the models path,
+	// otherwise the request would fail later on loading it
+	if _, known := cm.Get(modelFile); !known && !loader.ExistsInModelPath(modelFile) {
+		return nil, nil, fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("The model '%s' does not exist", modelFile))
+	}
+
+	// The aliases of a model share its limit
+	limited := config.Name
+	if limited == "" {
+		limited = modelFile
+	}
+	if err := checkRateLimit(c, o, config, limited); err != nil {
+		return nil, nil, err
+	}
+
+	// the request is marshalled only when it is logged
+	if debug := debugLog(config); debug.Enabled() {
+		received, _ := json.Marshal(input)
+		debug.Msgf("Request received: %s", string(received))
+	}
+
+	// Set the parameters for the language model prediction
+	updateConfig(config, input)
+	if err := updateExtra(config, unknownFields(c)); err != nil {
+		return nil, nil, err
+	}
+
+	return config, input, nil
+}
+
+// requestKeys returns the keys of the JSON body of the request, the null ones
+// excluded. It is empty for the other bodies.
+func requestKeys(c *fiber.Ctx) map[string]bool {
+	keys := map[string]bool{}
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		return keys
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(c.Body(), &fields); err != nil {
+		return keys
+	}
+	for key, value := range fields {
+		if !bytes.Equal(value, []byte("null")) {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// modelConfig returns the config of the model, loading its config file from
+// the models path if present. The config file is validated as the ones loaded
+// at startup, an invalid one fails the request with a 400. The settings given
+// on the command line apply when the config leaves them unset.
+func modelConfig(cm *ConfigMerger, o *Option, modelFile string) (*Config, error) {
 	// Load a config file if present after the model name
-	modelConfig := filepath.Join(loader.ModelPath, modelFile+".yaml")
-	if _, err := os.Stat(modelConfig); err == nil {
-		if err := cm.LoadConfig(modelConfig); err != nil {
-			return nil, nil, fmt.Errorf("failed loading model config (%s) %s", modelConfig, err.Error())
+	for _, ext := range []string{".yaml", ".json"} {
+		modelConfig := filepath.Join(o.loader.ModelPath, modelFile+ext)
+		if _, err := os.Stat(modelConfig); err != nil {
+			continue
+		}
+		c, err := cm.readConfig(modelConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading model config (%s) %s", modelConfig, err.Error())
 		}
+		c.backends = o.backends
+		if err := c.Validate(o.loader.ModelPath); err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("invalid model config (%s) %s", modelConfig, err.Error()))
+		}
+		cm.Set(c.Name, *c)
+		break
 	}
 
 	var config *Config
-	cfg, exists := cm[modelFile]
+	cfg, exists := cm.Get(modelFile)
 	if !exists {
+		// served with the default parameters, as overridden in the
+		// environment for all the models or for this one by its name
 		config = &Config{
+			Name:          modelFile,
 			OpenAIRequest: defaultRequest(modelFile),
 		}
+		if err := config.prepare(o.loader.ModelPath); err != nil {
+			return nil, err
+		}
 	} else {
+		// The requests change their config, which must not leak into the
+		// one of the merger
+		cfg = cfg.clone()
 		config = &cfg
 	}
 
-	// Set the parameters for the language model prediction
-	updateConfig(config, input)
-
-	if threads != 0 {
-		config.Threads = threads
+	// The command line settings are defaults for the models which don't
+	// set them in their config
+	if config.Threads == 0 {
+		config.Threads = o.threads
 	}
-	if ctx != 0 {
-		config.ContextSize = ctx
+	if config.ContextSize == 0 {
+		config.ContextSize = o.ctxSize
 	}
-	if f16 {
+	if o.f16 {
 		config.F16 = true
 	}
 
-	if debug {
+	if o.debug {
 		config.Debug = true
 	}
 
-	return config, input, nil
+	config.backends = o.backends
+	return config, nil
+}
+
+// predictionContext returns the context the predictions of the request run
+// in. It is cancelled when the client goes away, and after the timeout of the
+// model config or, if it doesn't set one, the one of the server. It derives
+// from the base context of the server rather than from the one of the
+// request, which fasthttp cancels as soon as the server starts shutting down.
+func predictionContext(c *fiber.Ctx, config *Config, o *Option) (context.Context, context.CancelFunc) {
+	timeout := o.requestTimeout
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(o.baseContext, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(o.baseContext)
+	}
+
+	stop := watchDisconnect(c, cancel)
+	var once sync.Once
+	return ctx, func() {
+		once.Do(stop)
+		cancel()
+	}
+}
+
+// predictionError turns the predictions which ran out of time into a 504
+func predictionError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fiber.NewError(fiber.StatusGatewayTimeout, "the request timed out")
+	}
+	return err
 }
 
 // https://platform.openai.com/docs/api-reference/completions
-func completionEndpoint(cm ConfigMerger, debug bool, loader *model.ModelLoader, threads, ctx int, f16 bool) func(c *fiber.Ctx) error {
+func completionEndpoint(cm *ConfigMerger, o *Option) func(c *fiber.Ctx) error {
+	loader := o.loader
 	return func(c *fiber.Ctx) error {
-		config, input, err := readConfig(cm, c, loader, debug, threads, ctx, f16)
+		config, input, err := readConfig(cm, c, o)
 		if err != nil {
 			return fmt.Errorf("failed reading parameters from request:%w", err)
 		}
 
-		log.Debug().Msgf("Parameter Config: %+v", config)
+		config.LogProbs = input.LogProbs
 
-		predInput := []string{}
+		debugLog(config).Msgf("Parameter Config: %+v", config)
 
-		switch p := input.Prompt.(type) {
-		case string:
-			predInput = append(predInput, p)
-		case []interface{}:
-			for _, pp := range p {
-				if s, ok := pp.(string); ok {
-					predInput = append(predInput, s)
-				}
+		predInput := append([]string{}, input.Prompt...)
+
+		for k, i := range predInput {
+			templatedInput, err := templateInput(loader, config, config.TemplateConfig.Completion, i, PromptTemplateData{
+				Input:  i,
+				Suffix: input.Suffix,
+			})
+			if err != nil {
+				return err
+			}
+			predInput[k] = templatedInput
+
+			tokens, estimated := promptTokens(loader, config, templatedInput)
+			if err := checkPromptTokens(o, "prompt", tokens, estimated); err != nil {
+				return err
+			}
+			config.truncated += promptOverflow(config, tokens)
+		}
+		setTruncated(c, config)
+
+		if input.DryRun {
+			return dryRun(c, loader, config, input, config.TemplateConfig.Completion, predInput...)
+		}
+
+		if input.Stream {
+			if len(predInput) != 1 {
+				return fiber.NewError(fiber.StatusBadRequest, "streaming requires a single prompt")
+			}
+			if config.LogProbs != nil {
+				return invalidParam("logprobs", "logprobs can't be streamed")
 			}
+
+			// the chunks of a streamed response share the same id
+			id := newResponseID("cmpl-")
+			created := int(time.Now().Unix())
+
+			return streamPrediction(c, o, config, input, predInput[0], func(index int, token string) OpenAIResponse {
+				return OpenAIResponse{
+					ID:      id,
+					Created: created,
+					Model:   input.Model, // we have to return what the user sent here, due to OpenAI spec.
+					Choices: []Choice{{Index: index, Text: token}},
+					Object:  "text_completion",
+				}
+			}, func(index int, finishReason string) OpenAIResponse {
+				return OpenAIResponse{
+					ID:      id,
+					Created: created,
+					Model:   input.Model, // we have to return what the user sent here, due to OpenAI spec.
+					Choices: []Choice{{Index: index, FinishReason: finishReason}},
+					Object:  "text_completion",
+				}
+			})
 		}
 
-		templateFile := config.Model
+		cacheKey := responseCacheKey(c, o, config, input, predInput...)
+		if resp, cached := o.responseCache.get(c, cacheKey); cached {
+			return c.JSON(resp)
+		}
+
+		ctx, cancel := predictionContext(c, config, o)
+		defer cancel()
 
-		if config.TemplateConfig.Completion != "" {
-			templateFile = config.TemplateConfig.Completion
+		done, err := o.limiter.acquire(ctx)
+		if err != nil {
+			return predictionError(err)
 		}
+		defer done()
 
 		var result []Choice
+		totalTokenUsage := TokenUsage{}
 		for _, i := range predInput {
-			// A model can have a "file.bin.tmpl" file associated with a prompt template prefix
-			templatedInput, err := loader.TemplatePrefix(templateFile, struct {
-				Input string
-			}{Input: i})
-			if err == nil {
-				i = templatedInput
-				log.Debug().Msgf("Template found, input modified to: %s", i)
-			}
-
-			r, err := ComputeChoices(i, input, config, loader, func(s string, c *[]Choice) {
+			cb := func(s string, c *[]Choice) {
 				*c = append(*c, Choice{Text: s})
-			}, nil)
+			}
+			var r []Choice
+			var tokenUsage TokenUsage
+			if input.BestOf > 1 {
+				r, tokenUsage, err = ComputeBestChoices(ctx, i, input, config, loader, cb)
+			} else {
+				r, tokenUsage, err = ComputeChoices(ctx, i, input, config, loader, cb, nil)
+			}
 			if err != nil {
-				return err
+				return predictionError(err)
 			}
 
+			totalTokenUsage.add(tokenUsage)
+
 			result = append(result, r...)
 		}
 
+		for i := range result {
+			result[i].Index = i
+		}
+
+		c.Locals(usageLocal, totalTokenUsage)
+
 		resp := &OpenAIResponse{
+			ID:      newResponseID("cmpl-"),
+			Created: int(time.Now().Unix()),
 			Model:   input.Model, // we have to return what the user sent here, due to OpenAI spec.
 			Choices: result,
 			Object:  "text_completion",
+			Usage:   usage(totalTokenUsage),
+		}
+		if input.Timings {
+			resp.Timings = timings(totalTokenUsage)
 		}
+		o.responseCache.add(cacheKey, *resp)
 
-		jsonResult, _ := json.Marshal(resp)
-		log.Debug().Msgf("Response: %s", jsonResult)
+		if debug := debugLog(config); debug.Enabled() {
+			jsonResult, _ := json.Marshal(resp)
+			debug.Msgf("Response: %s", jsonResult)
+		}
 
 		// Return the prediction in the response body
 		return c.JSON(resp)
 	}
 }
 
-func chatEndpoint(cm ConfigMerger, debug bool, loader *model.ModelLoader, threads, ctx int, f16 bool) func(c *fiber.Ctx) error {
-	return func(c *fiber.Ctx) error {
-		config, input, err := readConfig(cm, c, loader, debug, threads, ctx, f16)
-		if err != nil {
-			return fmt.Errorf("failed reading parameters from request:%w", err)
-		}
-
-		log.Debug().Msgf("Parameter Config: %+v", config)
-
-		var predInput string
-
-		mess := []string{}
-		for _, i := range input.Messages {
-			r := config.Roles[i.Role]
-			if r == "" {
-				r = i.Role
-			}
+// chatTemplateData returns the template data of the chat messages. Input
+// flattens them one per line, prefixed by their role as mapped by the config.
+// The system prompt of the config is prepended when the request doesn't send
+// a system message, and the assistant prefix of the config ends Input.
+func chatTemplateData(config *Config, messages []Message) PromptTemplateData {
+	if config.SystemPrompt != "" && !hasSystemMessage(messages) {
+		messages = append([]Message{{Role: "system", Content: config.SystemPrompt}}, messages...)
+	}
 
-			content := fmt.Sprint(r, " ", i.Content)
-			mess = append(mess, content)
+	mess := []string{}
+	system := []string{}
+	for _, i := range messages {
+		r := config.Roles[i.Role]
+		if r == "" {
+			r = i.Role
 		}
 
-		predInput = strings.Join(mess, "\n")
+		content := fmt.Sprint(r, " ", i.Content)
+		mess = append(mess, content)
 
-		if input.Stream {
-			log.Debug().Msgf("Stream request received")
-			c.Context().SetContentType("text/event-stream")
-			//c.Response().Header.SetContentType(fiber.MIMETextHTMLCharsetUTF8)
-			//	c.Set("Content-Type", "text/event-stream")
-			c.Set("Cache-Control", "no-cache")
-			c.Set("Connection", "keep-alive")
-			c.Set("Transfer-Encoding", "chunked")
+		if i.Role == "system" {
+			system = append(system, i.Content)
 		}
+	}
 
-		templateFile := config.Model
+	// the prompt ends with the assistant turn, for the model to respond
+	if config.AssistantPrefix != "" {
+		mess = append(mess, config.AssistantPrefix)
+	}
 
-		if config.TemplateConfig.Chat != "" {
-			templateFile = config.TemplateConfig.Chat
-		}
+	return PromptTemplateData{
+		Input:           strings.Join(mess, "\n"),
+		Messages:        messages,
+		SystemPrompt:    strings.Join(system, "\n"),
+		AssistantPrefix: config.AssistantPrefix,
+	}
+}
 
-		// A model can have a "file.bin.tmpl" file associated with a prompt template prefix
-		templatedInput, err := loader.TemplatePrefix(templateFile, struct {
-			Input string
-		}{Input: predInput})
-		if err == nil {
-			predInput = templatedInput
-			log.Debug().Msgf("Template found, input modified to: %s", predInput)
+func hasSystemMessage(messages []Message) bool {
+	for _, m := range messages {
+		if m.Role == "system" {
+			return true
 		}
+	}
+	return false
+}
 
-		if input.Stream {
-			responses := make(chan OpenAIResponse)
-
-			go func() {
-				ComputeChoices(predInput, input, config, loader, func(s string, c *[]Choice) {}, func(s string) bool {
-					resp := OpenAIResponse{
-						Model:   input.Model, // we have to return what the user sent here, due to OpenAI spec.
-						Choices: []Choice{{Delta: &Message{Role: "assistant", Content: s}}},
-						Object:  "chat.completion.chunk",
-					}
-
-					responses <- resp
-					return true
-				})
-				close(responses)
-			}()
-
-			c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
-
-				for ev := range responses {
-					var buf bytes.Buffer
-					enc := json.NewEncoder(&buf)
-					enc.Encode(ev)
-
-					fmt.Fprintf(w, "event: data\n\n")
-					fmt.Fprintf(w, "data: %v\n\n", buf.String())
-					log.Debug().Msgf("Sending chunk: %s", buf.String())
-					w.Flush()
-				}
+// streamPrediction streams the tokens of the prediction of predInput as
+// server-sent events built by chunk, then the last event of the choice built
+// from its finish reason, and the [DONE] marker. The n choices of the request
+// are streamed one after the other, their chunks told apart by their index.
+func streamPrediction(c *fiber.Ctx, o *Option, config *Config, input *OpenAIRequest, predInput string, chunk func(index int, token string) OpenAIResponse, last func(index int, finishReason string) OpenAIResponse) error {
+	configLogger(config).Debug().Msgf("Stream request received")
+
+	// the prediction is cancelled by the stream writer when it returns,
+	// e.g. when the client went away, so it stops producing tokens
+	ctx, cancel := predictionContext(c, config, o)
+
+	// the slot is released once the prediction stops
+	done, err := o.limiter.acquire(ctx)
+	if err != nil {
+		cancel()
+		return predictionError(err)
+	}
 
-				w.WriteString("event: data\n\n")
-				resp := &OpenAIResponse{
-					Model:   input.Model, // we have to return what the user sent here, due to OpenAI spec.
-					Choices: []Choice{{FinishReason: "stop"}},
+	c.Context().SetContentType("text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("Transfer-Encoding", "chunked")
+
+	n := input.N
+	if n == 0 {
+		n = 1
+	}
+	choice := *input
+	choice.N = 1
+
+	responses := streamTokens(ctx, func(send func(OpenAIResponse) bool) {
+		defer done()
+
+		var tokenUsage TokenUsage
+		var finish OpenAIResponse
+		for i := 0; i < n; i++ {
+			result, u, err := ComputeChoices(ctx, predInput, &choice, config, o.loader, func(s string, c *[]Choice) {
+				*c = append(*c, Choice{})
+			}, func(token string) bool {
+				return send(chunk(i, token))
+			})
+			if err != nil {
+				configLogger(config).Error().Msgf("Stream inference failed: %s", err.Error())
+			}
+			tokenUsage.add(u)
+
+			finishReason := "stop"
+			if len(result) > 0 {
+				finishReason = result[0].FinishReason
+			}
+			finish = last(i, finishReason)
+			if i == n-1 && input.Timings {
+				finish.Timings = timings(tokenUsage)
+			}
+			if !send(finish) {
+				return
+			}
+		}
+
+		if config.StreamUsage || (input.StreamOptions != nil && input.StreamOptions.IncludeUsage) {
+			// the usage chunk follows the last one, whose id and
+			// model it shares
+			u := finish
+			u.Choices = []Choice{}
+			u.Usage = usage(tokenUsage)
+			send(u)
+		}
+	})
+
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+
+		if err := writeStream(w, config, responses, o.streamKeepalive); err != nil {
+			configLogger(config).Debug().Msgf("Client disconnected, stopping stream: %s", err.Error())
+		}
+	}))
+	return nil
+}
+
+// streamTokens runs stream in the background, and returns the channel of the
+// chunks it sends, closed once stream returns. The channel is unbuffered, so
+// a slow client slows the prediction down rather than having the tokens pile
+// up in memory. Once ctx is cancelled send returns false, which stops the
+// backends supporting it when returned by their token callback, and the
+// remaining chunks are dropped.
+func streamTokens(ctx context.Context, stream func(send func(OpenAIResponse) bool)) <-chan OpenAIResponse {
+	responses := make(chan OpenAIResponse)
+	go func() {
+		defer close(responses)
+		stream(func(resp OpenAIResponse) bool {
+			select {
+			case responses <- resp:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return responses
+}
+
+// writeStream writes the responses as server-sent events, followed by
+// [DONE]. It stops at the first chunk which can't be written, e.g. when the
+// client went away, returning the error. The chunks with empty, rather than
+// nil, choices, like the usage one, are written with an empty choices array.
+// Until the first chunk, a ": ping" comment, which the clients ignore, is
+// written every keepalive, if positive, so the proxies don't time out the
+// idle connection.
+func writeStream(w *bufio.Writer, config *Config, responses <-chan OpenAIResponse, keepalive time.Duration) error {
+	var ping <-chan time.Time
+	if keepalive > 0 {
+		ticker := time.NewTicker(keepalive)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		var ev OpenAIResponse
+		var ok bool
+		select {
+		case ev, ok = <-responses:
+		case <-ping:
+			w.WriteString(": ping\n\n")
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		if !ok {
+			break
+		}
+		ping = nil
+
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		if ev.Choices != nil && len(ev.Choices) == 0 {
+			enc.Encode(struct {
+				OpenAIResponse
+				Choices []Choice `json:"choices"`
+			}{ev, ev.Choices})
+		} else {
+			enc.Encode(ev)
+		}
+
+		debugLog(config).Msgf("Sending chunk: %s", buf.String())
+		fmt.Fprintf(w, "data: %v\n", buf.String())
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	w.WriteString("data: [DONE]\n\n")
+	return w.Flush()
+}
+
+// templateInput renders the template the config names, or else the template of
+// its model file, with in. The input is used as is when there is no template.
+// When the template the config names is missing, or a template fails to
+// render, the input is used as is with a warning, unless the template config
+// is strict, which returns an error instead.
+//
+// The inline template of the request, if any, is rendered instead, failing
+// the request when it doesn't render.
+func templateInput(loader *model.ModelLoader, config *Config, name, input string, in interface{}) (string, error) {
+	if config.Template != "" {
+		templatedInput, err := loader.EvaluateTemplate(config.Template, in)
+		if err != nil {
+			return "", invalidParam("template", "cannot use the template of the request: %s", err.Error())
+		}
+		debugLog(config).Msgf("Inline template rendered, input modified to: %s", templatedInput)
+		return templatedInput, nil
+	}
+
+	templateFile := config.Model
+	if name != "" {
+		templateFile = name
+	}
+
+	// A model can have a "file.bin.tmpl" file associated with a prompt template prefix
+	templatedInput, err := loader.TemplatePrefixIn(config.dir, templateFile, in)
+	switch {
+	case err == nil:
+		debugLog(config).Msgf("Template found, input modified to: %s", templatedInput)
+		return templatedInput, nil
+	case errors.Is(err, model.ErrNoTemplate) && name == "":
+		return input, nil
+	}
+
+	err = fmt.Errorf("cannot use the template %s of model %s: %w", templateFile, config.Name, err)
+	if config.TemplateConfig.Strict {
+		return "", err
+	}
+	configLogger(config).Warn().Msgf("%s, using the input as is", err.Error())
+	return input, nil
+}
+
+// truncatedHeader is set to true on the responses whose prompt didn't fit in
+// the context of the model, and truncatedTokensHeader to the number of its
+// tokens which were dropped, or which the backend had to drop.
+const (
+	truncatedHeader       = "X-Prompt-Truncated"
+	truncatedTokensHeader = "X-Prompt-Truncated-Tokens"
+)
+
+// setTruncated tells the client in the truncated headers when its prompt
+// didn't fit in the context, see Config.truncated
+func setTruncated(c *fiber.Ctx, config *Config) {
+	if config.truncated <= 0 {
+		return
+	}
+	c.Set(truncatedHeader, "true")
+	c.Set(truncatedTokensHeader, strconv.Itoa(config.truncated))
+}
+
+// promptTokens counts the tokens of the prompt with the tokenizer of the
+// model, or estimates them when the model can't tokenize it, which estimated
+// tells. Only rwkv exposes its tokenizer. The model isn't loaded to count
+// them, see ModelTokenize.
+func promptTokens(loader *model.ModelLoader, config *Config, prompt string) (count int, estimated bool) {
+	tokens, count, err := ModelTokenize(prompt, loader, *config)
+	if err != nil {
+		debugLog(config).Msgf("Cannot tokenize the prompt, estimating its tokens: %s", err.Error())
+		return estimateTokens(prompt), true
+	}
+	return count, tokens == nil
+}
+
+// about qualifies the number of tokens which were estimated, see promptTokens
+func about(estimated bool) string {
+	if estimated {
+		return "about "
+	}
+	return ""
+}
+
+// dryRun replies with the prompts rendered with the template name, or the
+// default template of the model, for the requests with dry_run
+func dryRun(c *fiber.Ctx, loader *model.ModelLoader, config *Config, input *OpenAIRequest, name string, prompts ...string) error {
+	resp := DryRunResponse{
+		Object:        "dry_run",
+		Model:         input.Model,
+		Prompts:       prompts,
+		Template:      "inline",
+		TemplateFound: true,
+	}
+	if config.Template == "" {
+		resp.Template = name
+		if name == "" {
+			resp.Template = config.Model
+		}
+		resp.TemplateFile, resp.TemplateFound = config.templateFile(loader.ModelPath, resp.Template)
+	}
+	return c.JSON(resp)
+}
+
+// checkPromptTokens rejects the prompts longer than the server allows, see
+// WithMaxPromptTokens, naming param. The limit applies to the estimated
+// tokens of the models which don't expose their tokenizer as well.
+func checkPromptTokens(o *Option, param string, tokens int, estimated bool) error {
+	if o.maxPromptTokens > 0 && tokens > o.maxPromptTokens {
+		return invalidParam(param, "the prompt is %s%d tokens long, over the limit of %d tokens", about(estimated), tokens, o.maxPromptTokens)
+	}
+	return nil
+}
+
+// promptOverflow returns the number of tokens of a prompt which don't fit in
+// the context, where room is left for at least one token to be predicted.
+func promptOverflow(config *Config, tokens int) int {
+	if config.ContextSize <= 0 || tokens < config.ContextSize {
+		return 0
+	}
+	return tokens - config.ContextSize + 1
+}
+
+// chatPrompt returns the prompt of the messages, templated for the model.
+// When it doesn't fit in the context, the truncate policy of the config
+// applies: "oldest" drops the oldest messages, but the system ones and the
+// last one, until it fits, and "none" returns an error. Without a policy the
+// prompt is left as is. The tokens which were dropped, or which still don't
+// fit, are counted in config.truncated. They are estimated for the models
+// which don't expose their tokenizer, see promptTokens.
+func chatPrompt(loader *model.ModelLoader, config *Config, messages []Message) (string, error) {
+	first := -1
+	for {
+		templateData := chatTemplateData(config, messages)
+		predInput, err := templateInput(loader, config, config.TemplateConfig.Chat, templateData.Input, templateData)
+		if err != nil {
+			return "", err
+		}
+
+		tokens, estimated := promptTokens(loader, config, predInput)
+		if first < 0 {
+			first = tokens
+		}
+		overflow := promptOverflow(config, tokens)
+		if config.Truncate == "" || overflow == 0 {
+			config.truncated = first - tokens + overflow
+			return predInput, nil
+		}
+
+		if config.Truncate == "oldest" {
+			if i := oldestMessage(messages); i >= 0 {
+				debugLog(config).Msgf("Prompt of %d tokens exceeding the context, dropping message %d", tokens, i)
+				// the messages of the request are left untouched
+				messages = append(messages[:i:i], messages[i+1:]...)
+				continue
+			}
+		}
+		return "", fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("the prompt is %s%d tokens long, exceeding the context size of %d tokens", about(estimated), tokens, config.ContextSize))
+	}
+}
+
+// oldestMessage returns the index of the oldest message which can be dropped,
+// neither a system message nor the last one, or -1 if there is none.
+func oldestMessage(messages []Message) int {
+	if len(messages) == 0 {
+		return -1
+	}
+	for i, m := range messages[:len(messages)-1] {
+		if m.Role != "system" {
+			return i
+		}
+	}
+	return -1
+}
+
+func chatEndpoint(cm *ConfigMerger, o *Option) func(c *fiber.Ctx) error {
+	loader := o.loader
+	return func(c *fiber.Ctx) error {
+		config, input, err := readConfig(cm, c, o)
+		if err != nil {
+			return fmt.Errorf("failed reading parameters from request:%w", err)
+		}
+
+		debugLog(config).Msgf("Parameter Config: %+v", config)
+
+		predInput, err := chatPrompt(loader, config, input.Messages)
+		if err != nil {
+			return err
+		}
+		if o.maxPromptTokens > 0 {
+			tokens, estimated := promptTokens(loader, config, predInput)
+			if err := checkPromptTokens(o, "messages", tokens, estimated); err != nil {
+				return err
+			}
+		}
+		setTruncated(c, config)
+
+		if input.DryRun {
+			return dryRun(c, loader, config, input, config.TemplateConfig.Chat, predInput)
+		}
+
+		// the chunks of a streamed response share the same id
+		id := newResponseID("chatcmpl-")
+		created := int(time.Now().Unix())
+
+		if input.Stream {
+			return streamPrediction(c, o, config, input, predInput, func(index int, token string) OpenAIResponse {
+				return OpenAIResponse{
+					ID:      id,
+					Created: created,
+					Model:   input.Model, // we have to return what the user sent here, due to OpenAI spec.
+					Choices: []Choice{{Index: index, Delta: &Message{Role: "assistant", Content: token}}},
+					Object:  "chat.completion.chunk",
 				}
-				respData, _ := json.Marshal(resp)
+			}, func(index int, finishReason string) OpenAIResponse {
+				return OpenAIResponse{
+					ID:      id,
+					Created: created,
+					Model:   input.Model, // we have to return what the user sent here, due to OpenAI spec.
+					Choices: []Choice{{Index: index, Delta: &Message{}, FinishReason: finishReason}},
+					Object:  "chat.completion.chunk",
+				}
+			})
+		}
 
-				w.WriteString(fmt.Sprintf("data: %s\n\n", respData))
-				w.Flush()
-			}))
-			return nil
+		cacheKey := responseCacheKey(c, o, config, input, predInput)
+		if resp, cached := o.responseCache.get(c, cacheKey); cached {
+			return c.JSON(resp)
 		}
 
-		result, err := ComputeChoices(predInput, input, config, loader, func(s string, c *[]Choice) {
-			*c = append(*c, Choice{Message: &Message{Role: "assistant", Content: s}})
+		ctx, cancel := predictionContext(c, config, o)
+		defer cancel()
+
+		done, err := o.limiter.acquire(ctx)
+		if err != nil {
+			return predictionError(err)
+		}
+		defer done()
+
+		result, tokenUsage, err := ComputeChoices(ctx, predInput, input, config, loader, func(s string, c *[]Choice) {
+			*c = append(*c, Choice{Index: len(*c), Message: &Message{Role: "assistant", Content: s}})
 		}, nil)
 		if err != nil {
-			return err
+			return predictionError(err)
 		}
 
+		c.Locals(usageLocal, tokenUsage)
+
 		resp := &OpenAIResponse{
+			ID:      id,
+			Created: created,
 			Model:   input.Model, // we have to return what the user sent here, due to OpenAI spec.
 			Choices: result,
 			Object:  "chat.completion",
+			Usage:   usage(tokenUsage),
 		}
+		if input.Timings {
+			resp.Timings = timings(tokenUsage)
+		}
+		o.responseCache.add(cacheKey, *resp)
 
 		// Return the prediction in the response body
 		return c.JSON(resp)
 	}
 }
 
-func editEndpoint(cm ConfigMerger, debug bool, loader *model.ModelLoader, threads, ctx int, f16 bool) func(c *fiber.Ctx) error {
+func editEndpoint(cm *ConfigMerger, o *Option) func(c *fiber.Ctx) error {
+	loader := o.loader
 	return func(c *fiber.Ctx) error {
-		config, input, err := readConfig(cm, c, loader, debug, threads, ctx, f16)
+		config, input, err := readConfig(cm, c, o)
 		if err != nil {
 			return fmt.Errorf("failed reading parameters from request:%w", err)
 		}
 
-		log.Debug().Msgf("Parameter Config: %+v", config)
+		debugLog(config).Msgf("Parameter Config: %+v", config)
 
-		predInput := input.Input
-		templateFile := config.Model
+		if len(config.InputStrings) == 0 {
+			return invalidParam("input", "an input to edit is required")
+		}
 
-		if config.TemplateConfig.Edit != "" {
-			templateFile = config.TemplateConfig.Edit
+		prompts := []string{}
+		for _, i := range config.InputStrings {
+			prompt, err := templateInput(loader, config, config.TemplateConfig.Edit, i, PromptTemplateData{
+				Input:       i,
+				Instruction: input.Instruction,
+			})
+			if err != nil {
+				return err
+			}
+			prompts = append(prompts, prompt)
 		}
 
-		// A model can have a "file.bin.tmpl" file associated with a prompt template prefix
-		templatedInput, err := loader.TemplatePrefix(templateFile, struct {
-			Input       string
-			Instruction string
-		}{Input: predInput, Instruction: input.Instruction})
-		if err == nil {
-			predInput = templatedInput
-			log.Debug().Msgf("Template found, input modified to: %s", predInput)
+		if input.DryRun {
+			return dryRun(c, loader, config, input, config.TemplateConfig.Edit, prompts...)
 		}
 
-		result, err := ComputeChoices(predInput, input, config, loader, func(s string, c *[]Choice) {
-			*c = append(*c, Choice{Text: s})
-		}, nil)
+		cacheKey := responseCacheKey(c, o, config, input, prompts...)
+		if resp, cached := o.responseCache.get(c, cacheKey); cached {
+			return c.JSON(resp)
+		}
+
+		ctx, cancel := predictionContext(c, config, o)
+		defer cancel()
+
+		done, err := o.limiter.acquire(ctx)
 		if err != nil {
-			return err
+			return predictionError(err)
+		}
+		defer done()
+
+		var result []Choice
+		totalTokenUsage := TokenUsage{}
+		for _, prompt := range prompts {
+			r, tokenUsage, err := ComputeChoices(ctx, prompt, input, config, loader, func(s string, c *[]Choice) {
+				*c = append(*c, Choice{Text: s})
+			}, nil)
+			if err != nil {
+				return predictionError(err)
+			}
+
+			totalTokenUsage.add(tokenUsage)
+
+			result = append(result, r...)
 		}
 
+		for i := range result {
+			result[i].Index = i
+		}
+
+		c.Locals(usageLocal, totalTokenUsage)
+
 		resp := &OpenAIResponse{
+			Created: int(time.Now().Unix()),
 			Model:   input.Model, // we have to return what the user sent here, due to OpenAI spec.
 			Choices: result,
 			Object:  "edit",
+			Usage:   usage(totalTokenUsage),
 		}
+		if input.Timings {
+			resp.Timings = timings(totalTokenUsage)
+		}
+		o.responseCache.add(cacheKey, *resp)
 
-		jsonResult, _ := json.Marshal(resp)
-		log.Debug().Msgf("Response: %s", jsonResult)
+		if debug := debugLog(config); debug.Enabled() {
+			jsonResult, _ := json.Marshal(resp)
+			debug.Msgf("Response: %s", jsonResult)
+		}
 
 		// Return the prediction in the response body
 		return c.JSON(resp)
 	}
 }
 
-func listModels(loader *model.ModelLoader, cm ConfigMerger) func(ctx *fiber.Ctx) error {
+// https://platform.openai.com/docs/api-reference/embeddings
+func embeddingsEndpoint(cm *ConfigMerger, o *Option) func(c *fiber.Ctx) error {
+	loader := o.loader
+	return func(c *fiber.Ctx) error {
+		config, input, err := readConfig(cm, c, o)
+		if err != nil {
+			return fmt.Errorf("failed reading parameters from request:%w", err)
+		}
+
+		debugLog(config).Msgf("Parameter Config: %+v", config)
+
+		if len(config.InputStrings) == 0 {
+			return invalidParam("input", "an input to embed is required")
+		}
+
+		ctx, cancel := predictionContext(c, config, o)
+		defer cancel()
+
+		done, err := o.limiter.acquire(ctx)
+		if err != nil {
+			return predictionError(err)
+		}
+		defer done()
+
+		items := []Item{}
+		tokenUsage := TokenUsage{}
+		for i, s := range config.InputStrings {
+			embedding, tokens, err := ModelEmbedding(ctx, s, loader, *config)
+			if err != nil {
+				return predictionError(err)
+			}
+			tokenUsage.Prompt += tokens
+			items = append(items, Item{Embedding: embedding, Index: i, Object: "embedding"})
+		}
+
+		c.Locals(usageLocal, tokenUsage)
+
+		resp := &OpenAIResponse{
+			Model:  input.Model, // we have to return what the user sent here, due to OpenAI spec.
+			Data:   items,
+			Object: "list",
+			Usage:  usage(tokenUsage),
+		}
+
+		// Return the embeddings in the response body
+		return c.JSON(resp)
+	}
+}
+
+// https://platform.openai.com/docs/api-reference/audio/create
+func transcriptEndpoint(cm *ConfigMerger, o *Option) func(c *fiber.Ctx) error {
+	return audioEndpoint(cm, o, "transcribe")
+}
+
+// https://platform.openai.com/docs/api-reference/audio/create-translation
+func translationEndpoint(cm *ConfigMerger, o *Option) func(c *fiber.Ctx) error {
+	return audioEndpoint(cm, o, "translate")
+}
+
+// audioEndpoint runs the task, transcribe or translate, on the audio file of
+// the request. Translations are always in English, so they take no language.
+//
+// The task runs under the request timeout and is cancelled with the request,
+// as the predictions are, see predictionContext. whisper can't be interrupted
+// while it processes the audio though, so the request returns as soon as it
+// is cancelled, while the audio is still processed in the background, the
+// model and the slot of the request being held until it is.
+func audioEndpoint(cm *ConfigMerger, o *Option, task string) func(c *fiber.Ctx) error {
+	loader := o.loader
+	return func(c *fiber.Ctx) error {
+		config, _, err := readConfig(cm, c, o)
+		if err != nil {
+			return fmt.Errorf("failed reading parameters from request:%w", err)
+		}
+
+		responseFormat := c.FormValue("response_format", "json")
+		switch responseFormat {
+		case "json", "verbose_json", "text":
+		default:
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("unsupported response_format: %s", responseFormat))
+		}
+
+		// retrieve the file data from the request
+		file, err := c.FormFile("file")
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("failed reading the audio file from request: %s", err.Error()))
+		}
+
+		ctx, cancel := predictionContext(c, config, o)
+		defer cancel()
+
+		// Keep the model loaded while serving the request
+		release := loader.Use(config.Model)
+
+		done, err := o.limiter.acquire(ctx)
+		if err != nil {
+			release()
+			return predictionError(err)
+		}
+
+		// the resources of the task are released once it stops, which
+		// can be after the request is cancelled
+		cleanup := func(dir string) {
+			if dir != "" {
+				os.RemoveAll(dir)
+			}
+			done()
+			release()
+		}
+
+		dir, err := os.MkdirTemp("", "whisper")
+		if err != nil {
+			cleanup("")
+			return err
+		}
+
+		dst := filepath.Join(dir, filepath.Base(file.Filename))
+		if err := c.SaveFile(file, dst); err != nil {
+			cleanup(dir)
+			return err
+		}
+
+		configLogger(config).Debug().Msgf("Audio file copied to: %+v", dst)
+
+		whisperModel, err := loader.LoadWhisperModel(config.Model)
+		if err != nil {
+			cleanup(dir)
+			return err
+		}
+
+		translate := task == "translate"
+		language := c.FormValue("language")
+		if translate {
+			language = ""
+		}
+
+		type transcription struct {
+			result whisper.Result
+			err    error
+		}
+		transcribed := make(chan transcription, 1)
+		go func() {
+			defer cleanup(dir)
+
+			l := loader.PredictionLock(config.Model)
+			l.Lock()
+			defer l.Unlock()
+
+			tr, err := whisper.Transcript(ctx, whisperModel, dst, language, translate, uint(config.Threads))
+			transcribed <- transcription{result: tr, err: err}
+		}()
+
+		var tr whisper.Result
+		select {
+		case t := <-transcribed:
+			if t.err != nil {
+				return predictionError(t.err)
+			}
+			tr = t.result
+		case <-ctx.Done():
+			return predictionError(ctx.Err())
+		}
+
+		debugLog(config).Msgf("Transcribed: %+v", tr)
+
+		switch responseFormat {
+		case "text":
+			return c.SendString(tr.Text)
+		case "verbose_json":
+			return c.JSON(struct {
+				Task string `json:"task"`
+				whisper.Result
+			}{Task: task, Result: tr})
+		default:
+			return c.JSON(fiber.Map{"text": tr.Text})
+		}
+	}
+}
+
+// tokenizeEndpoint returns the tokens of the content for the model. Only rwkv
+// exposes its tokenizer, the other backends reply with a 501 rather than an
+// estimate.
+func tokenizeEndpoint(cm *ConfigMerger, o *Option) func(c *fiber.Ctx) error {
+	loader := o.loader
+	return func(c *fiber.Ctx) error {
+		config, input, err := readConfig(cm, c, o)
+		if err != nil {
+			return fmt.Errorf("failed reading parameters from request:%w", err)
+		}
+
+		tokenizer, err := modelTokenizer(loader, *config)
+		if err != nil {
+			return err
+		}
+		if tokenizer == nil {
+			return fiber.NewError(fiber.StatusNotImplemented, fmt.Sprintf("the backend of model %s does not expose its tokenizer, only rwkv does", input.Model))
+		}
+
+		tokens, count, err := ModelTokenize(input.Content, loader, *config)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(TokenizeResponse{
+			Tokens: tokens,
+			Count:  count,
+		})
+	}
+}
+
+// loadConfigEndpoint adds or replaces the configs sent in the body, a config
+// or a list of configs in YAML, or JSON when sent as such. Nothing is loaded
+// unless all of them are valid.
+func loadConfigEndpoint(cm *ConfigMerger, o *Option) func(ctx *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		isJSON := strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON)
+		configs, err := cm.readConfigs(c.Body(), isJSON, o.loader.ModelPath)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("invalid config: %s", err.Error()))
+		}
+		for _, cc := range configs {
+			if err := cc.Validate(o.loader.ModelPath); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+		}
+
+		names := []string{}
+		cm.Lock()
+		for _, cc := range configs {
+			cm.set(cc.Name, *cc)
+			names = append(names, cc.Name)
+		}
+		cm.Unlock()
+
+		requestLogger(c).Info().Msgf("loaded configs %s", strings.Join(names, ", "))
+
+		return c.JSON(struct {
+			Models []string `json:"models"`
+		}{
+			Models: names,
+		})
+	}
+}
+
+// reloadConfigEndpoint reads the config of a single model again from its file,
+// leaving the other configs untouched.
+func reloadConfigEndpoint(cm *ConfigMerger, o *Option) func(ctx *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		config, err := cm.ReloadConfig(c.Params("model"), o.loader.ModelPath)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return fiber.NewError(fiber.StatusNotFound, err.Error())
+		case err != nil:
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("invalid config: %s", err.Error()))
+		}
+
+		requestLogger(c).Info().Msgf("reloaded config %s from %s", config.Name, config.file)
+
+		return c.JSON(struct {
+			Models []string `json:"models"`
+		}{
+			Models: []string{config.Name},
+		})
+	}
+}
+
+func listModels(loader *model.ModelLoader, cm *ConfigMerger) func(ctx *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		models, err := loader.ListModels()
 		if err != nil {
@@ -463,15 +1802,40 @@ func listModels(loader *model.ModelLoader, cm ConfigMerger) func(ctx *fiber.Ctx)
 		}
 		var mm map[string]interface{} = map[string]interface{}{}
 
+		// the files named as a disabled config, or one of its aliases, are
+		// the disabled model too
+		for _, k := range cm.List() {
+			if cfg, _ := cm.Get(k); cfg.disabled() {
+				mm[k] = nil
+				for _, alias := range cfg.Aliases {
+					mm[alias] = nil
+				}
+			}
+		}
+
 		dataModels := []OpenAIModel{}
 		for _, m := range models {
+			if _, exists := mm[m]; exists {
+				continue
+			}
 			mm[m] = nil
 			dataModels = append(dataModels, OpenAIModel{ID: m, Object: "model"})
 		}
 
-		for k := range cm {
+		for _, k := range cm.List() {
+			cfg, _ := cm.Get(k)
+			if cfg.disabled() {
+				continue
+			}
 			if _, exists := mm[k]; !exists {
 				dataModels = append(dataModels, OpenAIModel{ID: k, Object: "model"})
+				mm[k] = nil
+			}
+			for _, alias := range cfg.Aliases {
+				if _, exists := mm[alias]; !exists {
+					dataModels = append(dataModels, OpenAIModel{ID: alias, Object: "model"})
+					mm[alias] = nil
+				}
 			}
 		}
 
@@ -484,3 +1848,111 @@ func listModels(loader *model.ModelLoader, cm ConfigMerger) func(ctx *fiber.Ctx)
 		})
 	}
 }
+
+// ModelInfo describes a model along its config, for the /models/info endpoint
+type ModelInfo struct {
+	ID          string         `json:"id"`
+	Model       string         `json:"model"`
+	Backend     string         `json:"backend,omitempty"`
+	Aliases     []string       `json:"aliases,omitempty"`
+	ContextSize int            `json:"context_size"`
+	Threads     int            `json:"threads"`
+	StopWords   []string       `json:"stopwords,omitempty"`
+	Template    TemplateConfig `json:"template"`
+	Configured  bool           `json:"configured"`
+	Disabled    bool           `json:"disabled,omitempty"`
+	Loaded      bool           `json:"loaded"`
+}
+
+// listModelsInfo lists the model configs, then the models in the models path
+// without a config, with their settings and whether they are in memory. It
+// is not part of the OpenAI API.
+func listModelsInfo(loader *model.ModelLoader, cm *ConfigMerger, o *Option) func(ctx *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		models, err := loader.ListModels()
+		if err != nil {
+			return err
+		}
+
+		info := []ModelInfo{}
+		configured := map[string]bool{}
+		for _, name := range cm.List() {
+			cfg, _ := cm.Get(name)
+			configured[cfg.Model] = true
+
+			i := ModelInfo{
+				ID:          name,
+				Model:       cfg.Model,
+				Backend:     cfg.Backend,
+				Aliases:     cfg.Aliases,
+				ContextSize: cfg.ContextSize,
+				Threads:     cfg.Threads,
+				StopWords:   cfg.StopWords,
+				Template:    cfg.TemplateConfig,
+				Configured:  true,
+				Disabled:    cfg.disabled(),
+				Loaded:      loader.IsLoaded(cfg.Model),
+			}
+			// the command line settings apply to the configs which don't set them
+			if i.ContextSize == 0 {
+				i.ContextSize = o.ctxSize
+			}
+			if i.Threads == 0 {
+				i.Threads = o.threads
+			}
+			info = append(info, i)
+		}
+
+		for _, m := range models {
+			if configured[m] {
+				continue
+			}
+			info = append(info, ModelInfo{
+				ID:          m,
+				Model:       m,
+				ContextSize: o.ctxSize,
+				Threads:     o.threads,
+				Loaded:      loader.IsLoaded(m),
+			})
+		}
+
+		return c.JSON(fiber.Map{"data": info})
+	}
+}
+
+// https://platform.openai.com/docs/api-reference/models/retrieve
+func getModel(loader *model.ModelLoader, cm *ConfigMerger) func(ctx *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		id := c.Params("model")
+
+		// the model can be either a file in the model path or a model config
+		modelFile := ""
+		if cfg, exists := cm.Get(id); exists {
+			if cfg.disabled() {
+				return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("The model '%s' is disabled", id))
+			}
+			modelFile = cfg.Model
+		} else {
+			models, err := loader.ListModels()
+			if err != nil {
+				return err
+			}
+			for _, m := range models {
+				if m == id {
+					modelFile = m
+					break
+				}
+			}
+			if modelFile == "" {
+				return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("The model '%s' does not exist", id))
+			}
+		}
+
+		m := OpenAIModel{ID: id, Object: "model", OwnedBy: "local"}
+		if info, err := os.Stat(filepath.Join(loader.ModelPath, modelFile)); err == nil {
+			m.Created = info.ModTime().Unix()
+		}
+
+		return c.JSON(m)
+	}
+}
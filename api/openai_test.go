@@ -0,0 +1,1287 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("OpenAI request parsing", func() {
+	Context("bearer token", func() {
+		It("extracts the model name from the header", func() {
+			Expect(bearerToken("Bearer ggml-model")).To(Equal("ggml-model"))
+		})
+		It("does not strip characters of the token", func() {
+			Expect(bearerToken("Bearer Barbelith")).To(Equal("Barbelith"))
+		})
+		It("trims surrounding whitespace", func() {
+			Expect(bearerToken("  Bearer  ggml-model \t")).To(Equal("ggml-model"))
+		})
+		It("returns an empty token if the header is not set", func() {
+			Expect(bearerToken("")).To(BeEmpty())
+		})
+	})
+
+	Context("responses", func() {
+		It("marshals the object type under the object key", func() {
+			for _, object := range []string{"text_completion", "chat.completion", "chat.completion.chunk", "edit"} {
+				data, err := json.Marshal(OpenAIResponse{Object: object})
+				Expect(err).ToNot(HaveOccurred())
+
+				res := map[string]interface{}{}
+				Expect(json.Unmarshal(data, &res)).To(Succeed())
+				Expect(res).To(HaveKeyWithValue("object", object))
+				Expect(res).ToNot(HaveKey("chat.completion"))
+			}
+		})
+	})
+
+	Context("response ids", func() {
+		It("are unique and prefixed", func() {
+			id := newResponseID("chatcmpl-")
+			Expect(id).To(HavePrefix("chatcmpl-"))
+			Expect(id).ToNot(Equal(newResponseID("chatcmpl-")))
+		})
+	})
+
+	Context("message content", func() {
+		It("accepts a string", func() {
+			m := Message{}
+			Expect(json.Unmarshal([]byte(`{"role":"user","content":"Hi"}`), &m)).To(Succeed())
+			Expect(m).To(Equal(Message{Role: "user", Content: "Hi"}))
+
+			Expect(json.Unmarshal([]byte(`{"role":"assistant","content":null}`), &m)).To(Succeed())
+			Expect(m).To(Equal(Message{Role: "assistant"}))
+		})
+		It("accepts an array of text parts", func() {
+			m := Message{}
+			Expect(json.Unmarshal([]byte(`{"role":"user","content":[
+				{"type":"text","text":"What's in"},
+				{"type":"text","text":"this text?"}
+			]}`), &m)).To(Succeed())
+			Expect(m.Content).To(Equal("What's in\nthis text?"))
+		})
+		It("rejects the other parts", func() {
+			m := Message{}
+			Expect(json.Unmarshal([]byte(`{"role":"user","content":[{"type":"audio"}]}`), &m)).To(MatchError(ContainSubstring(`unsupported content part type "audio"`)))
+			Expect(json.Unmarshal([]byte(`{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/cat.png"}}]}`), &m)).To(MatchError(ContainSubstring("image_url content parts are unsupported")))
+			Expect(json.Unmarshal([]byte(`{"role":"user","content":3}`), &m)).ToNot(Succeed())
+		})
+		It("is marshalled as text", func() {
+			data, err := json.Marshal(Message{Role: "assistant", Content: "Hi"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal(`{"role":"assistant","content":"Hi"}`))
+		})
+	})
+
+	Context("stop parameter", func() {
+		It("accepts a single string", func() {
+			input := &OpenAIRequest{}
+			Expect(json.Unmarshal([]byte(`{"stop":"\n"}`), input)).To(Succeed())
+			Expect(input.Stop).To(Equal(StringList{"\n"}))
+
+			config := &Config{StopWords: []string{"HUMAN:"}}
+			updateConfig(config, input)
+			Expect(config.StopWords).To(Equal([]string{"HUMAN:", "\n"}))
+		})
+		It("accepts an array of strings", func() {
+			input := &OpenAIRequest{}
+			Expect(json.Unmarshal([]byte(`{"stop":["\n","User:"]}`), input)).To(Succeed())
+			Expect(input.Stop).To(Equal(StringList{"\n", "User:"}))
+
+			config := &Config{}
+			updateConfig(config, input)
+			Expect(config.StopWords).To(Equal([]string{"\n", "User:"}))
+		})
+		It("is merged with the config stopwords without changing them", func() {
+			stops := make([]string, 1, 4)
+			stops[0] = "HUMAN:"
+			config := &Config{StopWords: stops}
+			updateConfig(config, &OpenAIRequest{Stop: StringList{"\n", "HUMAN:"}})
+			Expect(config.StopWords).To(Equal([]string{"HUMAN:", "\n"}))
+
+			other := &Config{StopWords: stops}
+			updateConfig(other, &OpenAIRequest{Stop: StringList{"User:"}})
+			Expect(other.StopWords).To(Equal([]string{"HUMAN:", "User:"}))
+			Expect(config.StopWords).To(Equal([]string{"HUMAN:", "\n"}))
+			Expect(stops[:cap(stops)][1]).To(BeEmpty())
+		})
+		It("replaces the config stopwords with replace_stopwords", func() {
+			config := &Config{StopWords: []string{"HUMAN:"}, ReplaceStopWords: true}
+			updateConfig(config, &OpenAIRequest{Stop: StringList{"User:"}})
+			Expect(config.StopWords).To(Equal([]string{"User:"}))
+
+			config = &Config{StopWords: []string{"HUMAN:"}, ReplaceStopWords: true}
+			updateConfig(config, &OpenAIRequest{})
+			Expect(config.StopWords).To(Equal([]string{"HUMAN:"}))
+		})
+		It("accepts null", func() {
+			input := &OpenAIRequest{}
+			Expect(json.Unmarshal([]byte(`{"stop":null}`), input)).To(Succeed())
+			Expect(input.Stop).To(BeEmpty())
+		})
+		It("rejects other types", func() {
+			input := &OpenAIRequest{}
+			Expect(json.Unmarshal([]byte(`{"stop":3}`), input)).ToNot(Succeed())
+		})
+		It("can be set in YAML as a string or a list", func() {
+			config := &Config{}
+			Expect(yaml.Unmarshal([]byte("parameters:\n  stop: \"User:\"\n"), config)).To(Succeed())
+			Expect(config.Stop).To(Equal(StringList{"User:"}))
+			Expect(yaml.Unmarshal([]byte("parameters:\n  stop:\n  - a\n  - b\n"), config)).To(Succeed())
+			Expect(config.Stop).To(Equal(StringList{"a", "b"}))
+		})
+	})
+
+	Context("prompt parameter", func() {
+		It("accepts a string or an array of strings", func() {
+			input := &OpenAIRequest{}
+			Expect(json.Unmarshal([]byte(`{"prompt":"Hi"}`), input)).To(Succeed())
+			Expect(input.Prompt).To(Equal(StringList{"Hi"}))
+			Expect(json.Unmarshal([]byte(`{"prompt":["Hi","Hello"]}`), input)).To(Succeed())
+			Expect(input.Prompt).To(Equal(StringList{"Hi", "Hello"}))
+			Expect(json.Unmarshal([]byte(`{"prompt":[1, 2]}`), input)).ToNot(Succeed())
+		})
+	})
+
+	Context("response format", func() {
+		It("accepts a string or an object with a type", func() {
+			input := &OpenAIRequest{}
+			Expect(json.Unmarshal([]byte(`{"response_format":"b64_json"}`), input)).To(Succeed())
+			Expect(input.ResponseFormat.Type).To(Equal("b64_json"))
+			Expect(json.Unmarshal([]byte(`{"response_format":{"type":"json_object"}}`), input)).To(Succeed())
+			Expect(input.ResponseFormat.Type).To(Equal("json_object"))
+
+			config := &Config{}
+			Expect(yaml.Unmarshal([]byte("parameters:\n  response_format:\n    type: json_object\n"), config)).To(Succeed())
+			Expect(config.ResponseFormat.Type).To(Equal("json_object"))
+		})
+		It("extracts the JSON object of the predictions", func() {
+			Expect(jsonObject(` {"a": 1}`)).To(Equal(`{"a": 1}`))
+			Expect(jsonObject("Sure:\n```json\n{\"a\": [1, 2]}\n```")).To(Equal(`{"a": [1, 2]}`))
+
+			_, err := jsonObject("I can't do that")
+			Expect(err).To(HaveOccurred())
+			code, _ := errorResponse(err)
+			Expect(code).To(Equal(500))
+		})
+	})
+
+	Context("penalties", func() {
+		It("override the config ones when set", func() {
+			config := &Config{}
+			Expect(yaml.Unmarshal([]byte("parameters:\n  frequency_penalty: 0.5\n  presence_penalty: 0.3\n"), config)).To(Succeed())
+
+			input := &OpenAIRequest{}
+			Expect(json.Unmarshal([]byte(`{"presence_penalty": 1.2}`), input)).To(Succeed())
+			updateConfig(config, input)
+			Expect(config.FrequencyPenalty).To(Equal(0.5))
+			Expect(config.PresencePenalty).To(Equal(1.2))
+		})
+	})
+
+	Context("seed parameter", func() {
+		It("is unset when omitted", func() {
+			input := &OpenAIRequest{}
+			Expect(json.Unmarshal([]byte(`{"seed":null}`), input)).To(Succeed())
+			Expect(input.Seed).To(BeNil())
+
+			seed := 42
+			config := &Config{OpenAIRequest: OpenAIRequest{Seed: &seed}}
+			updateConfig(config, input)
+			Expect(*config.Seed).To(Equal(42))
+		})
+		It("respects an explicit zero", func() {
+			input := &OpenAIRequest{}
+			Expect(json.Unmarshal([]byte(`{"seed":0}`), input)).To(Succeed())
+			Expect(input.Seed).ToNot(BeNil())
+
+			seed := 42
+			config := &Config{OpenAIRequest: OpenAIRequest{Seed: &seed}}
+			updateConfig(config, input)
+			Expect(*config.Seed).To(Equal(0))
+		})
+	})
+
+	Context("model config", func() {
+		It("takes precedence over the command line settings", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "big-context.yaml"), []byte("name: big-context\ncontext_size: 4096\n"), 0600)).To(Succeed())
+
+			config, err := modelConfig(NewConfigMerger(), newOptions(WithModelLoader(model.NewModelLoader(dir)), WithThreads(4), WithContextSize(512)), "big-context")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.ContextSize).To(Equal(4096))
+			Expect(config.Threads).To(Equal(4))
+		})
+		It("falls back to the command line settings", func() {
+			config, err := modelConfig(NewConfigMerger(), newOptions(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithThreads(4), WithContextSize(512)), "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.ContextSize).To(Equal(512))
+			Expect(config.Threads).To(Equal(4))
+		})
+		It("is validated when read for the request", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("name: broken\ntruncate: newest\n"), 0600)).To(Succeed())
+			cm := NewConfigMerger()
+
+			_, err := modelConfig(cm, newOptions(WithModelLoader(model.NewModelLoader(dir))), "broken")
+			Expect(err).To(MatchError(ContainSubstring("truncate must be none or oldest")))
+			code, _ := errorResponse(err)
+			Expect(code).To(Equal(fiber.StatusBadRequest))
+			_, exists := cm.Get("broken")
+			Expect(exists).To(BeFalse())
+		})
+	})
+
+	Context("extra parameters", func() {
+		var app *fiber.App
+
+		BeforeEach(func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "extra.yaml"), []byte("name: extra\nextra_parameters:\n- repeat_last_n\n"), 0600)).To(Succeed())
+			o := newOptions(WithModelLoader(model.NewModelLoader(dir)))
+
+			app = fiber.New(fiber.Config{
+				ErrorHandler: func(ctx *fiber.Ctx, err error) error {
+					code, resp := errorResponse(err)
+					return ctx.Status(code).JSON(resp)
+				},
+			})
+			app.Post("/", func(c *fiber.Ctx) error {
+				config, _, err := readConfig(NewConfigMerger(), c, o)
+				if err != nil {
+					return err
+				}
+				return c.JSON(config.Extra)
+			})
+		})
+
+		post := func(body string) *http.Response {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			return resp
+		}
+
+		It("are forwarded when the config allows them", func() {
+			resp := post(`{"model": "extra", "repeat_last_n": 128, "penalize_nl": true, "unknown": 1}`)
+			Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+			extra := map[string]interface{}{}
+			Expect(json.NewDecoder(resp.Body).Decode(&extra)).To(Succeed())
+			Expect(extra).To(Equal(map[string]interface{}{"repeat_last_n": 128.0}))
+		})
+		It("are checked", func() {
+			resp := post(`{"model": "extra", "repeat_last_n": "many"}`)
+			Expect(resp.StatusCode).To(Equal(fiber.StatusBadRequest))
+			errResp := ErrorResponse{}
+			Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed())
+			Expect(*errResp.Error.Param).To(Equal("repeat_last_n"))
+
+			resp = post(`{"model": "extra", "repeat_last_n": 100000}`)
+			Expect(resp.StatusCode).To(Equal(fiber.StatusBadRequest))
+		})
+		It("are the backend options without a request field", func() {
+			for name := range extraParameters {
+				Expect(requestFields).ToNot(HaveKey(name))
+			}
+			Expect(extraParameters).ToNot(HaveKey("n_predict"))
+		})
+	})
+
+	Context("default model", func() {
+		requestModel := func(opts ...AppOption) string {
+			dir := GinkgoT().TempDir()
+			for _, name := range []string{"alpha", "beta"} {
+				Expect(os.WriteFile(filepath.Join(dir, name), nil, 0600)).To(Succeed())
+			}
+			o := newOptions(append([]AppOption{WithModelLoader(model.NewModelLoader(dir))}, opts...)...)
+
+			app := fiber.New()
+			app.Post("/", func(c *fiber.Ctx) error {
+				config, _, err := readConfig(NewConfigMerger(), c, o)
+				if err != nil {
+					return err
+				}
+				return c.SendString(config.Model)
+			})
+			req := httptest.NewRequest("POST", "/", strings.NewReader(`{"prompt": "Hi"}`))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(200))
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			return string(body)
+		}
+
+		It("is the first model of the models path when unset", func() {
+			Expect(requestModel()).To(Equal("alpha"))
+		})
+		It("is used by the requests which don't name one", func() {
+			Expect(requestModel(WithDefaultModel("beta"))).To(Equal("beta"))
+		})
+	})
+
+	Context("parameters precedence", func() {
+		var app *fiber.App
+		var cm *ConfigMerger
+
+		BeforeEach(func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "cold.yaml"), []byte("name: cold\nstopwords:\n- \"HUMAN:\"\nparameters:\n  temperature: 0.2\n  top_k: 0\n"), 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "foo"), nil, 0600)).To(Succeed())
+			o := newOptions(WithModelLoader(model.NewModelLoader(dir)))
+			cm = NewConfigMerger()
+
+			app = fiber.New()
+			app.Post("/", func(c *fiber.Ctx) error {
+				config, _, err := readConfig(cm, c, o)
+				if err != nil {
+					return err
+				}
+				return c.JSON(config.OpenAIRequest)
+			})
+		})
+
+		parameters := func(body string) OpenAIRequest {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(200))
+
+			parameters := OpenAIRequest{}
+			Expect(json.NewDecoder(resp.Body).Decode(&parameters)).To(Succeed())
+			return parameters
+		}
+
+		It("layers the config over the defaults", func() {
+			p := parameters(`{"model": "cold"}`)
+			Expect(p.Temperature).To(Equal(0.2))
+			Expect(p.TopK).To(Equal(0))
+			Expect(p.TopP).To(Equal(0.7))
+			Expect(p.Maxtokens).To(Equal(512))
+		})
+		It("layers the request over the config", func() {
+			p := parameters(`{"model": "cold", "temperature": 0, "top_p": 0.5, "top_k": null}`)
+			Expect(p.Temperature).To(Equal(0.0))
+			Expect(p.TopP).To(Equal(0.5))
+			Expect(p.TopK).To(Equal(0))
+		})
+		It("uses the defaults without a config", func() {
+			p := parameters(`{"model": "foo"}`)
+			Expect(p.Temperature).To(Equal(0.9))
+			Expect(p.TopK).To(Equal(80))
+		})
+		It("takes tfs_z and typical_p from the request", func() {
+			p := parameters(`{"model": "cold", "tfs_z": 0.9, "typical_p": 0.8}`)
+			Expect(p.TFSZ).To(Equal(0.9))
+			Expect(p.TypicalP).To(Equal(0.8))
+		})
+		It("doesn't change the stored config", func() {
+			for i := 0; i < 3; i++ {
+				parameters(`{"model": "cold", "stop": "User:"}`)
+			}
+			config, exists := cm.Get("cold")
+			Expect(exists).To(BeTrue())
+			Expect(config.StopWords).To(Equal([]string{"HUMAN:"}))
+		})
+	})
+
+	Context("errors", func() {
+		It("are wrapped in the OpenAI envelope", func() {
+			code, resp := errorResponse(fmt.Errorf("failed reading parameters: %w", fiber.NewError(fiber.StatusBadRequest, "no model specified")))
+			Expect(code).To(Equal(fiber.StatusBadRequest))
+			Expect(resp.Error.Type).To(Equal("invalid_request_error"))
+			Expect(resp.Error.Message).To(ContainSubstring("no model specified"))
+
+			code, resp = errorResponse(fiber.NewError(fiber.StatusNotFound, "The model 'foo' does not exist"))
+			Expect(code).To(Equal(fiber.StatusNotFound))
+			Expect(resp.Error.Type).To(Equal("invalid_request_error"))
+
+			code, resp = errorResponse(fmt.Errorf("inference failed"))
+			Expect(code).To(Equal(fiber.StatusInternalServerError))
+			Expect(resp.Error.Type).To(Equal("server_error"))
+		})
+		It("reject malformed requests with a 400", func() {
+			empty, withModel := GinkgoT().TempDir(), GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(withModel, "foo"), nil, 0600)).To(Succeed())
+
+			for body, dir := range map[string]string{
+				`{"model": `:             empty,
+				`{"prompt": "no model"}`: empty,
+				`{"model": "foo", "prompt": ["a", "b"], "stream": true}`: withModel,
+			} {
+				app, err := App(WithModelLoader(model.NewModelLoader(dir)), WithDisableMessage(true))
+				Expect(err).ToNot(HaveOccurred())
+
+				req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				resp, err := app.Test(req)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(fiber.StatusBadRequest))
+
+				errResp := ErrorResponse{}
+				Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed())
+				Expect(errResp.Error.Type).To(Equal("invalid_request_error"))
+				Expect(errResp.Error.Code).To(BeNumerically("==", fiber.StatusBadRequest))
+			}
+		})
+		It("reject audio requests without a file", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "whisper"), nil, 0600)).To(Succeed())
+			app, err := App(WithModelLoader(model.NewModelLoader(dir)), WithDisableMessage(true))
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, endpoint := range []string{"/v1/audio/transcriptions", "/v1/audio/translations"} {
+				body := &bytes.Buffer{}
+				form := multipart.NewWriter(body)
+				Expect(form.WriteField("model", "whisper")).To(Succeed())
+				Expect(form.Close()).To(Succeed())
+
+				req := httptest.NewRequest("POST", endpoint, body)
+				req.Header.Set("Content-Type", form.FormDataContentType())
+				resp, err := app.Test(req)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(fiber.StatusBadRequest))
+			}
+		})
+		It("reply 404 for the unknown models", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "alias.yaml"), []byte("name: alias\naliases:\n- other\n"), 0600)).To(Succeed())
+			app, err := App(WithModelLoader(model.NewModelLoader(dir)), WithDisableMessage(true))
+			Expect(err).ToNot(HaveOccurred())
+
+			complete := func(model string) *http.Response {
+				req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model": "`+model+`", "prompt": "Hi"}`))
+				req.Header.Set("Content-Type", "application/json")
+				resp, err := app.Test(req)
+				Expect(err).ToNot(HaveOccurred())
+				return resp
+			}
+			Expect(complete("other").StatusCode).ToNot(Equal(fiber.StatusNotFound))
+
+			resp := complete("missing")
+			Expect(resp.StatusCode).To(Equal(fiber.StatusNotFound))
+
+			errResp := ErrorResponse{}
+			Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed())
+			Expect(errResp.Error.Type).To(Equal("invalid_request_error"))
+			Expect(errResp.Error.Message).To(HaveSuffix("The model 'missing' does not exist"))
+		})
+	})
+
+	Context("api keys", func() {
+		listModels := func(app *fiber.App, auth string) int {
+			req := httptest.NewRequest("GET", "/v1/models", nil)
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			return resp.StatusCode
+		}
+
+		It("are not required by default", func() {
+			app, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(listModels(app, "")).To(Equal(fiber.StatusOK))
+		})
+		It("are required when configured", func() {
+			app, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true), WithAPIKeys("key1", "key2"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(listModels(app, "")).To(Equal(fiber.StatusUnauthorized))
+			Expect(listModels(app, "Bearer nope")).To(Equal(fiber.StatusUnauthorized))
+			Expect(listModels(app, "Bearer key2")).To(Equal(fiber.StatusOK))
+		})
+	})
+
+	Context("models info", func() {
+		It("lists the configs and the models without one", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "ggml-gpt4all-j"), nil, 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "ggml-whisper"), nil, 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "gpt-3.5-turbo.yaml"), []byte("name: gpt-3.5-turbo\nparameters:\n  model: ggml-gpt4all-j\ncontext_size: 1024\nstopwords:\n- \"HUMAN:\"\ntemplate:\n  chat: chat\n"), 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "chat.tmpl"), nil, 0600)).To(Succeed())
+
+			app, err := App(WithModelLoader(model.NewModelLoader(dir)), WithDisableMessage(true), WithThreads(4))
+			Expect(err).ToNot(HaveOccurred())
+			resp, err := app.Test(httptest.NewRequest("GET", "/models/info", nil))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+
+			info := struct {
+				Data []ModelInfo `json:"data"`
+			}{}
+			Expect(json.NewDecoder(resp.Body).Decode(&info)).To(Succeed())
+			Expect(info.Data).To(Equal([]ModelInfo{
+				{ID: "gpt-3.5-turbo", Model: "ggml-gpt4all-j", ContextSize: 1024, Threads: 4, StopWords: []string{"HUMAN:"}, Template: TemplateConfig{Chat: "chat"}, Configured: true},
+				{ID: "ggml-whisper", Model: "ggml-whisper", ContextSize: 512, Threads: 4},
+			}))
+		})
+	})
+
+	Context("version", func() {
+		It("reports the build and the backends", func() {
+			app, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true))
+			Expect(err).ToNot(HaveOccurred())
+			resp, err := app.Test(httptest.NewRequest("GET", "/version", nil))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+
+			version := VersionResponse{}
+			Expect(json.NewDecoder(resp.Body).Decode(&version)).To(Succeed())
+			Expect(version.Version).To(Equal("dev"))
+			Expect(version.GoVersion).To(Equal(runtime.Version()))
+
+			names := []string{}
+			versions := map[string]BackendVersion{}
+			for _, b := range version.Backends {
+				names = append(names, b.Name)
+				versions[b.Name] = b
+			}
+			Expect(names).To(Equal(backendNames(backends)))
+			Expect(versions["llama"].Module).To(Equal("github.com/go-skynet/go-llama.cpp"))
+			Expect(versions["llama"].Capabilities).To(ContainElement("completion"))
+			Expect(versions["whisper"].Capabilities).To(Equal([]string{"transcription"}))
+			Expect(versions["llama"].LoadedModels).To(BeEmpty())
+		})
+	})
+
+	Context("cors", func() {
+		preflight := func(app *fiber.App, origin string) string {
+			req := httptest.NewRequest("OPTIONS", "/v1/models", nil)
+			req.Header.Set("Origin", origin)
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			return resp.Header.Get("Access-Control-Allow-Origin")
+		}
+
+		It("allows the same origin only by default", func() {
+			app, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(preflight(app, "https://example.com")).To(BeEmpty())
+		})
+		It("allows the origins configured", func() {
+			app, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true), WithCORSOrigins("https://example.com"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(preflight(app, "https://example.com")).To(Equal("https://example.com"))
+			Expect(preflight(app, "https://evil.com")).To(BeEmpty())
+		})
+		It("doesn't allow the credentials from any origin", func() {
+			_, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true), WithCORSOrigins("*"), WithCORSAllowCredentials(true))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("body logging", func() {
+		It("is enabled only for the models debugged", func() {
+			var buf bytes.Buffer
+			logger := zerolog.New(&buf).Level(zerolog.InfoLevel)
+
+			debugLog(&Config{logger: &logger}).Msg("secret prompt")
+			Expect(buf.String()).To(BeEmpty())
+
+			debugLog(&Config{Debug: true, logger: &logger}).Msg("secret prompt")
+			Expect(buf.String()).To(ContainSubstring("secret prompt"))
+		})
+	})
+
+	Context("loading configs", func() {
+		loadConfig := func(app *fiber.App, contentType, body string) *http.Response {
+			req := httptest.NewRequest("POST", "/v1/models/configs", strings.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Authorization", "Bearer key")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			return resp
+		}
+
+		It("adds the configs to the models", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "foo.bin"), nil, 0600)).To(Succeed())
+			app, err := App(WithModelLoader(model.NewModelLoader(dir)), WithDisableMessage(true), WithAPIKeys("key"))
+			Expect(err).ToNot(HaveOccurred())
+
+			resp := loadConfig(app, "application/yaml", "- name: foo\n  parameters:\n    model: foo.bin\n- name: bar\n")
+			Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+			loaded := struct{ Models []string }{}
+			Expect(json.NewDecoder(resp.Body).Decode(&loaded)).To(Succeed())
+			Expect(loaded.Models).To(Equal([]string{"foo", "bar"}))
+
+			resp = loadConfig(app, "application/json", `{"name": "baz", "aliases": ["qux"]}`)
+			Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+
+			req := httptest.NewRequest("GET", "/v1/models/qux", nil)
+			req.Header.Set("Authorization", "Bearer key")
+			resp, err = app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+		})
+		It("rejects invalid configs", func() {
+			app, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true), WithAPIKeys("key"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(loadConfig(app, "application/yaml", "name: foo\ncutstrings:\n- \"(\"\n").StatusCode).To(Equal(fiber.StatusBadRequest))
+			Expect(loadConfig(app, "application/json", `{"parameters": {}}`).StatusCode).To(Equal(fiber.StatusBadRequest))
+			Expect(loadConfig(app, "application/yaml", "- name: foo\n- name: bar\n  truncate: newest\n").StatusCode).To(Equal(fiber.StatusBadRequest))
+			Expect(loadConfig(app, "application/yaml", "name: foo\nparameters:\n  model: missing.bin\n").StatusCode).To(Equal(fiber.StatusBadRequest))
+
+			req := httptest.NewRequest("GET", "/v1/models/foo", nil)
+			req.Header.Set("Authorization", "Bearer key")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusNotFound))
+		})
+		It("applies the defaults of the models path", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, defaultsFile), []byte("stopwords:\n- \"USER:\"\n"), 0600)).To(Succeed())
+			app, err := App(WithModelLoader(model.NewModelLoader(dir)), WithDisableMessage(true), WithAPIKeys("key"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(loadConfig(app, "application/json", `{"name": "chat"}`).StatusCode).To(Equal(fiber.StatusOK))
+			req := httptest.NewRequest("GET", "/models/info", nil)
+			req.Header.Set("Authorization", "Bearer key")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			info := struct {
+				Data []ModelInfo `json:"data"`
+			}{}
+			Expect(json.NewDecoder(resp.Body).Decode(&info)).To(Succeed())
+			Expect(info.Data).To(HaveLen(1))
+			Expect(info.Data[0].StopWords).To(Equal([]string{"USER:"}))
+		})
+		It("is disabled without API keys", func() {
+			app, err := App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(loadConfig(app, "application/yaml", "name: foo\n").StatusCode).To(Equal(fiber.StatusMethodNotAllowed))
+		})
+		It("reloads a single config from its file", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "model.bin"), nil, 0600)).To(Succeed())
+			file := filepath.Join(dir, "chat.yaml")
+			Expect(os.WriteFile(file, []byte("name: chat\nparameters:\n  model: model.bin\nstopwords:\n- \"USER:\"\n"), 0600)).To(Succeed())
+			app, err := App(WithModelLoader(model.NewModelLoader(dir)), WithDisableMessage(true), WithAPIKeys("key"))
+			Expect(err).ToNot(HaveOccurred())
+
+			reload := func(name string) int {
+				req := httptest.NewRequest("POST", "/v1/models/"+name+"/reload", nil)
+				req.Header.Set("Authorization", "Bearer key")
+				resp, err := app.Test(req)
+				Expect(err).ToNot(HaveOccurred())
+				return resp.StatusCode
+			}
+			stopwords := func() []string {
+				req := httptest.NewRequest("GET", "/models/info", nil)
+				req.Header.Set("Authorization", "Bearer key")
+				resp, err := app.Test(req)
+				Expect(err).ToNot(HaveOccurred())
+				info := struct {
+					Data []ModelInfo `json:"data"`
+				}{}
+				Expect(json.NewDecoder(resp.Body).Decode(&info)).To(Succeed())
+				return info.Data[0].StopWords
+			}
+
+			Expect(os.WriteFile(file, []byte("name: chat\nparameters:\n  model: model.bin\nstopwords:\n- \"HUMAN:\"\n"), 0600)).To(Succeed())
+			Expect(stopwords()).To(Equal([]string{"USER:"}))
+			Expect(reload("chat")).To(Equal(fiber.StatusOK))
+			Expect(stopwords()).To(Equal([]string{"HUMAN:"}))
+
+			// the invalid configs are not loaded
+			Expect(os.WriteFile(file, []byte("name: chat\nparameters:\n  model: missing.bin\n"), 0600)).To(Succeed())
+			Expect(reload("chat")).To(Equal(fiber.StatusBadRequest))
+			Expect(stopwords()).To(Equal([]string{"HUMAN:"}))
+
+			Expect(os.Remove(file)).To(Succeed())
+			Expect(reload("chat")).To(Equal(fiber.StatusNotFound))
+			Expect(reload("missing")).To(Equal(fiber.StatusNotFound))
+		})
+	})
+
+	Context("prompt templates", func() {
+		It("fail the strict configs when missing or broken", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "broken.tmpl"), []byte("{{.Missing.Field}}"), 0600)).To(Succeed())
+			loader := model.NewModelLoader(dir)
+			messages := []Message{{Role: "user", Content: "Hi"}}
+
+			// without a template the input is used as is
+			prompt, err := chatPrompt(loader, &Config{Name: "plain", OpenAIRequest: OpenAIRequest{Model: "model.bin"}, TemplateConfig: TemplateConfig{Strict: true}}, messages)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(prompt).To(Equal("user Hi"))
+
+			for _, name := range []string{"missing", "broken"} {
+				config := &Config{Name: name, TemplateConfig: TemplateConfig{Chat: name}}
+				prompt, err := chatPrompt(loader, config, messages)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(prompt).To(Equal("user Hi"))
+
+				config.TemplateConfig.Strict = true
+				_, err = chatPrompt(loader, config, messages)
+				Expect(err).To(MatchError(ContainSubstring("cannot use the template " + name)))
+			}
+		})
+		It("are overridden by the inline template of the request", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "chat.tmpl"), []byte("{{.Input}}"), 0600)).To(Succeed())
+			loader := model.NewModelLoader(dir)
+			messages := []Message{{Role: "user", Content: "Hi"}}
+
+			config := &Config{TemplateConfig: TemplateConfig{Chat: "chat"}}
+			config.Template = "{{range .Messages}}[{{.Role | upper}}] {{.Content}}{{end}}"
+			prompt, err := chatPrompt(loader, config, messages)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(prompt).To(Equal("[USER] Hi"))
+
+			config.Template = "{{.Missing.Field}}"
+			_, err = chatPrompt(loader, config, messages)
+			Expect(err).To(MatchError(ContainSubstring("cannot use the template of the request")))
+			code, _ := errorResponse(err)
+			Expect(code).To(Equal(fiber.StatusBadRequest))
+		})
+		It("can use the suffix of fill-in-the-middle completions", func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "coder.tmpl"), []byte("<PRE>{{.Input}}<SUF>{{.Suffix}}<MID>"), 0600)).To(Succeed())
+			loader := model.NewModelLoader(dir)
+
+			prompt, err := loader.TemplatePrefix("coder", PromptTemplateData{Input: "func add(a, b int) int {", Suffix: "}"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(prompt).To(Equal("<PRE>func add(a, b int) int {<SUF>}<MID>"))
+		})
+		It("can render the chat messages", func() {
+			dir := GinkgoT().TempDir()
+			tmpl := "<|system|>{{.SystemPrompt}}{{range .Messages}}{{if ne .Role \"system\"}}<|{{.Role}}|>{{.Content}}{{end}}{{end}}<|assistant|>"
+			Expect(os.WriteFile(filepath.Join(dir, "chat.tmpl"), []byte(tmpl), 0600)).To(Succeed())
+			loader := model.NewModelLoader(dir)
+
+			config := &Config{Roles: map[string]string{"user": "USER:"}}
+			data := chatTemplateData(config, []Message{
+				{Role: "system", Content: "Be brief."},
+				{Role: "user", Content: "Hi"},
+			})
+			Expect(data.Input).To(Equal("system Be brief.\nUSER: Hi"))
+
+			prompt, err := loader.TemplatePrefix("chat", data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(prompt).To(Equal("<|system|>Be brief.<|user|>Hi<|assistant|>"))
+		})
+		It("end with the assistant prefix of the config", func() {
+			config := &Config{AssistantPrefix: "### Assistant:", Roles: map[string]string{"user": "### User:"}}
+			data := chatTemplateData(config, []Message{{Role: "user", Content: "Hi"}})
+			Expect(data.Input).To(Equal("### User: Hi\n### Assistant:"))
+			Expect(data.Messages).To(HaveLen(1))
+
+			loader := model.NewModelLoader(GinkgoT().TempDir())
+			prompt, err := chatPrompt(loader, config, []Message{{Role: "user", Content: "Hi"}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(prompt).To(HaveSuffix("\n### Assistant:"))
+
+			// the templates rendering the messages place it themselves
+			config.Template = "{{range .Messages}}<{{.Role}}>{{.Content}}{{end}}<{{.AssistantPrefix}}>"
+			prompt, err = chatPrompt(loader, config, []Message{{Role: "user", Content: "Hi"}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(prompt).To(Equal("<user>Hi<### Assistant:>"))
+		})
+		It("prepend the system prompt of the config unless the request sends one", func() {
+			config := &Config{SystemPrompt: "You are helpful."}
+			data := chatTemplateData(config, []Message{{Role: "user", Content: "Hi"}})
+			Expect(data.SystemPrompt).To(Equal("You are helpful."))
+			Expect(data.Input).To(Equal("system You are helpful.\nuser Hi"))
+			Expect(data.Messages).To(HaveLen(2))
+
+			data = chatTemplateData(config, []Message{{Role: "system", Content: "Be brief."}, {Role: "user", Content: "Hi"}})
+			Expect(data.SystemPrompt).To(Equal("Be brief."))
+			Expect(data.Input).To(Equal("system Be brief.\nuser Hi"))
+		})
+	})
+
+	Context("chat truncation", func() {
+		var loader *model.ModelLoader
+		messages := []Message{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: strings.Repeat("a", 40)},
+			{Role: "assistant", Content: strings.Repeat("b", 40)},
+			{Role: "user", Content: "Hi"},
+		}
+
+		BeforeEach(func() {
+			loader = model.NewModelLoader(GinkgoT().TempDir())
+		})
+
+		It("leaves the prompt as is by default", func() {
+			config := &Config{ContextSize: 8}
+			prompt, err := chatPrompt(loader, config, messages)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(prompt).To(ContainSubstring("aaaa"))
+			// the backend drops the tokens past the context
+			Expect(config.truncated).To(Equal(estimateTokens(prompt) - 7))
+		})
+		It("drops the oldest messages but the system one", func() {
+			config := &Config{ContextSize: 16, Truncate: "oldest"}
+			prompt, err := chatPrompt(loader, config, messages)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(prompt).To(Equal("system Be brief.\nuser Hi"))
+			Expect(messages).To(HaveLen(4))
+			Expect(config.truncated).To(BeNumerically(">", 20))
+
+			config = &Config{ContextSize: 1024, Truncate: "oldest"}
+			_, err = chatPrompt(loader, config, messages)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.truncated).To(BeZero())
+		})
+		It("reports the truncation in the headers", func() {
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				config := &Config{ContextSize: 16, Truncate: "oldest"}
+				if _, err := chatPrompt(loader, config, messages); err != nil {
+					return err
+				}
+				setTruncated(c, config)
+				return nil
+			})
+			resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.Header.Get(truncatedHeader)).To(Equal("true"))
+			Expect(resp.Header.Get(truncatedTokensHeader)).To(MatchRegexp(`^[1-9][0-9]+$`))
+		})
+		It("fails when the prompt overflows", func() {
+			_, err := chatPrompt(loader, &Config{ContextSize: 16, Truncate: "none"}, messages)
+			Expect(err).To(MatchError(ContainSubstring("exceeding the context size of 16 tokens")))
+			code, _ := errorResponse(err)
+			Expect(code).To(Equal(fiber.StatusBadRequest))
+
+			_, err = chatPrompt(loader, &Config{ContextSize: 2, Truncate: "oldest"}, messages)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("routes", func() {
+		var app *fiber.App
+		var backend *echoBackend
+
+		BeforeEach(func() {
+			app, backend = echoApp(map[string]string{
+				"echo.yaml":    "name: echo\nbackend: echo\nroles:\n  user: \"USER:\"\n  system: \"SYSTEM:\"\nparameters:\n  model: model.bin\n",
+				"metered.yaml": "name: metered\nbackend: echo\nstream_usage: true\nparameters:\n  model: model.bin\n",
+			})
+		})
+
+		post := func(path, body string) OpenAIResponse {
+			req := httptest.NewRequest("POST", path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+
+			response := OpenAIResponse{}
+			Expect(json.NewDecoder(resp.Body).Decode(&response)).To(Succeed())
+			Expect(response.Choices).To(HaveLen(1))
+			return response
+		}
+
+		// streamed returns the chunks of the completion streamed for body
+		streamed := func(body string) []OpenAIResponse {
+			req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+
+			data, err := io.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			chunks := []OpenAIResponse{}
+			for _, event := range strings.Split(string(data), "\n\n") {
+				data := strings.TrimPrefix(event, "data: ")
+				if data == event || data == "[DONE]" {
+					continue
+				}
+				chunk := OpenAIResponse{}
+				Expect(json.Unmarshal([]byte(data), &chunk)).To(Succeed())
+				chunks = append(chunks, chunk)
+			}
+			Expect(chunks).ToNot(BeEmpty())
+			return chunks
+		}
+
+		It("serve the batches of completions, reporting the failures per request", func() {
+			req := httptest.NewRequest("POST", "/v1/completions/batch", strings.NewReader(`[
+				{"model": "echo", "prompt": "Once upon a time"},
+				{"model": "missing", "prompt": "Hi"},
+				{"model": "echo", "prompt": "Hi", "stream": true},
+				{"model": "echo", "prompt": "The end"}
+			]`))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+
+			batch := BatchResponse{}
+			Expect(json.NewDecoder(resp.Body).Decode(&batch)).To(Succeed())
+			Expect(batch.Data).To(HaveLen(4))
+			for i, result := range batch.Data {
+				Expect(result.Index).To(Equal(i))
+			}
+
+			texts := []string{}
+			for _, i := range []int{0, 3} {
+				Expect(batch.Data[i].Status).To(Equal(fiber.StatusOK))
+				response := OpenAIResponse{}
+				Expect(json.Unmarshal(batch.Data[i].Response, &response)).To(Succeed())
+				Expect(response.Choices).To(HaveLen(1))
+				texts = append(texts, response.Choices[0].Text)
+			}
+			Expect(texts).To(Equal([]string{"Once upon a time", "The end"}))
+
+			Expect(batch.Data[1].Status).To(Equal(fiber.StatusNotFound))
+			Expect(batch.Data[1].Error.Message).To(ContainSubstring("The model 'missing' does not exist"))
+			Expect(batch.Data[2].Status).To(Equal(fiber.StatusBadRequest))
+			Expect(*batch.Data[2].Error.Param).To(Equal("stream"))
+		})
+		DescribeTable("render the prompts of the dry runs without loading the model",
+			func(path, body, prompt string) {
+				req := httptest.NewRequest("POST", path, strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				resp, err := app.Test(req)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+
+				dry := DryRunResponse{}
+				Expect(json.NewDecoder(resp.Body).Decode(&dry)).To(Succeed())
+				Expect(dry.Object).To(Equal("dry_run"))
+				Expect(dry.Prompts).To(Equal([]string{prompt}))
+				// the echo model has no template, so the input is used as is
+				Expect(dry.Template).To(Equal("model.bin"))
+				Expect(dry.TemplateFound).To(BeFalse())
+				Expect(backend.loaded()).To(BeEmpty())
+			},
+			Entry("completions", "/v1/completions", `{"model": "echo", "prompt": "Once upon a time", "dry_run": true}`, "Once upon a time"),
+			Entry("chat completions", "/v1/chat/completions", `{"model": "echo", "messages": [{"role": "user", "content": "Hi"}], "dry_run": true}`, "USER: Hi"),
+		)
+		It("reply to the tokenization with a 501 without the tokenizer of the backend", func() {
+			req := httptest.NewRequest("POST", "/v1/tokenize", strings.NewReader(`{"model": "echo", "content": "Once upon a time"}`))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusNotImplemented))
+			Expect(backend.loaded()).To(BeEmpty())
+		})
+		It("reject the batches which aren't arrays of requests", func() {
+			for _, body := range []string{`{"model": "echo", "prompt": "Hi"}`, `[]`} {
+				req := httptest.NewRequest("POST", "/completions/batch", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				resp, err := app.Test(req)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(fiber.StatusBadRequest))
+			}
+		})
+
+		DescribeTable("flatten the messages of the chat completions",
+			func(path string) {
+				response := post(path, `{"model": "echo", "messages": [{"role": "system", "content": "Be brief."}, {"role": "user", "content": "Hi"}]}`)
+				Expect(response.Object).To(Equal("chat.completion"))
+				Expect(response.Choices[0].Message.Content).To(Equal("SYSTEM: Be brief.\nUSER: Hi"))
+			},
+			Entry("with the version", "/v1/chat/completions"),
+			Entry("without the version", "/chat/completions"),
+		)
+		DescribeTable("pass the prompt of the completions",
+			func(path string) {
+				response := post(path, `{"model": "echo", "prompt": "Once upon a time"}`)
+				Expect(response.Object).To(Equal("text_completion"))
+				Expect(response.Choices[0].Text).To(Equal("Once upon a time"))
+			},
+			Entry("with the version", "/v1/completions"),
+			Entry("without the version", "/completions"),
+		)
+		It("report the timings when asked", func() {
+			response := post("/v1/completions", `{"model": "echo", "prompt": "Once upon a time"}`)
+			Expect(response.Timings).To(BeNil())
+
+			response = post("/v1/completions", `{"model": "echo", "prompt": "Once upon a time", "timings": true}`)
+			Expect(response.Timings).ToNot(BeNil())
+			Expect(response.Timings.PromptTokens).To(Equal(response.Usage.PromptTokens))
+			Expect(response.Timings.PredictedTokens).To(Equal(response.Usage.CompletionTokens))
+			Expect(response.Timings.PredictedMS).To(BeNumerically(">", 0))
+			Expect(response.Timings.PredictedPerSecond).To(BeNumerically(">", 0))
+		})
+		It("reject the edits without an input with a 400", func() {
+			req := httptest.NewRequest("POST", "/v1/edits", strings.NewReader(`{"model": "echo", "instruction": "Fix the spelling"}`))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusBadRequest))
+
+			errResp := ErrorResponse{}
+			Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed())
+			Expect(*errResp.Error.Param).To(Equal("input"))
+		})
+		It("reject the inline templates unless the server allows them", func() {
+			req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model": "echo", "prompt": "Hi", "template": "{{.Input}}!"}`))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusBadRequest))
+		})
+		It("stream the choices one after the other, by index", func() {
+			chunks := streamed(`{"model": "echo", "prompt": "Once upon a time", "stream": true, "n": 2, "stream_options": {"include_usage": true}}`)
+			texts := map[int]string{}
+			finishReasons := map[int]string{}
+			last := -1
+			for _, chunk := range chunks[:len(chunks)-1] {
+				Expect(chunk.Choices).To(HaveLen(1))
+				choice := chunk.Choices[0]
+				Expect(choice.Index).To(BeNumerically(">=", last))
+				last = choice.Index
+				texts[choice.Index] += choice.Text
+				if choice.FinishReason != "" {
+					finishReasons[choice.Index] = choice.FinishReason
+				}
+			}
+			Expect(texts).To(Equal(map[int]string{0: "Once upon a time", 1: "Once upon a time"}))
+			Expect(finishReasons).To(HaveLen(2))
+			Expect(chunks[len(chunks)-1].Choices).To(BeEmpty())
+		})
+		It("end the streams with the usage when the config asks for it", func() {
+			// the usage chunk is the only one without choices
+			echo := streamed(`{"model": "echo", "prompt": "Once upon a time", "stream": true}`)
+			Expect(echo[len(echo)-1].Choices).ToNot(BeEmpty())
+			metered := streamed(`{"model": "metered", "prompt": "Once upon a time", "stream": true}`)
+			text := ""
+			for _, chunk := range metered[:len(metered)-1] {
+				text += chunk.Choices[0].Text
+			}
+			Expect(text).To(Equal("Once upon a time"))
+			Expect(metered[len(metered)-2].Choices[0].FinishReason).To(Equal("stop"))
+			Expect(metered[len(metered)-1].Choices).To(BeEmpty())
+			Expect(metered[len(metered)-1].Usage.CompletionTokens).To(BeNumerically(">", 0))
+		})
+	})
+
+	Context("disabled models", func() {
+		var app *fiber.App
+
+		BeforeEach(func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "model.bin"), nil, 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "on.yaml"), []byte("name: on\nparameters:\n  model: model.bin\n"), 0600)).To(Succeed())
+			// the model of a disabled config can be missing
+			Expect(os.WriteFile(filepath.Join(dir, "off.yaml"), []byte("name: off\nenabled: false\naliases:\n- off-alias\nparameters:\n  model: downloading.bin\n"), 0600)).To(Succeed())
+			// a file named as the disabled config is disabled along it
+			Expect(os.WriteFile(filepath.Join(dir, "off-alias"), nil, 0600)).To(Succeed())
+
+			var err error
+			app, err = App(WithModelLoader(model.NewModelLoader(dir)), WithDisableMessage(true))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("are not listed", func() {
+			resp, err := app.Test(httptest.NewRequest("GET", "/v1/models", nil))
+			Expect(err).ToNot(HaveOccurred())
+			models := struct {
+				Data []OpenAIModel `json:"data"`
+			}{}
+			Expect(json.NewDecoder(resp.Body).Decode(&models)).To(Succeed())
+			ids := []string{}
+			for _, m := range models.Data {
+				ids = append(ids, m.ID)
+			}
+			Expect(ids).To(ConsistOf("model.bin", "on"))
+
+			resp, err = app.Test(httptest.NewRequest("GET", "/v1/models/off", nil))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusNotFound))
+		})
+		It("reply 404 to the requests", func() {
+			for _, name := range []string{"off", "off-alias"} {
+				req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model": "`+name+`", "prompt": "Hi"}`))
+				req.Header.Set("Content-Type", "application/json")
+				resp, err := app.Test(req)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(fiber.StatusNotFound))
+
+				errResp := ErrorResponse{}
+				Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed())
+				Expect(errResp.Error.Message).To(ContainSubstring("is disabled"))
+			}
+		})
+	})
+
+	Context("compression", func() {
+		get := func(opts ...AppOption) *http.Response {
+			dir := GinkgoT().TempDir()
+			for i := 0; i < 20; i++ {
+				Expect(os.WriteFile(filepath.Join(dir, fmt.Sprintf("model-%d.bin", i)), nil, 0600)).To(Succeed())
+			}
+			app, err := App(append(opts, WithModelLoader(model.NewModelLoader(dir)), WithDisableMessage(true))...)
+			Expect(err).ToNot(HaveOccurred())
+			req := httptest.NewRequest("GET", "/v1/models", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			return resp
+		}
+
+		It("is negotiated with Accept-Encoding", func() {
+			Expect(get().Header.Get("Content-Encoding")).To(Equal("gzip"))
+		})
+		It("can be disabled", func() {
+			Expect(get(WithDisableCompression(true)).Header.Get("Content-Encoding")).To(BeEmpty())
+		})
+		It("skips the streams", func() {
+			app := fiber.New()
+			app.Post("/", func(c *fiber.Ctx) error {
+				return c.JSON(isStream(c))
+			})
+			stream := func(body string) (isStream bool) {
+				resp, err := app.Test(httptest.NewRequest("POST", "/", strings.NewReader(body)))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(json.NewDecoder(resp.Body).Decode(&isStream)).To(Succeed())
+				return
+			}
+			Expect(stream(`{"model": "foo", "stream": true}`)).To(BeTrue())
+			Expect(stream(`{"model": "foo"}`)).To(BeFalse())
+			Expect(stream(`--boundary`)).To(BeFalse())
+		})
+	})
+
+	Context("streaming", func() {
+		chunk := func(token string) OpenAIResponse {
+			return OpenAIResponse{Object: "text_completion", Choices: []Choice{{Text: token}}}
+		}
+		last := func(finishReason string) OpenAIResponse {
+			return OpenAIResponse{Object: "text_completion", Choices: []Choice{{FinishReason: finishReason}}}
+		}
+		// predict streams the tokens of a prediction, then its last chunk
+		predict := func(tokens func(tokenCallback func(string) bool) string) func(send func(OpenAIResponse) bool) {
+			return func(send func(OpenAIResponse) bool) {
+				finishReason := tokens(func(token string) bool {
+					return send(chunk(token))
+				})
+				send(last(finishReason))
+			}
+		}
+
+		It("writes the tokens, the last chunk and DONE", func() {
+			responses := streamTokens(context.Background(), predict(func(tokenCallback func(string) bool) string {
+				tokenCallback("Hello")
+				tokenCallback(" world")
+				return "length"
+			}))
+
+			out := &bytes.Buffer{}
+			Expect(writeStream(bufio.NewWriter(out), &Config{}, responses, 0)).To(Succeed())
+			events := strings.Split(strings.TrimSpace(out.String()), "\n\n")
+			Expect(events).To(HaveLen(4))
+			Expect(events[0]).To(ContainSubstring(`"text":"Hello"`))
+			Expect(events[1]).To(ContainSubstring(`"text":" world"`))
+			Expect(events[2]).To(ContainSubstring(`"finish_reason":"length"`))
+			Expect(events[3]).To(Equal("data: [DONE]"))
+		})
+		It("writes the usage chunk with empty choices", func() {
+			responses := streamTokens(context.Background(), func(send func(OpenAIResponse) bool) {
+				predict(func(tokenCallback func(string) bool) string {
+					tokenCallback("Hello")
+					return "stop"
+				})(send)
+				send(OpenAIResponse{Object: "text_completion", Choices: []Choice{}, Usage: usage(TokenUsage{Prompt: 3, Completion: 1})})
+			})
+
+			out := &bytes.Buffer{}
+			Expect(writeStream(bufio.NewWriter(out), &Config{}, responses, 0)).To(Succeed())
+			events := strings.Split(strings.TrimSpace(out.String()), "\n\n")
+			Expect(events).To(HaveLen(4))
+			Expect(events[1]).To(ContainSubstring(`"finish_reason":"stop"`))
+			Expect(events[2]).To(ContainSubstring(`"choices":[]`))
+			Expect(events[2]).To(ContainSubstring(`"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}`))
+			Expect(events[3]).To(Equal("data: [DONE]"))
+		})
+		It("pings until the first token", func() {
+			responses := streamTokens(context.Background(), predict(func(tokenCallback func(string) bool) string {
+				time.Sleep(50 * time.Millisecond)
+				tokenCallback("Hello")
+				time.Sleep(50 * time.Millisecond)
+				return "stop"
+			}))
+
+			out := &bytes.Buffer{}
+			Expect(writeStream(bufio.NewWriter(out), &Config{}, responses, 10*time.Millisecond)).To(Succeed())
+			events := strings.Split(strings.TrimSpace(out.String()), "\n\n")
+			Expect(len(events)).To(BeNumerically(">", 3))
+			pings := events[:len(events)-3]
+			Expect(pings).To(HaveEach(": ping"))
+			Expect(events[len(events)-3]).To(ContainSubstring(`"text":"Hello"`))
+		})
+		It("doesn't generate ahead of a slow client", func() {
+			var generated int32
+			responses := streamTokens(context.Background(), predict(func(tokenCallback func(string) bool) string {
+				for i := 0; i < 10; i++ {
+					atomic.AddInt32(&generated, 1)
+					tokenCallback("token")
+				}
+				return "stop"
+			}))
+
+			Consistently(func() int32 { return atomic.LoadInt32(&generated) }, "100ms").Should(BeNumerically("<=", 1))
+			Expect(writeStream(bufio.NewWriter(io.Discard), &Config{}, responses, 0)).To(Succeed())
+			Expect(atomic.LoadInt32(&generated)).To(BeNumerically("==", 10))
+		})
+		It("cancels the prediction when the client goes away", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			stopped := make(chan struct{})
+			responses := streamTokens(ctx, predict(func(tokenCallback func(string) bool) string {
+				// a backend generating until told to stop
+				for tokenCallback("token") {
+				}
+				close(stopped)
+				return "stop"
+			}))
+
+			client := &brokenPipe{writes: 3}
+			err := writeStream(bufio.NewWriterSize(client, 16), &Config{}, responses, 0)
+			Expect(err).To(MatchError(syscall.EPIPE))
+			// as the stream writer does when it returns
+			cancel()
+
+			Eventually(stopped).Should(BeClosed())
+			Eventually(responses).Should(BeClosed())
+		})
+	})
+})
+
+// brokenPipe is a client connection which goes away after a few writes
+type brokenPipe struct {
+	writes int
+}
+
+func (b *brokenPipe) Write(p []byte) (int, error) {
+	if b.writes == 0 {
+		return 0, syscall.EPIPE
+	}
+	b.writes--
+	return len(p), nil
+}
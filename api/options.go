@@ -0,0 +1,301 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type Option struct {
+	configFile         string
+	defaultModel       string
+	modelFile          string
+	loader             *model.ModelLoader
+	threads            int
+	ctxSize            int
+	f16                bool
+	debug              bool
+	disableMessage     bool
+	disableCompression bool
+	watchConfigs       bool
+	preloadModels      []string
+	preloadStrict      bool
+	apiKeys            []string
+	requestTimeout     time.Duration
+	corsOrigins        []string
+	corsCredentials    bool
+
+	// maxConcurrency bounds the inferences running at once, with up to
+	// maxQueue requests waiting for them. 0 is unlimited
+	maxConcurrency int
+	maxQueue       int
+	limiter        *limiter
+
+	// responseCacheSize deterministic responses are cached for
+	// responseCacheTTL. 0 disables the cache
+	responseCacheSize int
+	responseCacheTTL  time.Duration
+	responseCache     *responseCache
+
+	// rateLimiter throttles the models with a rate_limit
+	rateLimiter *rateLimiter
+
+	// streamKeepalive is the interval of the pings written to the streams
+	// until their first token. 0 disables them
+	streamKeepalive time.Duration
+
+	// inlineTemplates lets the requests send their own prompt template
+	inlineTemplates bool
+
+	// maxBodySize is the size in bytes of the largest request body accepted,
+	// 0 is the default of fiber, and maxPromptTokens the number of tokens of
+	// the longest prompt accepted, 0 is unlimited
+	maxBodySize     int
+	maxPromptTokens int
+
+	// baseContext is the context the predictions run in, see WithContext
+	baseContext context.Context
+
+	// logger is the logger of the app, at debug level with debug and at
+	// info level otherwise, see WithLogger
+	logger *zerolog.Logger
+
+	// backends are the backends the configs can select, the built-in ones
+	// and the ones added with WithBackend
+	backends map[string]BackendFunc
+}
+
+type AppOption func(*Option)
+
+func newOptions(o ...AppOption) *Option {
+	opt := &Option{
+		threads:     1,
+		ctxSize:     512,
+		baseContext: context.Background(),
+		backends:    map[string]BackendFunc{},
+	}
+	for name, load := range backends {
+		opt.backends[name] = load
+	}
+	for _, oo := range o {
+		oo(opt)
+	}
+	logger := log.Logger
+	if opt.logger != nil {
+		logger = *opt.logger
+	}
+	logger = logger.Level(zerolog.InfoLevel)
+	if opt.debug {
+		logger = logger.Level(zerolog.DebugLevel)
+	}
+	opt.logger = &logger
+	opt.limiter = newLimiter(opt.maxConcurrency, opt.maxQueue)
+	opt.responseCache = newResponseCache(opt.responseCacheSize, opt.responseCacheTTL)
+	opt.rateLimiter = newRateLimiter()
+	return opt
+}
+
+func WithConfigFile(configFile string) AppOption {
+	return func(o *Option) {
+		o.configFile = configFile
+	}
+}
+
+// WithDefaultModel sets the model of the requests which don't name one. Without
+// it they use the first model of the models path.
+func WithDefaultModel(name string) AppOption {
+	return func(o *Option) {
+		o.defaultModel = name
+	}
+}
+
+// WithModelFile serves the model file without a config, with the default
+// parameters, under its name without extension.
+func WithModelFile(file string) AppOption {
+	return func(o *Option) {
+		o.modelFile = file
+	}
+}
+
+func WithModelLoader(loader *model.ModelLoader) AppOption {
+	return func(o *Option) {
+		o.loader = loader
+	}
+}
+
+func WithThreads(threads int) AppOption {
+	return func(o *Option) {
+		o.threads = threads
+	}
+}
+
+func WithContextSize(ctxSize int) AppOption {
+	return func(o *Option) {
+		o.ctxSize = ctxSize
+	}
+}
+
+func WithF16(f16 bool) AppOption {
+	return func(o *Option) {
+		o.f16 = f16
+	}
+}
+
+func WithDebug(debug bool) AppOption {
+	return func(o *Option) {
+		o.debug = debug
+	}
+}
+
+func WithDisableMessage(disableMessage bool) AppOption {
+	return func(o *Option) {
+		o.disableMessage = disableMessage
+	}
+}
+
+// WithDisableCompression disables the gzip, deflate and brotli compression of
+// the responses negotiated with Accept-Encoding.
+func WithDisableCompression(disable bool) AppOption {
+	return func(o *Option) {
+		o.disableCompression = disable
+	}
+}
+
+// WithWatchConfigs reloads the model config files from the models path when
+// they are added, changed or removed.
+func WithWatchConfigs(watch bool) AppOption {
+	return func(o *Option) {
+		o.watchConfigs = watch
+	}
+}
+
+// WithPreloadModels loads the models before serving the first request. "all"
+// preloads all the configured models.
+func WithPreloadModels(models ...string) AppOption {
+	return func(o *Option) {
+		o.preloadModels = append(o.preloadModels, models...)
+	}
+}
+
+// WithPreloadStrict makes App fail if a model can't be preloaded, rather than
+// logging the error.
+func WithPreloadStrict(strict bool) AppOption {
+	return func(o *Option) {
+		o.preloadStrict = strict
+	}
+}
+
+// WithAPIKeys requires the requests to carry one of the keys as bearer token
+func WithAPIKeys(keys ...string) AppOption {
+	return func(o *Option) {
+		o.apiKeys = append(o.apiKeys, keys...)
+	}
+}
+
+// WithRequestTimeout cancels the predictions of the requests which take longer
+// than timeout. Zero disables the timeout.
+func WithRequestTimeout(timeout time.Duration) AppOption {
+	return func(o *Option) {
+		o.requestTimeout = timeout
+	}
+}
+
+// WithLogger logs the requests and the events of the app with logger rather
+// than with the global logger.
+func WithLogger(logger zerolog.Logger) AppOption {
+	return func(o *Option) {
+		o.logger = &logger
+	}
+}
+
+// WithContext runs the predictions in ctx, so they are all cancelled with it,
+// e.g. once the requests in flight were given the time to complete on
+// shutdown. The server shutting down doesn't cancel them by itself.
+func WithContext(ctx context.Context) AppOption {
+	return func(o *Option) {
+		o.baseContext = ctx
+	}
+}
+
+// WithCORSOrigins allows the browsers to call the API from the origins, e.g.
+// https://example.com, or from any origin with "*". Without origins, only the
+// same origin is allowed.
+func WithCORSOrigins(origins ...string) AppOption {
+	return func(o *Option) {
+		o.corsOrigins = append(o.corsOrigins, origins...)
+	}
+}
+
+// WithCORSAllowCredentials lets the browsers send their credentials, e.g.
+// cookies, along the cross-origin requests.
+func WithCORSAllowCredentials(allow bool) AppOption {
+	return func(o *Option) {
+		o.corsCredentials = allow
+	}
+}
+
+// WithResponseCache caches up to size responses of the deterministic requests,
+// with a temperature of 0 or a seed, for ttl. They are replied again to the
+// identical requests. 0 disables the cache.
+func WithResponseCache(size int, ttl time.Duration) AppOption {
+	return func(o *Option) {
+		o.responseCacheSize = size
+		o.responseCacheTTL = ttl
+	}
+}
+
+// WithStreamKeepalive writes a comment to the streamed responses every
+// interval until their first token, so the proxies don't time out the
+// connections while the prompt is evaluated. 0 disables it.
+func WithStreamKeepalive(interval time.Duration) AppOption {
+	return func(o *Option) {
+		o.streamKeepalive = interval
+	}
+}
+
+// WithInlineTemplates lets the requests send a prompt template to render in
+// place of the one of the model config. The templates run with the functions
+// of the loader, so they should only be allowed from trusted clients.
+func WithInlineTemplates(allow bool) AppOption {
+	return func(o *Option) {
+		o.inlineTemplates = allow
+	}
+}
+
+// WithMaxBodySize rejects the requests whose body is larger than size bytes
+// with a 413. 0 keeps the default of fiber, 4MB.
+func WithMaxBodySize(size int) AppOption {
+	return func(o *Option) {
+		o.maxBodySize = size
+	}
+}
+
+// WithMaxPromptTokens rejects the completions whose prompt is longer than
+// tokens with a 400, before their inference starts. 0 is unlimited.
+func WithMaxPromptTokens(tokens int) AppOption {
+	return func(o *Option) {
+		o.maxPromptTokens = tokens
+	}
+}
+
+// WithMaxConcurrency bounds the number of inferences running at once to max.
+// The requests past the limit wait for one to complete, up to queue of them,
+// the others are rejected with a 429. 0 is unlimited.
+func WithMaxConcurrency(max, queue int) AppOption {
+	return func(o *Option) {
+		o.maxConcurrency = max
+		o.maxQueue = queue
+	}
+}
+
+// WithBackend adds a backend the configs can select by name, or replaces the
+// built-in one of the same name.
+func WithBackend(name string, load BackendFunc) AppOption {
+	return func(o *Option) {
+		o.backends[strings.ToLower(name)] = load
+	}
+}
@@ -1,63 +1,77 @@
 package api
 
 import (
+	"context"
 	"fmt"
-	"regexp"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/donomii/go-rwkv.cpp"
 	model "github.com/go-skynet/LocalAI/pkg/model"
 	gpt2 "github.com/go-skynet/go-gpt2.cpp"
 	gptj "github.com/go-skynet/go-gpt4all-j.cpp"
 	llama "github.com/go-skynet/go-llama.cpp"
+	"github.com/gofiber/fiber/v2"
 	"github.com/hashicorp/go-multierror"
 )
 
 const tokenizerSuffix = ".tokenizer.json"
 
-// mutex still needed, see: https://github.com/ggerganov/llama.cpp/discussions/784
-var mutexMap sync.Mutex
-var mutexes map[string]*sync.Mutex = make(map[string]*sync.Mutex)
+// BackendFunc loads a model file with a backend
+type BackendFunc func(loader *model.ModelLoader, modelFile string, llamaOpts []llama.ModelOption, threads uint32) (interface{}, error)
 
-var loadedModels map[string]interface{} = map[string]interface{}{}
-var muModels sync.Mutex
-
-func backendLoader(backendString string, loader *model.ModelLoader, modelFile string, llamaOpts []llama.ModelOption, threads uint32) (model interface{}, err error) {
-	switch strings.ToLower(backendString) {
-	case "llama":
+// backends holds the built-in backends the configs can select by name, see
+// WithBackend for the ones of an app
+var backends = map[string]BackendFunc{
+	"llama": func(loader *model.ModelLoader, modelFile string, llamaOpts []llama.ModelOption, threads uint32) (interface{}, error) {
 		return loader.LoadLLaMAModel(modelFile, llamaOpts...)
-	case "stablelm":
+	},
+	"stablelm": func(loader *model.ModelLoader, modelFile string, llamaOpts []llama.ModelOption, threads uint32) (interface{}, error) {
 		return loader.LoadStableLMModel(modelFile)
-	case "gpt2":
+	},
+	"gpt2": func(loader *model.ModelLoader, modelFile string, llamaOpts []llama.ModelOption, threads uint32) (interface{}, error) {
 		return loader.LoadGPT2Model(modelFile)
-	case "gptj":
+	},
+	"gptj": func(loader *model.ModelLoader, modelFile string, llamaOpts []llama.ModelOption, threads uint32) (interface{}, error) {
 		return loader.LoadGPTJModel(modelFile)
-	case "rwkv":
-		return loader.LoadRWKV(modelFile, modelFile+tokenizerSuffix, threads)
-	default:
-		return nil, fmt.Errorf("backend unsupported: %s", backendString)
+	},
+	"rwkv": func(loader *model.ModelLoader, modelFile string, llamaOpts []llama.ModelOption, threads uint32) (interface{}, error) {
+		return loader.LoadRWKV(modelFile, loader.ModelFile(modelFile)+tokenizerSuffix, threads)
+	},
+	"whisper": func(loader *model.ModelLoader, modelFile string, llamaOpts []llama.ModelOption, threads uint32) (interface{}, error) {
+		return loader.LoadWhisperModel(modelFile)
+	},
+}
+
+// backendNames returns the names of the backends, sorted
+func backendNames(backends map[string]BackendFunc) []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
 
-func greedyLoader(loader *model.ModelLoader, modelFile string, llamaOpts []llama.ModelOption, threads uint32) (model interface{}, err error) {
-	updateModels := func(model interface{}) {
-		muModels.Lock()
-		defer muModels.Unlock()
-		loadedModels[modelFile] = model
+func backendLoader(backends map[string]BackendFunc, backendString string, loader *model.ModelLoader, modelFile string, llamaOpts []llama.ModelOption, threads uint32) (model interface{}, err error) {
+	load, ok := backends[strings.ToLower(backendString)]
+	if !ok {
+		return nil, fmt.Errorf("backend unsupported: %s, available backends: %s", backendString, strings.Join(backendNames(backends), ", "))
 	}
+	return load(loader, modelFile, llamaOpts, threads)
+}
 
-	muModels.Lock()
-	m, exists := loadedModels[modelFile]
-	if exists {
-		muModels.Unlock()
+func greedyLoader(loader *model.ModelLoader, modelFile string, llamaOpts []llama.ModelOption, threads uint32) (model interface{}, err error) {
+	// the model was already loaded by one of the backends
+	if m, exists := loader.LoadedModel(modelFile); exists {
 		return m, nil
 	}
-	muModels.Unlock()
 
 	model, modelerr := loader.LoadLLaMAModel(modelFile, llamaOpts...)
 	if modelerr == nil {
-		updateModels(model)
 		return model, nil
 	} else {
 		err = multierror.Append(err, modelerr)
@@ -65,7 +79,6 @@ func greedyLoader(loader *model.ModelLoader, modelFile string, llamaOpts []llama
 
 	model, modelerr = loader.LoadGPTJModel(modelFile)
 	if modelerr == nil {
-		updateModels(model)
 		return model, nil
 	} else {
 		err = multierror.Append(err, modelerr)
@@ -73,7 +86,6 @@ func greedyLoader(loader *model.ModelLoader, modelFile string, llamaOpts []llama
 
 	model, modelerr = loader.LoadGPT2Model(modelFile)
 	if modelerr == nil {
-		updateModels(model)
 		return model, nil
 	} else {
 		err = multierror.Append(err, modelerr)
@@ -81,15 +93,13 @@ func greedyLoader(loader *model.ModelLoader, modelFile string, llamaOpts []llama
 
 	model, modelerr = loader.LoadStableLMModel(modelFile)
 	if modelerr == nil {
-		updateModels(model)
 		return model, nil
 	} else {
 		err = multierror.Append(err, modelerr)
 	}
 
-	model, modelerr = loader.LoadRWKV(modelFile, modelFile+tokenizerSuffix, threads)
+	model, modelerr = loader.LoadRWKV(modelFile, loader.ModelFile(modelFile)+tokenizerSuffix, threads)
 	if modelerr == nil {
-		updateModels(model)
 		return model, nil
 	} else {
 		err = multierror.Append(err, modelerr)
@@ -98,11 +108,21 @@ func greedyLoader(loader *model.ModelLoader, modelFile string, llamaOpts []llama
 	return nil, fmt.Errorf("could not load model - all backends returned error: %s", err.Error())
 }
 
-func ModelInference(s string, loader *model.ModelLoader, c Config, tokenCallback func(string) bool) (func() (string, error), error) {
-	supportStreams := false
-	modelFile := c.Model
+// loadModel loads the model referenced by the config, either with the backend
+// specified in the config or by trying all the backends in turn.
+func loadModel(loader *model.ModelLoader, c Config) (interface{}, error) {
+	return loadReplica(loader, c, c.Model)
+}
+
+// loadReplica loads the replica name of the model referenced by the config,
+// see ModelLoader.Replica, as loadModel loads the model.
+func loadReplica(loader *model.ModelLoader, c Config, name string) (interface{}, error) {
+	if c.DownloadURL != "" && !loader.ExistsInModelPath(c.Model) {
+		if err := loader.DownloadModel(c.Model, c.DownloadURL, c.SHA256); err != nil {
+			return nil, err
+		}
+	}
 
-	// Try to load the model
 	llamaOpts := []llama.ModelOption{}
 	if c.ContextSize != 0 {
 		llamaOpts = append(llamaOpts, llama.SetContext(c.ContextSize))
@@ -110,37 +130,450 @@ func ModelInference(s string, loader *model.ModelLoader, c Config, tokenCallback
 	if c.F16 {
 		llamaOpts = append(llamaOpts, llama.EnableF16Memory)
 	}
+	if c.MLock {
+		llamaOpts = append(llamaOpts, llama.EnableMLock)
+	}
+
+	return loader.RetryLoad(c.Model, func() (interface{}, error) {
+		if c.Backend == "" {
+			return greedyLoader(loader, name, llamaOpts, uint32(c.Threads))
+		}
+		return backendLoader(c.availableBackends(), c.Backend, loader, name, llamaOpts, uint32(c.Threads))
+	})
+}
+
+// preloadModels loads the models ahead of the first request, so it doesn't
+// pay for the loading time. "all" preloads all the configured models.
+func preloadModels(cm *ConfigMerger, o *Option, names []string) error {
+	if len(names) == 1 && names[0] == "all" {
+		names = cm.List()
+	}
 
-	var inferenceModel interface{}
 	var err error
-	if c.Backend == "" {
-		inferenceModel, err = greedyLoader(loader, modelFile, llamaOpts, uint32(c.Threads))
-	} else {
-		inferenceModel, err = backendLoader(c.Backend, loader, modelFile, llamaOpts, uint32(c.Threads))
+	for _, name := range names {
+		config, cerr := modelConfig(cm, o, name)
+		if cerr == nil && config.disabled() {
+			o.logger.Info().Msgf("Skipping the preload of the disabled model %s", name)
+			continue
+		}
+		if cerr == nil {
+			_, cerr = loadModel(o.loader, *config)
+		}
+		if cerr != nil {
+			err = multierror.Append(err, fmt.Errorf("failed preloading model %s: %w", name, cerr))
+			continue
+		}
+		o.logger.Info().Msgf("Preloaded model %s", name)
+	}
+
+	return err
+}
+
+// llamaModel is implemented by the llama backend, which streams the tokens of
+// its predictions to the callback set before them.
+type llamaModel interface {
+	Predict(text string, opts ...llama.PredictOption) (string, error)
+	SetTokenCallback(callback func(token string) bool)
+}
+
+// ModelTokenize returns the ids of the tokens of the text for the model. The
+// ids are nil for the backends which don't expose their tokenizer, and the
+// count is estimated. The model is never loaded to tokenize the text, see
+// modelTokenizer. The tokens are memoized with prompt_cache, see promptCache.
+func ModelTokenize(s string, loader *model.ModelLoader, c Config) (tokens []int, count int, err error) {
+	if c.PromptCache {
+		if tokens, ok := prompts.get(c.Model, s); ok {
+			return tokens, len(tokens), nil
+		}
+	}
+
+	tokenizer, err := modelTokenizer(loader, c)
+	if err != nil {
+		return nil, 0, err
+	}
+	if tokenizer == nil {
+		return nil, estimateTokens(s), nil
+	}
+
+	encoded, err := tokenizer.Encode(s)
+	if err != nil {
+		return nil, 0, err
+	}
+	tokens = []int{}
+	for _, t := range encoded {
+		tokens = append(tokens, t.ID)
+	}
+	if c.PromptCache {
+		prompts.add(c.Model, s, tokens, c.PromptCacheSize)
+	}
+
+	return tokens, len(tokens), nil
+}
+
+// modelTokenizer returns the tokenizer of the model, the one of rwkv being
+// the only one exposed by the backends. It is the one of the model when
+// already loaded, or else the one of its tokenizer file, read alone. It is nil
+// for the other backends.
+func modelTokenizer(loader *model.ModelLoader, c Config) (*rwkv.Tokenizer, error) {
+	if m, loaded := loader.LoadedModel(c.Model); loaded {
+		if state, ok := m.(*rwkv.RwkvState); ok {
+			return state.Tokenizer, nil
+		}
+		return nil, nil
+	}
+	if strings.ToLower(c.Backend) != "rwkv" {
+		return nil, nil
+	}
+	return loader.LoadRWKVTokenizer(c.Model + tokenizerSuffix)
+}
+
+// TokenUsage holds the number of tokens consumed by a prediction, and the time
+// taken to evaluate the prompt and to generate the completion. The prompt is
+// timed by the backends streaming their tokens only.
+type TokenUsage struct {
+	Prompt     int
+	Completion int
+
+	PromptDuration     time.Duration
+	CompletionDuration time.Duration
+}
+
+// add adds the tokens and durations of another prediction
+func (u *TokenUsage) add(o TokenUsage) {
+	u.Prompt += o.Prompt
+	u.Completion += o.Completion
+	u.PromptDuration += o.PromptDuration
+	u.CompletionDuration += o.CompletionDuration
+}
+
+// LLMResponse is the result of a single prediction
+type LLMResponse struct {
+	Response string
+	Usage    TokenUsage
+	// FinishReason is "length" when the prediction reached the maximum
+	// number of tokens, "stop" otherwise
+	FinishReason string
+}
+
+// finishReason tells whether a prediction of completionTokens stopped on its
+// own or on a stopword ("stop"), or was cut at max_tokens ("length"). The
+// backends don't report it, so it's derived from the number of tokens, when
+// they were counted rather than estimated.
+func finishReason(c Config, completionTokens int, estimated bool) string {
+	if !estimated && c.Maxtokens > 0 && completionTokens >= c.Maxtokens {
+		return "length"
+	}
+	return "stop"
+}
+
+// estimateTokens approximates the number of tokens of a text, for the backends
+// which don't expose their tokenizer. It follows the usual rule of thumb of ~4
+// characters per token for english text.
+func estimateTokens(s string) int {
+	if s == "" {
+		return 0
+	}
+	return (len(s) + 3) / 4
+}
+
+// maxTokens returns the maximum number of tokens to predict for a prompt of
+// promptTokens. max_tokens -1 predicts until the end of the text or until the
+// context is full, leaving room for at least one token.
+func maxTokens(c Config, promptTokens int) int {
+	if c.Maxtokens >= 0 {
+		return c.Maxtokens
+	}
+	left := c.ContextSize - promptTokens
+	if left < 1 {
+		return 1
+	}
+	return left
+}
+
+// llamaPredictOptions returns the llama prediction options for the config
+func llamaPredictOptions(c Config) []llama.PredictOption {
+	predictOptions := []llama.PredictOption{
+		llama.SetTemperature(c.Temperature),
+		llama.SetTopP(c.TopP),
+		llama.SetTopK(c.TopK),
+		llama.SetTokens(c.Maxtokens),
+		llama.SetThreads(c.Threads),
+	}
+
+	if c.Debug {
+		predictOptions = append(predictOptions, llama.Debug)
+	}
+
+	predictOptions = append(predictOptions, llama.SetStopWords(c.StopWords...))
+
+	if c.RepeatPenalty != 0 {
+		predictOptions = append(predictOptions, llama.SetPenalty(c.RepeatPenalty))
+	}
+
+	if c.FrequencyPenalty != 0 {
+		predictOptions = append(predictOptions, llama.SetFrequencyPenalty(c.FrequencyPenalty))
+	}
+
+	if c.PresencePenalty != 0 {
+		predictOptions = append(predictOptions, llama.SetPresencePenalty(c.PresencePenalty))
+	}
+
+	if c.Keep != 0 {
+		predictOptions = append(predictOptions, llama.SetNKeep(c.Keep))
+	}
+
+	if c.TFSZ != 0 {
+		predictOptions = append(predictOptions, llama.SetTailFreeSamplingZ(c.TFSZ))
+	}
+
+	if c.TypicalP != 0 {
+		predictOptions = append(predictOptions, llama.SetTypicalP(c.TypicalP))
+	}
+
+	if c.Mirostat != 0 {
+		predictOptions = append(predictOptions, llama.SetMirostat(c.Mirostat))
+	}
+
+	if c.MirostatTau != 0 {
+		predictOptions = append(predictOptions, llama.SetMirostatTAU(c.MirostatTau))
+	}
+
+	if c.MirostatEta != 0 {
+		predictOptions = append(predictOptions, llama.SetMirostatETA(c.MirostatEta))
+	}
+
+	if c.Batch != 0 {
+		predictOptions = append(predictOptions, llama.SetBatch(c.Batch))
+	}
+
+	if c.F16 {
+		predictOptions = append(predictOptions, llama.EnableF16KV)
+	}
+
+	if c.IgnoreEOS {
+		predictOptions = append(predictOptions, llama.IgnoreEOS)
+	}
+
+	if c.Seed != nil {
+		predictOptions = append(predictOptions, llama.SetSeed(*c.Seed))
+	}
+
+	for name, value := range c.Extra {
+		if extra, known := extraParameters[name]; known {
+			if option, err := extra(value); err == nil {
+				predictOptions = append(predictOptions, option)
+			}
+		}
+	}
+
+	// the bindings take a single bias, as "<token id><sign><bias>", the
+	// others are rejected by validateLogitBias
+	for token, bias := range c.LogitBias {
+		sign := '+'
+		if bias < 0 {
+			sign, bias = '-', -bias
+		}
+		predictOptions = append(predictOptions, llama.SetLogitBias(fmt.Sprintf("%s%c%g", token, sign, bias)))
+	}
+
+	return predictOptions
+}
+
+func ModelInference(ctx context.Context, s string, loader *model.ModelLoader, c Config, tokenCallback func(string) bool) (func() (LLMResponse, error), error) {
+	modelFile := c.Model
+
+	// Try to load the model
+	inferenceModel, err := loadModel(loader, c)
+	if err != nil {
+		return nil, err
+	}
+
+	// The prompt is tokenized by the model when it exposes its tokenizer
+	promptTokenCount, _ := promptTokens(loader, &c, s)
+	c.Maxtokens = maxTokens(c, promptTokenCount)
+
+	// The logit biases are applied by the llama backend only
+	if _, ok := inferenceModel.(llamaModel); !ok && len(c.LogitBias) > 0 {
+		return nil, invalidParam("logit_bias", "the backend of model %s does not support logit_bias", modelFile)
+	}
+
+	// The logprobs are scored by the models exposing their logits
+	if _, ok := logitsModelOf(inferenceModel, ""); !ok && c.LogProbs != nil {
+		return nil, invalidParam("logprobs", "the backend of model %s does not report logprobs, only rwkv does", modelFile)
+	}
+
+	if _, ok := inferenceModel.(llamaModel); !ok && len(c.Extra) > 0 {
+		configLogger(&c).Debug().Msgf("The backend of model %s ignores the extra parameters", modelFile)
+	}
+
+	if _, _, err := predictor(ctx, inferenceModel, s, c); err != nil {
+		return nil, err
+	}
+
+	return func() (resp LLMResponse, err error) {
+		err = withReplica(ctx, loader, c, inferenceModel, func(m interface{}) error {
+			resp, err = predict(ctx, m, s, c, promptTokenCount, tokenCallback)
+			return err
+		})
+		return resp, err
+	}, nil
+}
+
+// ModelEmbedding returns the embedding of the text for the model, and the
+// number of its tokens, see logitsModel. It is computed on one of the
+// replicas of the model, as the predictions are.
+func ModelEmbedding(ctx context.Context, s string, loader *model.ModelLoader, c Config) ([]float32, int, error) {
+	inferenceModel, err := loadModel(loader, c)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, ok := logitsModelOf(inferenceModel, ""); !ok {
+		return nil, 0, fiber.NewError(fiber.StatusNotImplemented, fmt.Sprintf("the backend of model %s does not compute embeddings, only rwkv does", c.Model))
 	}
+
+	var e []float32
+	var tokens int
+	err = withReplica(ctx, loader, c, inferenceModel, func(m interface{}) error {
+		e, tokens, err = embedding(ctx, replicaLogits(loader, c, m), s)
+		return err
+	})
+	return e, tokens, err
+}
+
+// ModelLogprobs returns the logprobs of the tokens of the completion following
+// the prompt for the model, with the c.LogProbs most likely tokens at each
+// position, preceded by the ones of the prompt with c.Echo, see scoreTokens. They are scored on one of the replicas of the
+// model, as the predictions are.
+func ModelLogprobs(ctx context.Context, prompt, completion string, loader *model.ModelLoader, c Config) (*Logprobs, error) {
+	inferenceModel, err := loadModel(loader, c)
 	if err != nil {
 		return nil, err
 	}
+	if _, ok := logitsModelOf(inferenceModel, ""); !ok {
+		return nil, invalidParam("logprobs", "the backend of model %s does not report logprobs, only rwkv does", c.Model)
+	}
 
-	var fn func() (string, error)
+	top := 0
+	if c.LogProbs != nil {
+		top = *c.LogProbs
+	}
+	var logprobs *Logprobs
+	err = withReplica(ctx, loader, c, inferenceModel, func(m interface{}) error {
+		logprobs, err = scoreTokens(ctx, replicaLogits(loader, c, m), prompt, completion, top, c.Echo)
+		return err
+	})
+	return logprobs, err
+}
 
+// replicaLogits returns the logits model of m, a replica of the model of c,
+// encoding the texts through the prompt cache with prompt_cache.
+func replicaLogits(loader *model.ModelLoader, c Config, m interface{}) logitsModel {
+	lm, _ := logitsModelOf(m, filepath.Join(loader.ModelPath, loader.ModelFile(c.Model)))
+	if c.PromptCache {
+		return cachedPromptModel{logitsModel: lm, model: c.Model, size: c.PromptCacheSize}
+	}
+	return lm
+}
+
+// withReplica runs fn with a replica of the model of the config once one is
+// free, m being the model itself. The predictions running at once on the
+// model run on its replicas, one at a time on each.
+// withReplica runs fn on one of the replicas of the model, m being the model
+// loaded for c, once it is free, see ModelLoader.AcquireReplica.
+func withReplica(ctx context.Context, loader *model.ModelLoader, c Config, m interface{}, fn func(m interface{}) error) error {
+	replica, release, err := loader.AcquireReplica(ctx, c.Model, c.replicas())
+	if err != nil {
+		return err
+	}
+	defer release()
+	releaseReplica := loader.Use(replica)
+	defer releaseReplica()
+
+	// The request may have been cancelled while waiting for the model
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if replica != c.Model {
+		if m, err = loadReplica(loader, c, replica); err != nil {
+			return err
+		}
+	}
+	return fn(m)
+}
+
+// predict runs a prediction of the prompt s, of promptTokenCount tokens, with
+// the model m, streaming its tokens to tokenCallback if not nil.
+func predict(ctx context.Context, m interface{}, s string, c Config, promptTokenCount int, tokenCallback func(string) bool) (LLMResponse, error) {
+	fn, supportStreams, err := predictor(ctx, m, s, c)
+	if err != nil {
+		return LLMResponse{}, err
+	}
+
+	start := time.Now()
+	// Count the generated tokens for the backends which stream them, the
+	// prompt being evaluated until the first one
+	completionTokens := 0
+	var firstToken time.Time
+	res, err := fn(func(token string) bool {
+		// stop the generation on the backends which support it
+		if ctx.Err() != nil {
+			return false
+		}
+		if completionTokens == 0 {
+			firstToken = time.Now()
+		}
+		completionTokens++
+		if tokenCallback != nil {
+			return tokenCallback(token)
+		}
+		return true
+	})
+	if tokenCallback != nil && !supportStreams {
+		tokenCallback(res)
+	}
+	if !supportStreams {
+		completionTokens = estimateTokens(res)
+		firstToken = time.Time{}
+	}
+	tokenUsage := TokenUsage{
+		Prompt:             promptTokenCount,
+		Completion:         completionTokens,
+		CompletionDuration: time.Since(start),
+	}
+	if !firstToken.IsZero() {
+		tokenUsage.PromptDuration = firstToken.Sub(start)
+		tokenUsage.CompletionDuration = time.Since(firstToken)
+	}
+
+	return LLMResponse{
+		Response:     res,
+		Usage:        tokenUsage,
+		FinishReason: finishReason(c, completionTokens, !supportStreams),
+	}, err
+}
+
+// predictor returns the function predicting the text of the prompt s with the
+// model, given the callback to call for each token on the backends which
+// support streaming, as told by supportStreams.
+func predictor(ctx context.Context, inferenceModel interface{}, s string, c Config) (fn func(streamCallback func(string) bool) (string, error), supportStreams bool, err error) {
 	switch model := inferenceModel.(type) {
 	case *rwkv.RwkvState:
 		supportStreams = true
 
-		fn = func() (string, error) {
+		fn = func(streamCallback func(string) bool) (string, error) {
 			//model.ProcessInput("You are a chatbot that is very good at chatting.  blah blah blah")
 			stopWord := "\n"
 			if len(c.StopWords) > 0 {
 				stopWord = c.StopWords[0]
 			}
 
-			response := model.GenerateResponse(c.Maxtokens, stopWord, float32(c.Temperature), float32(c.TopP), tokenCallback)
+			response := model.GenerateResponse(c.Maxtokens, stopWord, float32(c.Temperature), float32(c.TopP), streamCallback)
 
 			return response, nil
 		}
 	case *gpt2.StableLM:
-		fn = func() (string, error) {
+		fn = func(func(string) bool) (string, error) {
 			// Generate the prediction using the language model
 			predictOptions := []gpt2.PredictOption{
 				gpt2.SetTemperature(c.Temperature),
@@ -154,8 +587,8 @@ func ModelInference(s string, loader *model.ModelLoader, c Config, tokenCallback
 				predictOptions = append(predictOptions, gpt2.SetBatch(c.Batch))
 			}
 
-			if c.Seed != 0 {
-				predictOptions = append(predictOptions, gpt2.SetSeed(c.Seed))
+			if c.Seed != nil {
+				predictOptions = append(predictOptions, gpt2.SetSeed(*c.Seed))
 			}
 
 			return model.Predict(
@@ -164,7 +597,7 @@ func ModelInference(s string, loader *model.ModelLoader, c Config, tokenCallback
 			)
 		}
 	case *gpt2.GPT2:
-		fn = func() (string, error) {
+		fn = func(func(string) bool) (string, error) {
 			// Generate the prediction using the language model
 			predictOptions := []gpt2.PredictOption{
 				gpt2.SetTemperature(c.Temperature),
@@ -178,8 +611,8 @@ func ModelInference(s string, loader *model.ModelLoader, c Config, tokenCallback
 				predictOptions = append(predictOptions, gpt2.SetBatch(c.Batch))
 			}
 
-			if c.Seed != 0 {
-				predictOptions = append(predictOptions, gpt2.SetSeed(c.Seed))
+			if c.Seed != nil {
+				predictOptions = append(predictOptions, gpt2.SetSeed(*c.Seed))
 			}
 
 			return model.Predict(
@@ -188,7 +621,7 @@ func ModelInference(s string, loader *model.ModelLoader, c Config, tokenCallback
 			)
 		}
 	case *gptj.GPTJ:
-		fn = func() (string, error) {
+		fn = func(func(string) bool) (string, error) {
 			// Generate the prediction using the language model
 			predictOptions := []gptj.PredictOption{
 				gptj.SetTemperature(c.Temperature),
@@ -202,8 +635,8 @@ func ModelInference(s string, loader *model.ModelLoader, c Config, tokenCallback
 				predictOptions = append(predictOptions, gptj.SetBatch(c.Batch))
 			}
 
-			if c.Seed != 0 {
-				predictOptions = append(predictOptions, gptj.SetSeed(c.Seed))
+			if c.Seed != nil {
+				predictOptions = append(predictOptions, gptj.SetSeed(*c.Seed))
 			}
 
 			return model.Predict(
@@ -211,83 +644,43 @@ func ModelInference(s string, loader *model.ModelLoader, c Config, tokenCallback
 				predictOptions...,
 			)
 		}
-	case *llama.LLama:
+	case llamaModel:
 		supportStreams = true
-		fn = func() (string, error) {
-
-			if tokenCallback != nil {
-				model.SetTokenCallback(tokenCallback)
-			}
+		fn = func(streamCallback func(string) bool) (string, error) {
+			model.SetTokenCallback(streamCallback)
 
 			// Generate the prediction using the language model
-			predictOptions := []llama.PredictOption{
-				llama.SetTemperature(c.Temperature),
-				llama.SetTopP(c.TopP),
-				llama.SetTopK(c.TopK),
-				llama.SetTokens(c.Maxtokens),
-				llama.SetThreads(c.Threads),
-			}
-
-			if c.Debug {
-				predictOptions = append(predictOptions, llama.Debug)
-			}
-
-			predictOptions = append(predictOptions, llama.SetStopWords(c.StopWords...))
-
-			if c.RepeatPenalty != 0 {
-				predictOptions = append(predictOptions, llama.SetPenalty(c.RepeatPenalty))
-			}
-
-			if c.Keep != 0 {
-				predictOptions = append(predictOptions, llama.SetNKeep(c.Keep))
-			}
-
-			if c.Batch != 0 {
-				predictOptions = append(predictOptions, llama.SetBatch(c.Batch))
-			}
-
-			if c.F16 {
-				predictOptions = append(predictOptions, llama.EnableF16KV)
-			}
-
-			if c.IgnoreEOS {
-				predictOptions = append(predictOptions, llama.IgnoreEOS)
-			}
-
-			if c.Seed != 0 {
-				predictOptions = append(predictOptions, llama.SetSeed(c.Seed))
-			}
-
 			return model.Predict(
 				s,
-				predictOptions...,
+				llamaPredictOptions(c)...,
 			)
 		}
+	default:
+		return nil, false, fmt.Errorf("the backend of model %s does not support text generation", c.Model)
 	}
 
-	return func() (string, error) {
-		// This is still needed, see: https://github.com/ggerganov/llama.cpp/discussions/784
-		mutexMap.Lock()
-		l, ok := mutexes[modelFile]
-		if !ok {
-			m := &sync.Mutex{}
-			mutexes[modelFile] = m
-			l = m
+	// The JSON object is extracted from the prediction once generated, so it
+	// can't be streamed token by token
+	if c.ResponseFormat.Type == jsonObjectFormat {
+		supportStreams = false
+		predict := fn
+		fn = func(func(string) bool) (string, error) {
+			res, err := predict(func(string) bool {
+				return ctx.Err() == nil
+			})
+			if err != nil {
+				return "", err
+			}
+			return jsonObject(res)
 		}
-		mutexMap.Unlock()
-		l.Lock()
-		defer l.Unlock()
+	}
 
-		res, err := fn()
-		if tokenCallback != nil && !supportStreams {
-			tokenCallback(res)
-		}
-		return res, err
-	}, nil
+	return fn, supportStreams, nil
 }
 
-func ComputeChoices(predInput string, input *OpenAIRequest, config *Config, loader *model.ModelLoader, cb func(string, *[]Choice), tokenCallback func(string) bool) ([]Choice, error) {
+func ComputeChoices(ctx context.Context, predInput string, input *OpenAIRequest, config *Config, loader *model.ModelLoader, cb func(string, *[]Choice), tokenCallback func(string) bool) ([]Choice, TokenUsage, error) {
 	result := []Choice{}
+	tokenUsage := TokenUsage{}
 
 	n := input.N
 
@@ -295,43 +688,155 @@ func ComputeChoices(predInput string, input *OpenAIRequest, config *Config, load
 		n = 1
 	}
 
+	if err := ctx.Err(); err != nil {
+		return result, tokenUsage, err
+	}
+
+	// Keep the model loaded while computing the choices
+	release := loader.Use(config.Model)
+	defer release()
+
 	// get the model function to call for the result
-	predFunc, err := ModelInference(predInput, loader, *config, tokenCallback)
+	predFunc, err := ModelInference(ctx, predInput, loader, *config, tokenCallback)
 	if err != nil {
-		return result, err
+		return result, tokenUsage, err
 	}
 
+	// Streamed tokens can't be interleaved, so predictions are computed
+	// concurrently only when not streaming
+	workers := config.Parallel
+	if workers < 1 || tokenCallback != nil || config.serialized() {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	start := time.Now()
+	predictions := make([]LLMResponse, n)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				prediction, predErr := predFunc()
+				if predErr != nil {
+					errMu.Lock()
+					err = multierror.Append(err, predErr)
+					errMu.Unlock()
+					continue
+				}
+				predictions[i] = prediction
+			}
+		}()
+	}
+
+	// Stop scheduling predictions once the request is cancelled
+feed:
 	for i := 0; i < n; i++ {
-		prediction, err := predFunc()
-		if err != nil {
-			return result, err
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
 		}
+	}
+	close(jobs)
+	wg.Wait()
 
-		prediction = Finetune(*config, predInput, prediction)
-		cb(prediction, &result)
-
-		//result = append(result, Choice{Text: prediction})
+	// a cancelled or timed out context is reported over the errors of the
+	// predictions it interrupted
+	if err := ctx.Err(); err != nil {
+		return result, tokenUsage, err
+	}
+	if err != nil {
+		return result, tokenUsage, err
+	}
 
+	for _, prediction := range predictions {
+		// the prompt is evaluated once for all the choices
+		tokenUsage.Prompt = prediction.Usage.Prompt
+		tokenUsage.PromptDuration = prediction.Usage.PromptDuration
+		tokenUsage.Completion += prediction.Usage.Completion
+		tokenUsage.CompletionDuration += prediction.Usage.CompletionDuration
+
+		finetunedResponse := Finetune(*config, predInput, prediction.Response)
+		cb(finetunedResponse, &result)
+		if len(result) == 0 {
+			continue
+		}
+		result[len(result)-1].FinishReason = prediction.FinishReason
+
+		// the echoed prompt is scored along the completion
+		if config.LogProbs != nil {
+			completion := *config
+			completion.Echo = false
+			logprobs, err := ModelLogprobs(ctx, predInput, Finetune(completion, predInput, prediction.Response), loader, *config)
+			if err != nil {
+				return result, tokenUsage, err
+			}
+			result[len(result)-1].Logprobs = logprobs
+		}
 	}
-	return result, err
+
+	inferenceDuration.WithLabelValues(config.Model).Observe(time.Since(start).Seconds())
+	generatedTokens.WithLabelValues(config.Model).Add(float64(tokenUsage.Completion))
+
+	return result, tokenUsage, nil
 }
 
-var cutstrings map[string]*regexp.Regexp = make(map[string]*regexp.Regexp)
-var mu sync.Mutex = sync.Mutex{}
+// ComputeBestChoices computes the best_of choices of the prompt and returns
+// the n of them with the highest cumulative logprob, the best first. The
+// choices are ranked by their logprobs, so the backend must expose its
+// logits, and they are returned only when the request asks for them.
+func ComputeBestChoices(ctx context.Context, predInput string, input *OpenAIRequest, config *Config, loader *model.ModelLoader, cb func(string, *[]Choice)) ([]Choice, TokenUsage, error) {
+	inferenceModel, err := loadModel(loader, *config)
+	if err != nil {
+		return nil, TokenUsage{}, err
+	}
+	if _, ok := logitsModelOf(inferenceModel, ""); !ok {
+		return nil, TokenUsage{}, invalidParam("best_of", "the backend of model %s does not support best_of, which ranks the choices by their logprobs, only rwkv does", config.Model)
+	}
+
+	candidates := *input
+	candidates.N = input.BestOf
+	ranked := *config
+	if ranked.LogProbs == nil {
+		none := 0
+		ranked.LogProbs = &none
+	}
+	choices, tokenUsage, err := ComputeChoices(ctx, predInput, &candidates, &ranked, loader, cb, nil)
+	if err != nil {
+		return choices, tokenUsage, err
+	}
+
+	sort.SliceStable(choices, func(i, j int) bool {
+		return choices[i].Logprobs.sum() > choices[j].Logprobs.sum()
+	})
+	n := input.N
+	if n == 0 {
+		n = 1
+	}
+	if len(choices) > n {
+		choices = choices[:n]
+	}
+	if config.LogProbs == nil {
+		for i := range choices {
+			choices[i].Logprobs = nil
+		}
+	}
+	return choices, tokenUsage, nil
+}
 
 func Finetune(config Config, input, prediction string) string {
 	if config.Echo {
 		prediction = input + prediction
 	}
 
-	for _, c := range config.Cutstrings {
-		mu.Lock()
-		reg, ok := cutstrings[c]
-		if !ok {
-			cutstrings[c] = regexp.MustCompile(c)
-			reg = cutstrings[c]
-		}
-		mu.Unlock()
+	for _, reg := range config.cutstrings {
 		prediction = reg.ReplaceAllString(prediction, "")
 	}
 
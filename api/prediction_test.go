@@ -0,0 +1,279 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	llama "github.com/go-skynet/go-llama.cpp"
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Predictions", func() {
+	Context("cancellation", func() {
+		It("does not start when the request is already cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			config := &Config{OpenAIRequest: defaultRequest("foo")}
+			_, _, err := ComputeChoices(ctx, "prompt", &OpenAIRequest{}, config, model.NewModelLoader(GinkgoT().TempDir()), func(string, *[]Choice) {
+				Fail("no choice expected")
+			}, nil)
+			Expect(err).To(MatchError(context.Canceled))
+		})
+		It("times out with a 504", func() {
+			config := &Config{OpenAIRequest: defaultRequest("foo")}
+			app := fiber.New(fiber.Config{ErrorHandler: func(c *fiber.Ctx, err error) error {
+				code, resp := errorResponse(err)
+				return c.Status(code).JSON(resp)
+			}})
+			app.Get("/", func(c *fiber.Ctx) error {
+				ctx, cancel := predictionContext(c, config, newOptions(WithRequestTimeout(time.Nanosecond)))
+				defer cancel()
+				<-ctx.Done()
+
+				_, _, err := ComputeChoices(ctx, "prompt", &OpenAIRequest{}, config, model.NewModelLoader(GinkgoT().TempDir()), func(string, *[]Choice) {
+					Fail("no choice expected")
+				}, nil)
+				return predictionError(err)
+			})
+
+			resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusGatewayTimeout))
+		})
+		It("is cancelled with the base context of the server", func() {
+			base, cancelBase := context.WithCancel(context.Background())
+			config := &Config{OpenAIRequest: defaultRequest("foo")}
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				ctx, cancel := predictionContext(c, config, newOptions(WithContext(base)))
+				defer cancel()
+				Expect(ctx.Err()).ToNot(HaveOccurred())
+
+				cancelBase()
+				Expect(ctx.Err()).To(MatchError(context.Canceled))
+				return nil
+			})
+
+			_, err := app.Test(httptest.NewRequest("GET", "/", nil))
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("prefers the timeout of the model config", func() {
+			config := &Config{OpenAIRequest: defaultRequest("foo"), Timeout: 60}
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				ctx, cancel := predictionContext(c, config, newOptions(WithRequestTimeout(time.Nanosecond)))
+				defer cancel()
+
+				deadline, ok := ctx.Deadline()
+				Expect(ok).To(BeTrue())
+				Expect(time.Until(deadline)).To(BeNumerically(">", 30*time.Second))
+				return nil
+			})
+
+			_, err := app.Test(httptest.NewRequest("GET", "/", nil))
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("disconnection", func() {
+		It("stops the prediction of a request whose client went away", func() {
+			started, stopped := make(chan struct{}), make(chan struct{})
+			app, _ := echoApp(map[string]string{
+				"endless.yaml": "name: endless\nbackend: endless\nparameters:\n  model: model.bin\n",
+			}, WithBackend("endless", func(*model.ModelLoader, string, []llama.ModelOption, uint32) (interface{}, error) {
+				return &endlessModel{started: started, stopped: stopped}, nil
+			}))
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			go app.Listener(ln)
+			DeferCleanup(app.Shutdown)
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			body := `{"model": "endless", "prompt": "Once upon a time"}`
+			_, err = fmt.Fprintf(conn, "POST /v1/completions HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(started).Should(BeClosed())
+			Consistently(stopped, 50*time.Millisecond).ShouldNot(BeClosed())
+			Expect(conn.Close()).To(Succeed())
+			Eventually(stopped).Should(BeClosed())
+		})
+	})
+
+	Context("parallel", func() {
+		It("runs the concurrent predictions on replicas of the model", func() {
+			app, backend := echoApp(map[string]string{
+				"echo.yaml": "name: echo\nbackend: echo\nparallel: 4\nparameters:\n  model: model.bin\n",
+			})
+			req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model": "echo", "prompt": "Once upon a time", "n": 4}`))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+			Expect(len(backend.loaded())).To(BeNumerically("<=", 4))
+			Expect(backend.loaded()).To(ContainElement("model.bin"))
+		})
+
+		It("runs the predictions on one instance of the model by default", func() {
+			app, backend := echoApp(map[string]string{
+				"echo.yaml": "name: echo\nbackend: echo\nparameters:\n  model: model.bin\n",
+			})
+			req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model": "echo", "prompt": "Once upon a time", "n": 4}`))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusOK))
+			Expect(backend.loaded()).To(HaveLen(1))
+		})
+	})
+
+	Context("tokenization", func() {
+		It("estimates the tokens without loading the model", func() {
+			loader := model.NewModelLoader(GinkgoT().TempDir())
+			tokens, count, err := ModelTokenize("Once upon a time", loader, Config{Backend: "llama", OpenAIRequest: defaultRequest("model.bin")})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tokens).To(BeNil())
+			Expect(count).To(Equal(estimateTokens("Once upon a time")))
+			Expect(loader.LoadedModels()).To(BeZero())
+		})
+		It("reads the tokenizer of rwkv without its model", func() {
+			loader := model.NewModelLoader(GinkgoT().TempDir())
+			_, _, err := ModelTokenize("Once upon a time", loader, Config{Backend: "rwkv", OpenAIRequest: defaultRequest("model.bin")})
+			Expect(err).To(MatchError(ContainSubstring("tokenizer model.bin.tokenizer.json does not exist")))
+			Expect(loader.LoadedModels()).To(BeZero())
+		})
+	})
+
+	Context("finish reason", func() {
+		It("is length when the prediction reached max_tokens", func() {
+			config := Config{OpenAIRequest: OpenAIRequest{Maxtokens: 16}}
+			Expect(finishReason(config, 16, false)).To(Equal("length"))
+			Expect(finishReason(config, 3, false)).To(Equal("stop"))
+		})
+		It("is stop when the tokens were estimated", func() {
+			config := Config{OpenAIRequest: OpenAIRequest{Maxtokens: 16}}
+			Expect(finishReason(config, 16, true)).To(Equal("stop"))
+		})
+	})
+
+	Context("timings", func() {
+		It("report the speed of the prompt and of the completion", func() {
+			t := timings(TokenUsage{Prompt: 10, Completion: 20, PromptDuration: 500 * time.Millisecond, CompletionDuration: 2 * time.Second})
+			Expect(*t).To(Equal(Timings{PromptTokens: 10, PromptMS: 500, PromptPerSecond: 20, PredictedTokens: 20, PredictedMS: 2000, PredictedPerSecond: 10}))
+
+			// the prompt isn't timed by the backends which don't stream
+			t = timings(TokenUsage{Prompt: 10, Completion: 20, CompletionDuration: 2 * time.Second})
+			Expect(t.PromptPerSecond).To(BeZero())
+		})
+	})
+
+	Context("max tokens", func() {
+		It("fill the context when -1", func() {
+			config := Config{OpenAIRequest: OpenAIRequest{Maxtokens: -1}, ContextSize: 512}
+			Expect(maxTokens(config, 2)).To(Equal(510))
+			Expect(maxTokens(config, 1024)).To(Equal(1))
+
+			config.Maxtokens = 16
+			Expect(maxTokens(config, 2)).To(Equal(16))
+		})
+	})
+
+	Context("backend options", func() {
+		It("pass n_keep through to llama", func() {
+			Expect(llama.NewPredictOptions(llamaPredictOptions(Config{OpenAIRequest: OpenAIRequest{Keep: 32}})...).NKeep).To(Equal(32))
+			Expect(llama.NewPredictOptions(llamaPredictOptions(Config{OpenAIRequest: OpenAIRequest{Keep: -1}})...).NKeep).To(Equal(-1))
+			Expect(llama.NewPredictOptions(llamaPredictOptions(Config{})...).NKeep).To(Equal(llama.DefaultOptions.NKeep))
+		})
+		It("pass tfs_z and typical_p through to llama", func() {
+			options := llama.NewPredictOptions(llamaPredictOptions(Config{OpenAIRequest: OpenAIRequest{TFSZ: 0.95, TypicalP: 0.5}})...)
+			Expect(options.TailFreeSamplingZ).To(Equal(0.95))
+			Expect(options.TypicalP).To(Equal(0.5))
+
+			options = llama.NewPredictOptions(llamaPredictOptions(Config{})...)
+			Expect(options.TailFreeSamplingZ).To(Equal(llama.DefaultOptions.TailFreeSamplingZ))
+			Expect(options.TypicalP).To(Equal(llama.DefaultOptions.TypicalP))
+		})
+		It("pass mirostat through to llama", func() {
+			options := llama.NewPredictOptions(llamaPredictOptions(Config{OpenAIRequest: OpenAIRequest{Mirostat: 2, MirostatTau: 3, MirostatEta: 0.2}})...)
+			Expect(options.Mirostat).To(Equal(2))
+			Expect(options.MirostatTAU).To(Equal(3.0))
+			Expect(options.MirostatETA).To(Equal(0.2))
+
+			options = llama.NewPredictOptions(llamaPredictOptions(Config{})...)
+			Expect(options.Mirostat).To(Equal(0))
+			Expect(options.MirostatTAU).To(Equal(llama.DefaultOptions.MirostatTAU))
+			Expect(options.MirostatETA).To(Equal(llama.DefaultOptions.MirostatETA))
+		})
+		It("pass the extra parameters through to llama", func() {
+			options := llama.NewPredictOptions(llamaPredictOptions(Config{Extra: map[string]interface{}{
+				"repeat_last_n": 128.0,
+				"penalize_nl":   true,
+				"f16_kv":        true,
+			}})...)
+			Expect(options.Repeat).To(Equal(128))
+			Expect(options.PenalizeNL).To(BeTrue())
+			Expect(options.F16KV).To(BeTrue())
+		})
+		It("pass logit_bias through to llama", func() {
+			bias := func(b map[string]float64) string {
+				return llama.NewPredictOptions(llamaPredictOptions(Config{OpenAIRequest: OpenAIRequest{LogitBias: b}})...).LogitBias
+			}
+			Expect(bias(map[string]float64{"15043": 5})).To(Equal("15043+5"))
+			Expect(bias(map[string]float64{"50256": -100})).To(Equal("50256-100"))
+			Expect(bias(map[string]float64{"2": 0.5})).To(Equal("2+0.5"))
+			Expect(bias(nil)).To(BeEmpty())
+		})
+	})
+
+	Context("preloading", func() {
+		var loader *model.ModelLoader
+
+		BeforeEach(func() {
+			loader = model.NewModelLoader(GinkgoT().TempDir())
+		})
+
+		It("reports the models which fail to load", func() {
+			err := preloadModels(NewConfigMerger(), newOptions(WithModelLoader(loader)), []string{"missing"})
+			Expect(err).To(MatchError(ContainSubstring("failed preloading model missing")))
+		})
+		It("only fails the startup when strict", func() {
+			_, err := App(WithModelLoader(loader), WithDisableMessage(true), WithPreloadModels("missing"))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = App(WithModelLoader(loader), WithDisableMessage(true), WithPreloadModels("missing"), WithPreloadStrict(true))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+// endlessModel is a backend predicting tokens until the token callback returns
+// false, or for 5 seconds, closing started once it began and stopped once it
+// stopped.
+type endlessModel struct {
+	callback         func(string) bool
+	started, stopped chan struct{}
+}
+
+func (m *endlessModel) SetTokenCallback(callback func(token string) bool) {
+	m.callback = callback
+}
+
+func (m *endlessModel) Predict(text string, opts ...llama.PredictOption) (string, error) {
+	defer close(m.stopped)
+	close(m.started)
+	start := time.Now()
+	for m.callback("token ") && time.Since(start) < 5*time.Second {
+		time.Sleep(time.Millisecond)
+	}
+	return "", nil
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// defaultPromptCacheSize is the number of prompts cached per model when the
+// config doesn't set prompt_cache_size
+const defaultPromptCacheSize = 16
+
+// promptCache memoizes the tokens of the prompts of the models configured
+// with prompt_cache, so the prompts sent again, e.g. the chat histories
+// resent on each turn, are not tokenized again. The least recently used
+// prompts of a model are dropped past the size of its cache. The backends
+// can't restore the state of a prompt, so its tokens are still evaluated.
+type promptCache struct {
+	mu sync.Mutex
+	// models holds the entries of each model, the most recently used first
+	models map[string]*list.List
+	// entries indexes the entries by key, see promptCacheKey
+	entries map[string]*list.Element
+}
+
+type promptCacheEntry struct {
+	key    string
+	tokens []int
+}
+
+// prompts is the prompt cache of the models
+var prompts = newPromptCache()
+
+func newPromptCache() *promptCache {
+	return &promptCache{
+		models:  make(map[string]*list.List),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func promptCacheKey(model, prompt string) string {
+	sum := sha256.Sum256([]byte(model + "\x00" + prompt))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns a copy of the tokens of the prompt for the model, if cached
+func (pc *promptCache) get(model, prompt string) ([]int, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	e, ok := pc.entries[promptCacheKey(model, prompt)]
+	if !ok {
+		return nil, false
+	}
+	pc.models[model].MoveToFront(e)
+	return append([]int{}, e.Value.(promptCacheEntry).tokens...), true
+}
+
+// add caches the tokens of the prompt for the model, and drops the least
+// recently used prompts of the model past size.
+func (pc *promptCache) add(model, prompt string, tokens []int, size int) {
+	if size <= 0 {
+		size = defaultPromptCacheSize
+	}
+	key := promptCacheKey(model, prompt)
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	entries, ok := pc.models[model]
+	if !ok {
+		entries = list.New()
+		pc.models[model] = entries
+	}
+	if e, ok := pc.entries[key]; ok {
+		entries.Remove(e)
+	}
+	pc.entries[key] = entries.PushFront(promptCacheEntry{key: key, tokens: append([]int{}, tokens...)})
+
+	for entries.Len() > size {
+		e := entries.Back()
+		entries.Remove(e)
+		delete(pc.entries, e.Value.(promptCacheEntry).key)
+	}
+}
+
+// cachedPromptModel is a logits model encoding its texts through the prompt
+// cache, see promptCache
+type cachedPromptModel struct {
+	logitsModel
+	model string
+	size  int
+}
+
+func (m cachedPromptModel) Encode(text string) ([]int, error) {
+	if tokens, ok := prompts.get(m.model, text); ok {
+		return tokens, nil
+	}
+	tokens, err := m.logitsModel.Encode(text)
+	if err != nil {
+		return nil, err
+	}
+	prompts.add(m.model, text, tokens, m.size)
+	return tokens, nil
+}
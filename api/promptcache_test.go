@@ -0,0 +1,60 @@
+package api
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// countingModel is the words model counting the texts it encodes
+type countingModel struct {
+	wordsModel
+	encoded int
+}
+
+func (m *countingModel) Encode(text string) ([]int, error) {
+	m.encoded++
+	return m.wordsModel.Encode(text)
+}
+
+var _ = Describe("Prompt cache", func() {
+	// cached returns the tokens of the prompt cached for the model, nil if
+	// none
+	cached := func(pc *promptCache, model, prompt string) []int {
+		tokens, _ := pc.get(model, prompt)
+		return tokens
+	}
+
+	It("drops the least recently used prompts of a model past its size", func() {
+		pc := newPromptCache()
+		pc.add("model", "a", []int{1}, 2)
+		pc.add("model", "bb", []int{2}, 2)
+		pc.add("other", "a", []int{3}, 2)
+		_, ok := pc.get("model", "a")
+		Expect(ok).To(BeTrue())
+		pc.add("model", "ccc", []int{3}, 2)
+
+		Expect(cached(pc, "model", "bb")).To(BeNil())
+		Expect(cached(pc, "model", "a")).To(Equal([]int{1}))
+		Expect(cached(pc, "model", "ccc")).To(Equal([]int{3}))
+		Expect(cached(pc, "other", "a")).To(Equal([]int{3}))
+	})
+
+	It("returns copies of the tokens", func() {
+		pc := newPromptCache()
+		tokens := []int{1, 2}
+		pc.add("model", "a bb", tokens, 0)
+		tokens[0] = 4
+
+		cached(pc, "model", "a bb")[1] = 4
+		Expect(cached(pc, "model", "a bb")).To(Equal([]int{1, 2}))
+	})
+
+	It("memoizes the tokens of the texts the models encode", func() {
+		m := &countingModel{}
+		cm := cachedPromptModel{logitsModel: m, model: "prompt-cache-test", size: 2}
+		for i := 0; i < 3; i++ {
+			Expect(cm.Encode("a bb ccc")).To(Equal([]int{1, 2, 3}))
+		}
+		Expect(m.encoded).To(Equal(1))
+	})
+})
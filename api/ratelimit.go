@@ -0,0 +1,70 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// rateLimiter throttles the requests to the models with a rate_limit in
+// their config, with a token bucket per model. The bucket of a model holds up
+// to a minute of requests, and is refilled at its rate, so bursts are served
+// as long as the model stays under its rate on average.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*bucket{}}
+}
+
+// take takes a token from the bucket of model, refilled at perMinute tokens
+// a minute, at now. When the bucket is empty it returns how long until the
+// next token, and 0 otherwise. The models without a positive rate are never
+// throttled.
+func (r *rateLimiter) take(model string, perMinute int, now time.Time) time.Duration {
+	if perMinute <= 0 {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	capacity := float64(perMinute)
+	b, ok := r.buckets[model]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		r.buckets[model] = b
+	}
+	// the rate is read from the config on each request, so the configs
+	// reloaded with another rate apply right away
+	perSecond := capacity / 60
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// checkRateLimit rejects the request with a 429 when the model of config is
+// over its rate_limit, telling in Retry-After when to retry
+func checkRateLimit(c *fiber.Ctx, o *Option, config *Config, model string) error {
+	wait := o.rateLimiter.take(model, config.RateLimit, time.Now())
+	if wait <= 0 {
+		return nil
+	}
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return fiber.NewError(fiber.StatusTooManyRequests, fmt.Sprintf("The model '%s' is limited to %d requests per minute, retry later", model, config.RateLimit))
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rate limit", func() {
+	It("serves a minute of requests at once, then refills at the rate", func() {
+		r := newRateLimiter()
+		now := time.Now()
+		for i := 0; i < 2; i++ {
+			Expect(r.take("model", 2, now)).To(BeZero())
+		}
+		Expect(r.take("model", 2, now)).To(Equal(30 * time.Second))
+		Expect(r.take("model", 2, now.Add(20*time.Second))).To(Equal(10 * time.Second))
+		Expect(r.take("model", 2, now.Add(30*time.Second))).To(BeZero())
+		// the models have a bucket each
+		Expect(r.take("other", 2, now)).To(BeZero())
+	})
+	It("doesn't throttle the models without a limit", func() {
+		r := newRateLimiter()
+		for i := 0; i < 100; i++ {
+			Expect(r.take("model", 0, time.Now())).To(BeZero())
+		}
+	})
+
+	Context("routes", func() {
+		var app *fiber.App
+
+		BeforeEach(func() {
+			app, _ = echoApp(map[string]string{
+				"limited.yaml": "name: limited\nbackend: echo\nrate_limit: 1\naliases: [alias]\nparameters:\n  model: model.bin\n",
+				"echo.yaml":    "name: echo\nbackend: echo\nparameters:\n  model: model.bin\n",
+			})
+		})
+
+		post := func(model string) *http.Response {
+			req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model": "`+model+`", "prompt": "Hi"}`))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			return resp
+		}
+
+		It("reject the requests past the limit of the model with a 429", func() {
+			Expect(post("limited").StatusCode).To(Equal(fiber.StatusOK))
+			resp := post("alias")
+			Expect(resp.StatusCode).To(Equal(fiber.StatusTooManyRequests))
+			Expect(resp.Header.Get(fiber.HeaderRetryAfter)).To(Equal("60"))
+
+			// the other models are not throttled
+			for i := 0; i < 3; i++ {
+				Expect(post("echo").StatusCode).To(Equal(fiber.StatusOK))
+			}
+		})
+	})
+})
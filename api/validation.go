@@ -0,0 +1,92 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// paramError is an invalid parameter of a request. It is replied with a 400
+// naming the parameter, as OpenAI does.
+type paramError struct {
+	param   string
+	message string
+}
+
+func (e *paramError) Error() string {
+	return e.message
+}
+
+// noGrammar and noGPU are why the grammars and the GPU settings are
+// unsupported
+const (
+	noGrammar = "none of its backends constrains the predictions to a grammar"
+	noGPU     = "its llama.cpp bindings don't offload the models to GPUs"
+)
+
+func invalidParam(param, format string, a ...interface{}) error {
+	return &paramError{param: param, message: fmt.Sprintf(format, a...)}
+}
+
+// validateRequest rejects the parameters out of the ranges OpenAI accepts, and
+// the combinations of parameters which don't make sense.
+func validateRequest(input *OpenAIRequest) error {
+	switch {
+	case input.N < 0:
+		return invalidParam("n", "n must be at least 1, got %d", input.N)
+	case input.Temperature < 0 || input.Temperature > 2:
+		return invalidParam("temperature", "temperature must be between 0 and 2, got %g", input.Temperature)
+	case input.TopP < 0 || input.TopP > 1:
+		return invalidParam("top_p", "top_p must be between 0 and 1, got %g", input.TopP)
+	case input.TopK < 0:
+		return invalidParam("top_k", "top_k must not be negative, got %d", input.TopK)
+	case input.Maxtokens < -1:
+		return invalidParam("max_tokens", "max_tokens must be -1 or more, got %d", input.Maxtokens)
+	case input.FrequencyPenalty < -2 || input.FrequencyPenalty > 2:
+		return invalidParam("frequency_penalty", "frequency_penalty must be between -2 and 2, got %g", input.FrequencyPenalty)
+	case input.PresencePenalty < -2 || input.PresencePenalty > 2:
+		return invalidParam("presence_penalty", "presence_penalty must be between -2 and 2, got %g", input.PresencePenalty)
+	case len(input.Prompt) > 0 && len(input.Messages) > 0:
+		return invalidParam("messages", "prompt and messages can't be both set")
+	case input.TFSZ < 0 || input.TFSZ > 1:
+		return invalidParam("tfs_z", "tfs_z must be between 0 and 1, got %g", input.TFSZ)
+	case input.TypicalP < 0 || input.TypicalP > 1:
+		return invalidParam("typical_p", "typical_p must be between 0 and 1, got %g", input.TypicalP)
+	case input.Mirostat < 0 || input.Mirostat > 2:
+		return invalidParam("mirostat", "mirostat must be 0, 1 or 2, got %d", input.Mirostat)
+	case input.MirostatTau < 0:
+		return invalidParam("mirostat_tau", "mirostat_tau must not be negative, got %g", input.MirostatTau)
+	case input.MirostatEta < 0:
+		return invalidParam("mirostat_eta", "mirostat_eta must not be negative, got %g", input.MirostatEta)
+	case input.LogProbs != nil && (*input.LogProbs < 0 || *input.LogProbs > 5):
+		return invalidParam("logprobs", "logprobs must be between 0 and 5, got %d", *input.LogProbs)
+	case input.BestOf < 0:
+		return invalidParam("best_of", "best_of must be at least 1, got %d", input.BestOf)
+	case input.BestOf > 0 && input.BestOf < input.N:
+		return invalidParam("best_of", "best_of must be at least n, got %d for n %d", input.BestOf, input.N)
+	case input.Stream && input.BestOf > 1:
+		return invalidParam("best_of", "best_of can't be streamed")
+	case input.Grammar != "":
+		return invalidParam("grammar", "grammar is unsupported by this build, %s", noGrammar)
+	case input.StreamOptions != nil && !input.Stream:
+		return invalidParam("stream_options", "stream_options can only be set when streaming")
+	}
+	return validateLogitBias(input.LogitBias)
+}
+
+// validateLogitBias checks that the logit biases are keyed by token id, and
+// in the range OpenAI accepts. The llama bindings take a single bias, so the
+// other ones are rejected rather than dropped.
+func validateLogitBias(bias map[string]float64) error {
+	if len(bias) > 1 {
+		return invalidParam("logit_bias", "logit_bias can hold a single bias, the backends apply one at a time, got %d", len(bias))
+	}
+	for token, b := range bias {
+		if id, err := strconv.Atoi(token); err != nil || id < 0 {
+			return invalidParam("logit_bias", "logit_bias must be keyed by token ids, got %q", token)
+		}
+		if b < -100 || b > 100 {
+			return invalidParam("logit_bias", "logit_bias must be between -100 and 100, got %g for token %s", b, token)
+		}
+	}
+	return nil
+}
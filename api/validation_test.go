@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request validation", func() {
+	var app *fiber.App
+
+	BeforeEach(func() {
+		var err error
+		app, err = App(WithModelLoader(model.NewModelLoader(GinkgoT().TempDir())), WithDisableMessage(true))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	DescribeTable("rejects the invalid parameters with a 400 naming them",
+		func(endpoint, body, param string) {
+			req := httptest.NewRequest("POST", endpoint, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(fiber.StatusBadRequest))
+
+			errResp := ErrorResponse{}
+			Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed())
+			Expect(errResp.Error.Type).To(Equal("invalid_request_error"))
+			Expect(errResp.Error.Param).ToNot(BeNil())
+			Expect(*errResp.Error.Param).To(Equal(param))
+		},
+		Entry("negative n", "/v1/completions", `{"model": "foo", "prompt": "a", "n": -1}`, "n"),
+		Entry("negative temperature", "/v1/completions", `{"model": "foo", "prompt": "a", "temperature": -0.5}`, "temperature"),
+		Entry("temperature over 2", "/v1/chat/completions", `{"model": "foo", "temperature": 3}`, "temperature"),
+		Entry("top_p over 1", "/v1/completions", `{"model": "foo", "prompt": "a", "top_p": 1.5}`, "top_p"),
+		Entry("negative top_k", "/v1/completions", `{"model": "foo", "prompt": "a", "top_k": -1}`, "top_k"),
+		Entry("max_tokens under -1", "/v1/completions", `{"model": "foo", "prompt": "a", "max_tokens": -2}`, "max_tokens"),
+		Entry("frequency_penalty out of range", "/v1/completions", `{"model": "foo", "prompt": "a", "frequency_penalty": 2.5}`, "frequency_penalty"),
+		Entry("presence_penalty out of range", "/v1/completions", `{"model": "foo", "prompt": "a", "presence_penalty": -3}`, "presence_penalty"),
+		Entry("prompt and messages", "/v1/chat/completions", `{"model": "foo", "prompt": "a", "messages": [{"role": "user", "content": "a"}]}`, "messages"),
+		Entry("logit_bias not keyed by token id", "/v1/completions", `{"model": "foo", "prompt": "a", "logit_bias": {"hello": 1}}`, "logit_bias"),
+		Entry("logit_bias out of range", "/v1/completions", `{"model": "foo", "prompt": "a", "logit_bias": {"50256": -101}}`, "logit_bias"),
+		Entry("logit_bias with several biases", "/v1/chat/completions", `{"model": "foo", "messages": [{"role": "user", "content": "a"}], "logit_bias": {"50256": -100, "15043": 5}}`, "logit_bias"),
+		Entry("stream_options without streaming", "/v1/chat/completions", `{"model": "foo", "messages": [{"role": "user", "content": "a"}], "stream_options": {"include_usage": true}}`, "stream_options"),
+		Entry("tfs_z over 1", "/v1/completions", `{"model": "foo", "prompt": "a", "tfs_z": 1.5}`, "tfs_z"),
+		Entry("negative typical_p", "/v1/chat/completions", `{"model": "foo", "messages": [{"role": "user", "content": "a"}], "typical_p": -0.1}`, "typical_p"),
+		Entry("mirostat out of range", "/v1/completions", `{"model": "foo", "prompt": "a", "mirostat": 3}`, "mirostat"),
+		Entry("logprobs over 5", "/v1/completions", `{"model": "foo", "prompt": "a", "logprobs": 6}`, "logprobs"),
+		Entry("best_of under n", "/v1/completions", `{"model": "foo", "prompt": "a", "n": 3, "best_of": 2}`, "best_of"),
+		Entry("streamed best_of", "/v1/completions", `{"model": "foo", "prompt": "a", "best_of": 2, "stream": true}`, "best_of"),
+		Entry("grammar", "/v1/chat/completions", `{"model": "foo", "messages": [{"role": "user", "content": "a"}], "grammar": "root ::= \"yes\""}`, "grammar"),
+		Entry("image_url content part", "/v1/chat/completions", `{"model": "foo", "messages": [{"role": "user", "content": [{"type": "image_url", "image_url": {"url": "https://example.com/cat.png"}}]}]}`, "messages"),
+		Entry("negative mirostat_tau", "/v1/completions", `{"model": "foo", "prompt": "a", "mirostat": 2, "mirostat_tau": -1}`, "mirostat_tau"),
+	)
+
+	Context("size limits", func() {
+		BeforeEach(func() {
+			dir := GinkgoT().TempDir()
+			Expect(os.WriteFile(filepath.Join(dir, "model.bin"), nil, 0600)).To(Succeed())
+			var err error
+			app, err = App(WithModelLoader(model.NewModelLoader(dir)), WithDisableMessage(true), WithMaxBodySize(256), WithMaxPromptTokens(8))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		post := func(endpoint, body string) (int, ErrorResponse) {
+			req := httptest.NewRequest("POST", endpoint, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			Expect(err).ToNot(HaveOccurred())
+			errResp := ErrorResponse{}
+			Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed())
+			return resp.StatusCode, errResp
+		}
+
+		It("reject the bodies too large with a 413", func() {
+			// the server closes the connection after rejecting the body,
+			// which app.Test doesn't support
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			go app.Listener(ln)
+			DeferCleanup(app.Shutdown)
+
+			resp, err := http.Post("http://"+ln.Addr().String()+"/v1/completions", fiber.MIMEApplicationJSON, strings.NewReader(`{"model": "model.bin", "prompt": "`+strings.Repeat("a", 512)+`"}`))
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(fiber.StatusRequestEntityTooLarge))
+			errResp := ErrorResponse{}
+			Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed())
+			Expect(errResp.Error).ToNot(BeNil())
+		})
+		It("reject the prompts too long before their inference", func() {
+			code, resp := post("/v1/completions", `{"model": "model.bin", "prompt": "`+strings.Repeat("a", 64)+`"}`)
+			Expect(code).To(Equal(fiber.StatusBadRequest))
+			Expect(*resp.Error.Param).To(Equal("prompt"))
+			Expect(resp.Error.Message).To(ContainSubstring("over the limit of 8 tokens"))
+			// the model doesn't expose its tokenizer
+			Expect(resp.Error.Message).To(ContainSubstring("is about 16 tokens long"))
+
+			code, resp = post("/v1/chat/completions", `{"model": "model.bin", "messages": [{"role": "user", "content": "`+strings.Repeat("a", 64)+`"}]}`)
+			Expect(code).To(Equal(fiber.StatusBadRequest))
+			Expect(*resp.Error.Param).To(Equal("messages"))
+		})
+		It("count the tokens of the prompts without loading the model", func() {
+			var backend *echoBackend
+			app, backend = echoApp(map[string]string{
+				"echo.yaml": "name: echo\nbackend: echo\nparameters:\n  model: model.bin\n",
+			}, WithMaxPromptTokens(8))
+			code, _ := post("/v1/completions", `{"model": "echo", "prompt": "`+strings.Repeat("a", 64)+`"}`)
+			Expect(code).To(Equal(fiber.StatusBadRequest))
+			Expect(backend.loaded()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+
+	"github.com/donomii/go-rwkv.cpp"
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+	"github.com/go-skynet/LocalAI/internal"
+	model "github.com/go-skynet/LocalAI/pkg/model"
+	gpt2 "github.com/go-skynet/go-gpt2.cpp"
+	gptj "github.com/go-skynet/go-gpt4all-j.cpp"
+	llama "github.com/go-skynet/go-llama.cpp"
+	"github.com/gofiber/fiber/v2"
+)
+
+// VersionResponse reports the build of LocalAI and of its backends
+type VersionResponse struct {
+	Version   string           `json:"version"`
+	Commit    string           `json:"commit,omitempty"`
+	GoVersion string           `json:"go_version"`
+	Backends  []BackendVersion `json:"backends"`
+}
+
+// BackendVersion reports the module a backend is built from, what its models
+// are able to do, and which of them are loaded
+type BackendVersion struct {
+	Name         string   `json:"name"`
+	Module       string   `json:"module,omitempty"`
+	Version      string   `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities"`
+	LoadedModels []string `json:"loaded_models"`
+}
+
+// backendBuild describes how a backend is built. model is a nil model of the
+// backend, to recognize its loaded models.
+type backendBuild struct {
+	module       string
+	model        interface{}
+	capabilities []string
+}
+
+var backendBuilds = map[string]backendBuild{
+	"llama":    {module: "github.com/go-skynet/go-llama.cpp", model: (*llama.LLama)(nil), capabilities: []string{"completion"}},
+	"stablelm": {module: "github.com/go-skynet/go-gpt2.cpp", model: (*gpt2.StableLM)(nil), capabilities: []string{"completion"}},
+	"gpt2":     {module: "github.com/go-skynet/go-gpt2.cpp", model: (*gpt2.GPT2)(nil), capabilities: []string{"completion"}},
+	"gptj":     {module: "github.com/go-skynet/go-gpt4all-j.cpp", model: (*gptj.GPTJ)(nil), capabilities: []string{"completion"}},
+	"rwkv":     {module: "github.com/donomii/go-rwkv.cpp", model: (*rwkv.RwkvState)(nil), capabilities: []string{"completion", "tokenize", "embeddings"}},
+	// the whisper models are an interface, recognized in backendOf
+	"whisper": {module: "github.com/ggerganov/whisper.cpp/bindings/go", capabilities: []string{"transcription"}},
+}
+
+// backendOf returns the name of the backend of a loaded model, or an empty
+// string if it isn't one of backendBuilds
+func backendOf(m interface{}) string {
+	if _, ok := m.(whisper.Model); ok {
+		return "whisper"
+	}
+	for name, build := range backendBuilds {
+		if build.model != nil && reflect.TypeOf(m) == reflect.TypeOf(build.model) {
+			return name
+		}
+	}
+	return ""
+}
+
+// moduleVersions returns the versions of the modules LocalAI is built with,
+// the replaced ones reporting their replacement
+func moduleVersions() map[string]string {
+	versions := map[string]string{}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return versions
+	}
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		versions[dep.Path] = dep.Version
+	}
+	return versions
+}
+
+// versionEndpoint reports the version of LocalAI, the Go version it is built
+// with, and the versions and capabilities of the backends with their loaded
+// models
+func versionEndpoint(loader *model.ModelLoader) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		loaded := map[string][]string{}
+		for name, m := range loader.Loaded() {
+			if backend := backendOf(m); backend != "" {
+				loaded[backend] = append(loaded[backend], name)
+			}
+		}
+
+		modules := moduleVersions()
+		resp := VersionResponse{
+			Version:   internal.Version,
+			Commit:    internal.Commit,
+			GoVersion: runtime.Version(),
+			Backends:  []BackendVersion{},
+		}
+		for _, name := range backendNames(backends) {
+			b := BackendVersion{Name: name, Capabilities: []string{}, LoadedModels: []string{}}
+			if build, ok := backendBuilds[name]; ok {
+				b.Module = build.module
+				b.Version = modules[build.module]
+				b.Capabilities = append(b.Capabilities, build.capabilities...)
+			}
+			if models, ok := loaded[name]; ok {
+				sort.Strings(models)
+				b.LoadedModels = models
+			}
+			resp.Backends = append(resp.Backends, b)
+		}
+		return c.JSON(resp)
+	}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+// websocketHeaderLocal is set to the headers of the WebSocket upgrade
+// requests, which the requests sent on the socket are served with
+const websocketHeaderLocal = "websocketHeader"
+
+// WebsocketDone is the last frame of the WebSocket streams
+type WebsocketDone struct {
+	Done bool `json:"done"`
+}
+
+// websocketEndpoint streams the completions over a WebSocket, for the clients
+// handling them better than server-sent events. The first message of the
+// socket is the request, a chat completion when it has messages and a
+// completion otherwise, which is streamed back as the JSON frames of its
+// chunks followed by a done frame, or as a frame holding its error. The
+// socket is closed afterwards.
+//
+// The request is served by the streaming endpoints of app, so it goes through
+// the same authentication, limits and logging as the ones sent over HTTP, and
+// closing the socket cancels the prediction like a client going away does.
+// The errors of the socket are logged with logger, at the debug level.
+func websocketEndpoint(app *fiber.App, logger *zerolog.Logger) []fiber.Handler {
+	return []fiber.Handler{
+		func(c *fiber.Ctx) error {
+			if !websocket.IsWebSocketUpgrade(c) {
+				return fiber.ErrUpgradeRequired
+			}
+			header := &fasthttp.RequestHeader{}
+			c.Request().Header.CopyTo(header)
+			c.Locals(websocketHeaderLocal, header)
+			return c.Next()
+		},
+		websocket.New(func(conn *websocket.Conn) {
+			if err := serveWebsocket(app, conn); err != nil {
+				logger.Debug().Msgf("WebSocket stream stopped: %s", err.Error())
+			}
+		}),
+	}
+}
+
+// serveWebsocket serves the request read from the socket, see
+// websocketEndpoint, and closes it. It returns the errors of the socket.
+func serveWebsocket(app *fiber.App, conn *websocket.Conn) error {
+	defer conn.Close()
+
+	_, body, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	request := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &request); err != nil {
+		_, resp := errorResponse(fiber.NewError(fiber.StatusBadRequest, "invalid request body: "+err.Error()))
+		return closeWebsocket(conn, resp)
+	}
+	path := "/v1/completions"
+	if _, ok := request["messages"]; ok {
+		path = "/v1/chat/completions"
+	}
+	request["stream"] = json.RawMessage("true")
+	body, _ = json.Marshal(request)
+
+	header := &fasthttp.RequestHeader{}
+	if upgrade, ok := conn.Locals(websocketHeaderLocal).(*fasthttp.RequestHeader); ok {
+		upgrade.CopyTo(header)
+	}
+	for _, h := range []string{fiber.HeaderConnection, fiber.HeaderUpgrade, fiber.HeaderSecWebSocketKey, fiber.HeaderSecWebSocketVersion, fiber.HeaderSecWebSocketExtensions, fiber.HeaderSecWebSocketProtocol} {
+		header.Del(h)
+	}
+	if id, _ := conn.Locals(requestIDLocal).(string); id != "" {
+		header.Set(requestIDHeader, id)
+	}
+
+	ctx := innerRequest(app, header, conn.RemoteAddr(), path, body)
+	if ctx.Response.StatusCode() >= 400 || !ctx.Response.IsBodyStream() {
+		resp := ErrorResponse{}
+		if err := json.Unmarshal(ctx.Response.Body(), &resp); err != nil || resp.Error == nil {
+			resp.Error = &APIError{Code: ctx.Response.StatusCode(), Message: string(ctx.Response.Body()), Type: "server_error"}
+		}
+		return closeWebsocket(conn, resp)
+	}
+
+	// Closing the stream of the response stops its writer, which cancels
+	// the prediction. It is closed once the socket is closed by the client,
+	// which is noticed by reading it, or once the stream is served.
+	stream := ctx.Response.BodyStream()
+	closeStream := func() {
+		if c, ok := stream.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				closeStream()
+				return
+			}
+		}
+	}()
+	defer func() {
+		closeStream()
+		// the socket can't be read once the handler returns
+		conn.Close()
+		<-read
+	}()
+
+	events := bufio.NewReader(stream)
+	for {
+		line, err := events.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+
+		// the keep-alive comments and the blank lines ending the events
+		// are not forwarded
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, []byte("data: ")) {
+			continue
+		}
+		data := bytes.TrimPrefix(line, []byte("data: "))
+		if string(data) == "[DONE]" {
+			return closeWebsocket(conn, WebsocketDone{Done: true})
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			return err
+		}
+	}
+}
+
+// closeWebsocket writes the last frame of the socket and closes it normally
+func closeWebsocket(conn *websocket.Conn, last interface{}) error {
+	if err := conn.WriteJSON(last); err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+
+	fastws "github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WebSocket streams", func() {
+	var url string
+
+	BeforeEach(func() {
+		app, _ := echoApp(map[string]string{
+			"echo.yaml": "name: echo\nbackend: echo\nroles:\n  user: \"USER:\"\nparameters:\n  model: model.bin\n",
+		}, WithAPIKeys("key"))
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		go app.Listener(ln)
+		DeferCleanup(app.Shutdown)
+		url = "ws://" + ln.Addr().String() + "/v1/ws"
+	})
+
+	// stream sends the request on a new socket and returns the frames it
+	// gets back until the socket is closed
+	stream := func(request string) []map[string]interface{} {
+		conn, _, err := fastws.DefaultDialer.Dial(url, map[string][]string{"Authorization": {"Bearer key"}})
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Expect(conn.WriteMessage(fastws.TextMessage, []byte(request))).To(Succeed())
+
+		frames := []map[string]interface{}{}
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				Expect(fastws.IsCloseError(err, fastws.CloseNormalClosure)).To(BeTrue(), err.Error())
+				return frames
+			}
+			frame := map[string]interface{}{}
+			Expect(json.Unmarshal(data, &frame)).To(Succeed())
+			frames = append(frames, frame)
+		}
+	}
+
+	// text joins the texts of the chunks streamed, from the deltas of the
+	// chat completions or from the choices of the completions
+	text := func(frames []map[string]interface{}) string {
+		res := ""
+		for _, frame := range frames {
+			choices, _ := frame["choices"].([]interface{})
+			for _, choice := range choices {
+				choice := choice.(map[string]interface{})
+				if delta, ok := choice["delta"].(map[string]interface{}); ok {
+					content, _ := delta["content"].(string)
+					res += content
+				} else {
+					t, _ := choice["text"].(string)
+					res += t
+				}
+			}
+		}
+		return res
+	}
+
+	It("stream the chunks of the chat completions, then a done frame", func() {
+		frames := stream(`{"model": "echo", "messages": [{"role": "user", "content": "Hi there"}]}`)
+		Expect(len(frames)).To(BeNumerically(">=", 2))
+		Expect(frames[0]["object"]).To(Equal("chat.completion.chunk"))
+		Expect(text(frames)).To(Equal("USER: Hi there"))
+		Expect(frames[len(frames)-1]).To(Equal(map[string]interface{}{"done": true}))
+	})
+	It("stream the completions without messages", func() {
+		frames := stream(`{"model": "echo", "prompt": "Once upon a time"}`)
+		Expect(frames[0]["object"]).To(Equal("text_completion"))
+		Expect(text(frames)).To(Equal("Once upon a time"))
+		Expect(frames[len(frames)-1]).To(Equal(map[string]interface{}{"done": true}))
+	})
+	It("send the errors of the requests", func() {
+		frames := stream(`{"model": "missing", "prompt": "Hi"}`)
+		Expect(frames).To(HaveLen(1))
+		Expect(frames[0]["error"]).To(HaveKeyWithValue("code", BeNumerically("==", fiber.StatusNotFound)))
+	})
+	It("require the API key", func() {
+		_, resp, err := fastws.DefaultDialer.Dial(url, nil)
+		Expect(err).To(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(fiber.StatusUnauthorized))
+	})
+})
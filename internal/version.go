@@ -0,0 +1,15 @@
+package internal
+
+// Version and Commit are set at build time with -ldflags, see the Makefile
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+// PrintableVersion returns the version of LocalAI, with its commit if known
+func PrintableVersion() string {
+	if Commit == "" {
+		return Version
+	}
+	return Version + " (" + Commit + ")"
+}
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	api "github.com/go-skynet/LocalAI/api"
+	"github.com/go-skynet/LocalAI/internal"
 	model "github.com/go-skynet/LocalAI/pkg/model"
 	"github.com/jaypipes/ghw"
 	"github.com/rs/zerolog"
@@ -27,8 +35,9 @@ func main() {
 	}
 
 	app := &cli.App{
-		Name:  "LocalAI",
-		Usage: "OpenAI compatible API for running LLaMA/GPT models locally on CPU with consumer grade hardware.",
+		Name:    "LocalAI",
+		Version: internal.PrintableVersion(),
+		Usage:   "OpenAI compatible API for running LLaMA/GPT models locally on CPU with consumer grade hardware.",
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
 				Name:    "f16",
@@ -38,6 +47,12 @@ func main() {
 				Name:    "debug",
 				EnvVars: []string{"DEBUG"},
 			},
+			&cli.StringFlag{
+				Name:        "log-format",
+				DefaultText: "Format of the logs, console for humans or json for log aggregation",
+				EnvVars:     []string{"LOG_FORMAT"},
+				Value:       "console",
+			},
 			&cli.IntFlag{
 				Name:        "threads",
 				DefaultText: "Number of threads used for parallel computation. Usage of the number of physical cores in the system is suggested.",
@@ -55,6 +70,16 @@ func main() {
 				DefaultText: "Config file",
 				EnvVars:     []string{"CONFIG_FILE"},
 			},
+			&cli.StringFlag{
+				Name:        "model",
+				DefaultText: "Model file served with the default parameters, without a config, under its name without extension. It is the default model unless default-model is set",
+				EnvVars:     []string{"MODEL"},
+			},
+			&cli.StringFlag{
+				Name:        "default-model",
+				DefaultText: "Model used by the requests which don't specify one. By default the first model of the models path",
+				EnvVars:     []string{"DEFAULT_MODEL"},
+			},
 			&cli.StringFlag{
 				Name:        "address",
 				DefaultText: "Bind address for the API server.",
@@ -67,6 +92,111 @@ func main() {
 				EnvVars:     []string{"CONTEXT_SIZE"},
 				Value:       512,
 			},
+			&cli.StringFlag{
+				Name:        "preload-models",
+				DefaultText: "Comma separated list of models to load at startup, or \"all\" for all the configured models",
+				EnvVars:     []string{"PRELOAD_MODELS"},
+			},
+			&cli.BoolFlag{
+				Name:        "preload-strict",
+				DefaultText: "Fail to start if a model can't be preloaded",
+				EnvVars:     []string{"PRELOAD_STRICT"},
+			},
+			&cli.IntFlag{
+				Name:        "max-loaded-models",
+				DefaultText: "Maximum number of models kept in memory, the least recently used are unloaded first. 0 is unlimited",
+				EnvVars:     []string{"MAX_LOADED_MODELS"},
+			},
+			&cli.StringFlag{
+				Name:        "api-keys",
+				DefaultText: "Comma separated list of API keys the requests must use as bearer token. Empty disables authentication",
+				EnvVars:     []string{"API_KEYS"},
+			},
+			&cli.IntFlag{
+				Name:        "max-concurrency",
+				DefaultText: "Maximum number of inferences running at once. Defaults to the number of CPUs divided by the threads, at least 1, 0 is unlimited",
+				EnvVars:     []string{"MAX_CONCURRENCY"},
+			},
+			&cli.IntFlag{
+				Name:        "max-queue",
+				DefaultText: "Maximum number of requests waiting for an inference to complete when max-concurrency are running, the others are rejected with a 429",
+				EnvVars:     []string{"MAX_QUEUE"},
+				Value:       64,
+			},
+			&cli.IntFlag{
+				Name:        "max-body-size",
+				DefaultText: "Maximum size in bytes of the request bodies, the larger ones are rejected with a 413",
+				EnvVars:     []string{"MAX_BODY_SIZE"},
+				Value:       4 * 1024 * 1024,
+			},
+			&cli.IntFlag{
+				Name:        "max-prompt-tokens",
+				DefaultText: "Maximum number of tokens of the prompts of the completions and chat completions, the longer ones are rejected with a 400 before their inference. The tokens are counted by the rwkv models only, and estimated at 4 characters each for the other backends, so the limit is approximate for them. 0 is unlimited",
+				EnvVars:     []string{"MAX_PROMPT_TOKENS"},
+			},
+			&cli.IntFlag{
+				Name:        "response-cache-size",
+				DefaultText: "Number of responses of the deterministic requests, with a temperature of 0 or a seed, cached in memory. 0 disables the cache",
+				EnvVars:     []string{"RESPONSE_CACHE_SIZE"},
+			},
+			&cli.DurationFlag{
+				Name:        "response-cache-ttl",
+				DefaultText: "Time the responses are cached for. 0 keeps them until they are the least recently used",
+				EnvVars:     []string{"RESPONSE_CACHE_TTL"},
+				Value:       10 * time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:        "stream-keepalive",
+				DefaultText: "Interval of the keep-alive comments written to the streamed responses until their first token, so the proxies don't time out. 0 disables them",
+				EnvVars:     []string{"STREAM_KEEPALIVE"},
+			},
+			&cli.BoolFlag{
+				Name:        "allow-inline-templates",
+				DefaultText: "Let the requests send their own prompt template in \"template\", rendered in place of the one of the model. Only enable it for trusted clients",
+				EnvVars:     []string{"ALLOW_INLINE_TEMPLATES"},
+			},
+			&cli.IntFlag{
+				Name:        "load-retries",
+				DefaultText: "Number of times the failed loads of a model are retried, waiting 1s, then twice as long after each attempt",
+				EnvVars:     []string{"LOAD_RETRIES"},
+				Value:       3,
+			},
+			&cli.DurationFlag{
+				Name:        "model-idle-timeout",
+				DefaultText: "Unload the models which weren't used for this long, e.g. 30m. They are loaded again when requested. 0 keeps them loaded",
+				EnvVars:     []string{"MODEL_IDLE_TIMEOUT"},
+			},
+			&cli.DurationFlag{
+				Name:        "request-timeout",
+				DefaultText: "Cancel the predictions taking longer than this, e.g. 5m. 0 disables the timeout",
+				EnvVars:     []string{"REQUEST_TIMEOUT"},
+			},
+			&cli.DurationFlag{
+				Name:        "shutdown-timeout",
+				DefaultText: "Time given to the requests in flight to complete on SIGINT or SIGTERM before cancelling their predictions",
+				EnvVars:     []string{"SHUTDOWN_TIMEOUT"},
+				Value:       30 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:        "cors-origins",
+				DefaultText: "Comma separated list of origins allowed to call the API from a browser, or \"*\" for any origin. Empty allows the same origin only",
+				EnvVars:     []string{"CORS_ORIGINS"},
+			},
+			&cli.BoolFlag{
+				Name:        "cors-allow-credentials",
+				DefaultText: "Allow the browsers to send their credentials along the cross-origin requests",
+				EnvVars:     []string{"CORS_ALLOW_CREDENTIALS"},
+			},
+			&cli.BoolFlag{
+				Name:        "disable-compression",
+				DefaultText: "Don't compress the responses, even for the clients accepting gzip, deflate or brotli",
+				EnvVars:     []string{"DISABLE_COMPRESSION"},
+			},
+			&cli.BoolFlag{
+				Name:        "watch-configs",
+				DefaultText: "Reload the model config files in the models path when they change",
+				EnvVars:     []string{"WATCH_CONFIGS"},
+			},
 		},
 		Description: `
 LocalAI is a drop-in replacement OpenAI API which runs inference locally.
@@ -85,7 +215,90 @@ It uses llama.cpp, ggml and gpt4all as backend with golang c bindings.
 		UsageText: `local-ai [options]`,
 		Copyright: "go-skynet authors",
 		Action: func(ctx *cli.Context) error {
-			return api.App(ctx.String("config-file"), model.NewModelLoader(ctx.String("models-path")), ctx.Int("threads"), ctx.Int("context-size"), ctx.Bool("f16"), ctx.Bool("debug"), false).Listen(ctx.String("address"))
+			switch format := ctx.String("log-format"); format {
+			case "json":
+				log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+			case "console":
+			default:
+				return fmt.Errorf("log-format must be console or json, got %q", format)
+			}
+			// The app logs at the same level, the models with debug: true in
+			// their config being logged at debug level even without --debug
+			log.Logger = log.Logger.Level(zerolog.InfoLevel)
+			if ctx.Bool("debug") {
+				log.Logger = log.Logger.Level(zerolog.DebugLevel)
+			}
+
+			loader := model.NewModelLoader(ctx.String("models-path"))
+			loader.SetMaxLoadedModels(ctx.Int("max-loaded-models"))
+			loader.SetLoadRetries(ctx.Int("load-retries"), time.Second)
+
+			// By default, as many inferences run at once as the CPUs allow
+			// with the threads each one uses. 0 set explicitly is unlimited
+			maxConcurrency := ctx.Int("max-concurrency")
+			if !ctx.IsSet("max-concurrency") {
+				maxConcurrency = 1
+				if threads := ctx.Int("threads"); threads > 0 && runtime.NumCPU()/threads > 1 {
+					maxConcurrency = runtime.NumCPU() / threads
+				}
+			}
+
+			// The predictions in flight on shutdown are cancelled once they
+			// were given the shutdown timeout to complete
+			predictions, cancelPredictions := context.WithCancel(context.Background())
+			defer cancelPredictions()
+
+			app, err := api.App(
+				api.WithContext(predictions),
+				api.WithConfigFile(ctx.String("config-file")),
+				api.WithModelLoader(loader),
+				api.WithDefaultModel(ctx.String("default-model")),
+				api.WithModelFile(ctx.String("model")),
+				api.WithThreads(ctx.Int("threads")),
+				api.WithContextSize(ctx.Int("context-size")),
+				api.WithF16(ctx.Bool("f16")),
+				api.WithDebug(ctx.Bool("debug")),
+				api.WithWatchConfigs(ctx.Bool("watch-configs")),
+				api.WithDisableCompression(ctx.Bool("disable-compression")),
+				api.WithPreloadModels(splitList(ctx.String("preload-models"))...),
+				api.WithPreloadStrict(ctx.Bool("preload-strict")),
+				api.WithAPIKeys(splitList(ctx.String("api-keys"))...),
+				api.WithRequestTimeout(ctx.Duration("request-timeout")),
+				api.WithCORSOrigins(splitList(ctx.String("cors-origins"))...),
+				api.WithCORSAllowCredentials(ctx.Bool("cors-allow-credentials")),
+				api.WithMaxConcurrency(maxConcurrency, ctx.Int("max-queue")),
+				api.WithResponseCache(ctx.Int("response-cache-size"), ctx.Duration("response-cache-ttl")),
+				api.WithStreamKeepalive(ctx.Duration("stream-keepalive")),
+				api.WithInlineTemplates(ctx.Bool("allow-inline-templates")),
+				api.WithMaxBodySize(ctx.Int("max-body-size")),
+				api.WithMaxPromptTokens(ctx.Int("max-prompt-tokens")),
+			)
+			if err != nil {
+				return err
+			}
+
+			if timeout := ctx.Duration("model-idle-timeout"); timeout > 0 {
+				defer loader.WatchIdle(timeout)()
+			}
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			listening := make(chan error, 1)
+			go func() {
+				listening <- app.Listen(ctx.String("address"))
+			}()
+
+			// On SIGINT or SIGTERM, stop accepting connections and let the
+			// requests in flight complete before unloading the models
+			select {
+			case err = <-listening:
+			case sig := <-signals:
+				log.Info().Msgf("Received %s, shutting down", sig)
+				err = app.ShutdownWithTimeout(ctx.Duration("shutdown-timeout"))
+				cancelPredictions()
+			}
+			loader.UnloadAll()
+			return err
 		},
 	}
 
@@ -95,3 +308,14 @@ It uses llama.cpp, ggml and gpt4all as backend with golang c bindings.
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma separated list, skipping the empty items
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,119 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// progressInterval is how often the progress of the downloads is logged
+const progressInterval = 5 * time.Second
+
+// DownloadModel fetches the model from url into the models path, unless it is
+// there already. It is written to a .tmp file renamed once complete, so a
+// failed download doesn't leave a partial model behind. When checksum is set,
+// the SHA256 of the file must match it. Concurrent downloads of the same model
+// wait for the first one.
+func (ml *ModelLoader) DownloadModel(modelName, url, checksum string) error {
+	l := ml.downloadLock(modelName)
+	l.Lock()
+	defer l.Unlock()
+
+	if ml.ExistsInModelPath(modelName) {
+		return nil
+	}
+
+	modelFile := filepath.Join(ml.ModelPath, modelName)
+	if err := os.MkdirAll(filepath.Dir(modelFile), 0755); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Downloading model %s from %s", modelName, url)
+	resp, err := http.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed downloading model %s: %w", modelName, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed downloading model %s: %s", modelName, resp.Status)
+	}
+
+	tmpFile := modelFile + ".tmp"
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile)
+
+	progress := &progressWriter{
+		name:  modelName,
+		total: resp.ContentLength,
+		hash:  sha256.New(),
+		last:  time.Now(),
+	}
+	_, err = io.Copy(io.MultiWriter(f, progress), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed downloading model %s: %w", modelName, err)
+	}
+
+	if checksum != "" {
+		if sum := hex.EncodeToString(progress.hash.Sum(nil)); !strings.EqualFold(sum, checksum) {
+			return fmt.Errorf("checksum mismatch for model %s: expected %s, got %s", modelName, checksum, sum)
+		}
+	}
+
+	if err := os.Rename(tmpFile, modelFile); err != nil {
+		return err
+	}
+	log.Info().Msgf("Downloaded model %s", modelName)
+	return nil
+}
+
+// downloadLock returns the lock of the downloads of the model
+func (ml *ModelLoader) downloadLock(modelName string) *sync.Mutex {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	l, ok := ml.downloads[modelName]
+	if !ok {
+		l = &sync.Mutex{}
+		ml.downloads[modelName] = l
+	}
+	return l
+}
+
+// progressWriter hashes the bytes written and logs the progress of the
+// download periodically.
+type progressWriter struct {
+	name    string
+	total   int64
+	written int64
+	hash    hash.Hash
+	last    time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.hash.Write(b)
+	p.written += int64(n)
+	if time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		if p.total > 0 {
+			log.Info().Msgf("Downloading model %s: %d%%", p.name, p.written*100/p.total)
+		} else {
+			log.Info().Msgf("Downloading model %s: %d bytes", p.name, p.written)
+		}
+	}
+	return n, err
+}
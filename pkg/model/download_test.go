@@ -0,0 +1,51 @@
+package model
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Model downloads", func() {
+	var ml *ModelLoader
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		ml = NewModelLoader(GinkgoT().TempDir())
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/model.bin" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte("model"))
+		}))
+		DeferCleanup(server.Close)
+	})
+
+	It("fetches the missing models", func() {
+		Expect(ml.DownloadModel("model.bin", server.URL+"/model.bin", "")).To(Succeed())
+		data, err := os.ReadFile(filepath.Join(ml.ModelPath, "model.bin"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("model"))
+	})
+	It("verifies the checksum", func() {
+		err := ml.DownloadModel("model.bin", server.URL+"/model.bin", "0000")
+		Expect(err).To(MatchError(ContainSubstring("checksum mismatch")))
+		Expect(ml.ExistsInModelPath("model.bin")).To(BeFalse())
+		Expect(filepath.Join(ml.ModelPath, "model.bin.tmp")).ToNot(BeAnExistingFile())
+
+		// sha256 of "model", case insensitively
+		checksum := "9372C470EEADD5ECD9C3C74C2B3CB633F8E2F2FAD799250A0F70D652B6B825E4"
+		Expect(ml.DownloadModel("model.bin", server.URL+"/model.bin", checksum)).To(Succeed())
+		Expect(ml.ExistsInModelPath("model.bin")).To(BeTrue())
+	})
+	It("reports the failed downloads", func() {
+		err := ml.DownloadModel("missing.bin", server.URL+"/missing.bin", "")
+		Expect(err).To(MatchError(ContainSubstring("404")))
+		Expect(ml.ExistsInModelPath("missing.bin")).To(BeFalse())
+	})
+})
@@ -2,6 +2,9 @@ package model
 
 import (
 	"bytes"
+	"container/list"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -9,10 +12,12 @@ import (
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
 	rwkv "github.com/donomii/go-rwkv.cpp"
+	whisper "github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
 	gpt2 "github.com/go-skynet/go-gpt2.cpp"
 	gptj "github.com/go-skynet/go-gpt4all-j.cpp"
 	llama "github.com/go-skynet/go-llama.cpp"
@@ -22,12 +27,41 @@ type ModelLoader struct {
 	ModelPath string
 	mu        sync.Mutex
 
+	// maxLoaded bounds the number of models kept in memory, 0 is unlimited
+	maxLoaded int
+	// lru holds the names of the loaded models, the most recently used first
+	lru    *list.List
+	loaded map[string]*loadedModel
+	// inUse counts the requests using each model, which can't be evicted
+	inUse map[string]int
+	// downloads serializes the downloads of each model
+	downloads map[string]*sync.Mutex
+	// predictions serializes the predictions of each model, see
+	// PredictionLock
+	predictions map[string]*sync.Mutex
+	// replicas maps the names the replicas of the models are loaded under
+	// to the file of their model, and pools holds the replicas of each model
+	// free to run a prediction, see AcquireReplica
+	replicas map[string]string
+	pools    map[string]chan int
+	// loadRetries is how many times the failed loads are retried, waiting
+	// loadBackoff before the first retry and twice as long before each next
+	loadRetries int
+	loadBackoff time.Duration
+
 	models            map[string]*llama.LLama
 	gptmodels         map[string]*gptj.GPTJ
 	gpt2models        map[string]*gpt2.GPT2
 	gptstablelmmodels map[string]*gpt2.StableLM
 	rwkv              map[string]*rwkv.RwkvState
+	whisperModels     map[string]whisper.Model
 	promptsTemplates  map[string]*template.Template
+	// templateFuncs are the functions of the prompt templates, added to
+	// TemplateFuncs
+	templateFuncs template.FuncMap
+	// rwkvTokenizers holds the tokenizers loaded without their model, see
+	// LoadRWKVTokenizer
+	rwkvTokenizers map[string]*rwkv.Tokenizer
 }
 
 func NewModelLoader(modelPath string) *ModelLoader {
@@ -38,8 +72,334 @@ func NewModelLoader(modelPath string) *ModelLoader {
 		gptstablelmmodels: make(map[string]*gpt2.StableLM),
 		models:            make(map[string]*llama.LLama),
 		rwkv:              make(map[string]*rwkv.RwkvState),
+		rwkvTokenizers:    make(map[string]*rwkv.Tokenizer),
+		whisperModels:     make(map[string]whisper.Model),
 		promptsTemplates:  make(map[string]*template.Template),
+		templateFuncs:     template.FuncMap{},
+		lru:               list.New(),
+		loaded:            make(map[string]*loadedModel),
+		inUse:             make(map[string]int),
+		downloads:         make(map[string]*sync.Mutex),
+		predictions:       make(map[string]*sync.Mutex),
+		replicas:          make(map[string]string),
+		pools:             make(map[string]chan int),
+	}
+}
+
+// PredictionLock returns the mutex the predictions on the model hold, as none
+// of the backends can run them concurrently on an instance of the model. The
+// replicas of the model have their own. This is still needed for llama, see:
+// https://github.com/ggerganov/llama.cpp/discussions/784
+func (ml *ModelLoader) PredictionLock(modelName string) *sync.Mutex {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	l, ok := ml.predictions[modelName]
+	if !ok {
+		l = &sync.Mutex{}
+		ml.predictions[modelName] = l
+	}
+	return l
+}
+
+// Replica returns the name the replica i of the model is loaded under. The
+// backends can't run concurrent predictions on an instance of a model, so the
+// predictions running at once on a model run on its replicas, each one an
+// instance loaded from the file of the model. The replica 0 is the model.
+func (ml *ModelLoader) Replica(modelName string, i int) string {
+	if i == 0 {
+		return modelName
+	}
+	name := fmt.Sprintf("%s#%d", modelName, i)
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.replicas[name] = modelName
+	return name
+}
+
+// ModelFile returns the file of the model in the models path, the one of the
+// model it is a replica of for the replicas.
+func (ml *ModelLoader) ModelFile(modelName string) string {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return ml.modelFile(modelName)
+}
+
+// modelFile is ModelFile with the lock held.
+func (ml *ModelLoader) modelFile(modelName string) string {
+	if file, ok := ml.replicas[modelName]; ok {
+		return file
+	}
+	return modelName
+}
+
+// AcquireReplica waits for one of the first replicas of the model to be free,
+// and returns its name, holding its prediction lock until release is called.
+// Up to replicas predictions run on the model at once. It gives up when ctx
+// is done first.
+func (ml *ModelLoader) AcquireReplica(ctx context.Context, modelName string, replicas int) (name string, release func(), err error) {
+	if replicas < 1 {
+		replicas = 1
+	}
+	ml.mu.Lock()
+	pool, ok := ml.pools[modelName]
+	if !ok || cap(pool) != replicas {
+		// the config of the model changed the number of its replicas, the
+		// predictions still running on the former pool hold their lock
+		pool = make(chan int, replicas)
+		for i := 0; i < replicas; i++ {
+			pool <- i
+		}
+		ml.pools[modelName] = pool
+	}
+	ml.mu.Unlock()
+
+	var i int
+	select {
+	case i = <-pool:
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	}
+	name = ml.Replica(modelName, i)
+	l := ml.PredictionLock(name)
+	l.Lock()
+
+	var once sync.Once
+	return name, func() {
+		once.Do(func() {
+			l.Unlock()
+			pool <- i
+		})
+	}, nil
+}
+
+type loadedModel struct {
+	model   interface{}
+	free    func()
+	element *list.Element
+	// lastUsed is when the model was last requested or released
+	lastUsed time.Time
+}
+
+// SetMaxLoadedModels bounds the number of models kept in memory. When a model
+// is loaded past the limit, the least recently used models not in use are
+// freed. 0 means unlimited.
+func (ml *ModelLoader) SetMaxLoadedModels(max int) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.maxLoaded = max
+	ml.evict("")
+}
+
+// SetLoadRetries makes the failed loads of the models retried up to retries
+// times, waiting backoff before the first retry and twice as long before each
+// next one, e.g. for a model file still being written. 0 disables the
+// retries.
+func (ml *ModelLoader) SetLoadRetries(retries int, backoff time.Duration) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.loadRetries = retries
+	ml.loadBackoff = backoff
+}
+
+// RetryLoad calls load until it loads the model, retrying its failures as set
+// with SetLoadRetries. The models missing from the models path are not
+// retried.
+func (ml *ModelLoader) RetryLoad(modelName string, load func() (interface{}, error)) (interface{}, error) {
+	ml.mu.Lock()
+	retries, backoff := ml.loadRetries, ml.loadBackoff
+	ml.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		model, err := load()
+		if err == nil || attempt >= retries || !ml.ExistsInModelPath(modelName) {
+			return model, err
+		}
+		log.Warn().Msgf("Loading model %s failed (attempt %d of %d), retrying in %s: %s", modelName, attempt+1, retries+1, backoff, err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Use marks the model as in use until release is called, so it isn't evicted
+// meanwhile. It can be called before the model is loaded.
+func (ml *ModelLoader) Use(modelName string) (release func()) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.inUse[modelName]++
+	ml.used(modelName)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ml.mu.Lock()
+			defer ml.mu.Unlock()
+			ml.inUse[modelName]--
+			if ml.inUse[modelName] <= 0 {
+				delete(ml.inUse, modelName)
+			}
+			// the model is idle from the end of the request
+			ml.used(modelName)
+			// models which were in use may have kept the loader over the limit
+			ml.evict("")
+		})
+	}
+}
+
+// LoadedModel returns the model if it is loaded, whatever its backend.
+func (ml *ModelLoader) LoadedModel(modelName string) (interface{}, bool) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	m, ok := ml.loaded[modelName]
+	if !ok {
+		return nil, false
 	}
+	ml.touch(modelName)
+	return m.model, true
+}
+
+// register tracks a newly loaded model, free releases its memory. The lock
+// must be held.
+func (ml *ModelLoader) register(modelName string, model interface{}, free func()) {
+	ml.loaded[modelName] = &loadedModel{
+		model:    model,
+		free:     free,
+		element:  ml.lru.PushFront(modelName),
+		lastUsed: time.Now(),
+	}
+	ml.evict(modelName)
+}
+
+// touch marks the model as the most recently used. The lock must be held.
+func (ml *ModelLoader) touch(modelName string) {
+	if m, ok := ml.loaded[modelName]; ok {
+		ml.lru.MoveToFront(m.element)
+		m.lastUsed = time.Now()
+	}
+}
+
+// used resets the idle time of the model, without changing its rank in the
+// eviction order. The lock must be held.
+func (ml *ModelLoader) used(modelName string) {
+	if m, ok := ml.loaded[modelName]; ok {
+		m.lastUsed = time.Now()
+	}
+}
+
+// evict frees the least recently used models until the limit is honored,
+// skipping the ones in use and keep, the model being returned to the caller.
+// The lock must be held.
+func (ml *ModelLoader) evict(keep string) {
+	if ml.maxLoaded <= 0 {
+		return
+	}
+	for e := ml.lru.Back(); e != nil && len(ml.loaded) > ml.maxLoaded; {
+		prev := e.Prev()
+		modelName := e.Value.(string)
+		if ml.inUse[modelName] == 0 && modelName != keep {
+			log.Debug().Msgf("Evicting model from memory: %s", modelName)
+			ml.unload(modelName)
+		}
+		e = prev
+	}
+}
+
+// unload frees the model. The lock must be held.
+func (ml *ModelLoader) unload(modelName string) {
+	m := ml.loaded[modelName]
+	ml.lru.Remove(m.element)
+	delete(ml.loaded, modelName)
+	m.free()
+}
+
+// UnloadAll frees the models in memory, e.g. on shutdown. The models still in
+// use are kept, as freeing them would crash the predictions using them.
+func (ml *ModelLoader) UnloadAll() {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	for e := ml.lru.Back(); e != nil; {
+		prev := e.Prev()
+		modelName := e.Value.(string)
+		if ml.inUse[modelName] == 0 {
+			log.Debug().Msgf("Unloading model from memory: %s", modelName)
+			ml.unload(modelName)
+		} else {
+			log.Warn().Msgf("Model %s is still in use, not unloading it", modelName)
+		}
+		e = prev
+	}
+}
+
+// UnloadIdle frees the models which weren't used for longer than timeout. The
+// models in use are kept however long they have been loaded, the requests
+// using them being in flight. The models unloaded are loaded again by the
+// next requests for them.
+func (ml *ModelLoader) UnloadIdle(timeout time.Duration) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	for e := ml.lru.Back(); e != nil; {
+		prev := e.Prev()
+		modelName := e.Value.(string)
+		if ml.inUse[modelName] == 0 && time.Since(ml.loaded[modelName].lastUsed) > timeout {
+			log.Info().Msgf("Unloading idle model from memory: %s", modelName)
+			ml.unload(modelName)
+		}
+		e = prev
+	}
+}
+
+// WatchIdle unloads the models idle for longer than timeout in the
+// background, until stop is called.
+func (ml *ModelLoader) WatchIdle(timeout time.Duration) (stop func()) {
+	interval := timeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				ml.UnloadIdle(timeout)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
+
+// IsLoaded reports whether the model is in memory, without marking it as used
+func (ml *ModelLoader) IsLoaded(modelName string) bool {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	_, ok := ml.loaded[modelName]
+	return ok
+}
+
+// Loaded returns the models in memory by name, without marking them as used
+func (ml *ModelLoader) Loaded() map[string]interface{} {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	models := make(map[string]interface{}, len(ml.loaded))
+	for name, m := range ml.loaded {
+		models[name] = m.model
+	}
+	return models
+}
+
+// LoadedModels returns the number of models in memory
+func (ml *ModelLoader) LoadedModels() int {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return len(ml.loaded)
 }
 
 func (ml *ModelLoader) ExistsInModelPath(s string) bool {
@@ -55,8 +415,8 @@ func (ml *ModelLoader) ListModels() ([]string, error) {
 
 	models := []string{}
 	for _, file := range files {
-		// Skip templates, YAML and .keep files
-		if strings.HasSuffix(file.Name(), ".tmpl") || strings.HasSuffix(file.Name(), ".keep") || strings.HasSuffix(file.Name(), ".yaml") || strings.HasSuffix(file.Name(), ".yml") {
+		// Skip templates, YAML, JSON and .keep files
+		if strings.HasSuffix(file.Name(), ".tmpl") || strings.HasSuffix(file.Name(), ".keep") || strings.HasSuffix(file.Name(), ".yaml") || strings.HasSuffix(file.Name(), ".yml") || strings.HasSuffix(file.Name(), ".json") {
 			continue
 		}
 
@@ -66,11 +426,39 @@ func (ml *ModelLoader) ListModels() ([]string, error) {
 	return models, nil
 }
 
+// ErrNoTemplate is returned when rendering the template of a model which has
+// none
+var ErrNoTemplate = errors.New("no template found")
+
+// TemplatePrefix renders the prompt template of the model with in. It returns
+// ErrNoTemplate when the model has no template, the callers using the input
+// as is.
 func (ml *ModelLoader) TemplatePrefix(modelName string, in interface{}) (string, error) {
+	return ml.TemplatePrefixIn("", modelName, in)
+}
+
+// TemplatePrefixIn renders the prompt template of the model like
+// TemplatePrefix, looking it up in dir, the directory of the config which
+// refers to it, then in the models path, then in BuiltinTemplates.
+func (ml *ModelLoader) TemplatePrefixIn(dir, modelName string, in interface{}) (string, error) {
 	ml.mu.Lock()
 	defer ml.mu.Unlock()
 
-	m, ok := ml.promptsTemplates[modelName]
+	// the templates of dir are keyed by their path, so the ones of the same
+	// name in different directories don't collide
+	key := modelName
+	if file := filepath.Join(dir, modelName+".tmpl"); dir != "" && filepath.Clean(dir) != filepath.Clean(ml.ModelPath) {
+		if _, err := os.Stat(file); err == nil {
+			key = file
+			if _, ok := ml.promptsTemplates[key]; !ok {
+				if err := ml.loadTemplate(key, file); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+
+	m, ok := ml.promptsTemplates[key]
 	if !ok {
 		modelFile := filepath.Join(ml.ModelPath, modelName)
 		if err := ml.loadTemplateIfExists(modelName, modelFile); err != nil {
@@ -80,11 +468,16 @@ func (ml *ModelLoader) TemplatePrefix(modelName string, in interface{}) (string,
 		t, exists := ml.promptsTemplates[modelName]
 		if exists {
 			m = t
+		} else if builtin, ok := BuiltinTemplates[modelName]; ok {
+			if err := ml.parseTemplate(modelName, builtin); err != nil {
+				return "", err
+			}
+			m = ml.promptsTemplates[modelName]
 		}
 
 	}
 	if m == nil {
-		return "", nil
+		return "", fmt.Errorf("%w for %s", ErrNoTemplate, modelName)
 	}
 
 	var buf bytes.Buffer
@@ -109,17 +502,27 @@ func (ml *ModelLoader) loadTemplateIfExists(modelName, modelFile string) error {
 		return nil
 	}
 
-	dat, err := os.ReadFile(filepath.Join(ml.ModelPath, modelTemplateFile))
+	return ml.loadTemplate(modelName, filepath.Join(ml.ModelPath, modelTemplateFile))
+}
+
+// loadTemplate parses the template file and keeps it under key. The lock must
+// be held.
+func (ml *ModelLoader) loadTemplate(key, file string) error {
+	dat, err := os.ReadFile(file)
 	if err != nil {
 		return err
 	}
+	return ml.parseTemplate(key, string(dat))
+}
 
-	// Parse the template
-	tmpl, err := template.New("prompt").Parse(string(dat))
+// parseTemplate parses the template text and keeps it under key. The lock
+// must be held.
+func (ml *ModelLoader) parseTemplate(key, text string) error {
+	tmpl, err := template.New("prompt").Funcs(TemplateFuncs).Funcs(ml.templateFuncs).Parse(text)
 	if err != nil {
 		return err
 	}
-	ml.promptsTemplates[modelName] = tmpl
+	ml.promptsTemplates[key] = tmpl
 
 	return nil
 }
@@ -129,17 +532,19 @@ func (ml *ModelLoader) LoadStableLMModel(modelName string) (*gpt2.StableLM, erro
 	defer ml.mu.Unlock()
 
 	// Check if we already have a loaded model
-	if !ml.ExistsInModelPath(modelName) {
+	file := ml.modelFile(modelName)
+	if !ml.ExistsInModelPath(file) {
 		return nil, fmt.Errorf("model does not exist")
 	}
 
 	if m, ok := ml.gptstablelmmodels[modelName]; ok {
 		log.Debug().Msgf("Model already loaded in memory: %s", modelName)
+		ml.touch(modelName)
 		return m, nil
 	}
 
 	// Load the model and keep it in memory for later use
-	modelFile := filepath.Join(ml.ModelPath, modelName)
+	modelFile := filepath.Join(ml.ModelPath, file)
 	log.Debug().Msgf("Loading model in memory from file: %s", modelFile)
 
 	model, err := gpt2.NewStableLM(modelFile)
@@ -148,11 +553,15 @@ func (ml *ModelLoader) LoadStableLMModel(modelName string) (*gpt2.StableLM, erro
 	}
 
 	// If there is a prompt template, load it
-	if err := ml.loadTemplateIfExists(modelName, modelFile); err != nil {
+	if err := ml.loadTemplateIfExists(file, modelFile); err != nil {
 		return nil, err
 	}
 
 	ml.gptstablelmmodels[modelName] = model
+	ml.register(modelName, model, func() {
+		delete(ml.gptstablelmmodels, modelName)
+		model.Free()
+	})
 	return model, err
 }
 
@@ -161,17 +570,19 @@ func (ml *ModelLoader) LoadGPT2Model(modelName string) (*gpt2.GPT2, error) {
 	defer ml.mu.Unlock()
 
 	// Check if we already have a loaded model
-	if !ml.ExistsInModelPath(modelName) {
+	file := ml.modelFile(modelName)
+	if !ml.ExistsInModelPath(file) {
 		return nil, fmt.Errorf("model does not exist")
 	}
 
 	if m, ok := ml.gpt2models[modelName]; ok {
 		log.Debug().Msgf("Model already loaded in memory: %s", modelName)
+		ml.touch(modelName)
 		return m, nil
 	}
 
 	// Load the model and keep it in memory for later use
-	modelFile := filepath.Join(ml.ModelPath, modelName)
+	modelFile := filepath.Join(ml.ModelPath, file)
 	log.Debug().Msgf("Loading model in memory from file: %s", modelFile)
 
 	model, err := gpt2.New(modelFile)
@@ -180,11 +591,15 @@ func (ml *ModelLoader) LoadGPT2Model(modelName string) (*gpt2.GPT2, error) {
 	}
 
 	// If there is a prompt template, load it
-	if err := ml.loadTemplateIfExists(modelName, modelFile); err != nil {
+	if err := ml.loadTemplateIfExists(file, modelFile); err != nil {
 		return nil, err
 	}
 
 	ml.gpt2models[modelName] = model
+	ml.register(modelName, model, func() {
+		delete(ml.gpt2models, modelName)
+		model.Free()
+	})
 	return model, err
 }
 
@@ -193,17 +608,19 @@ func (ml *ModelLoader) LoadGPTJModel(modelName string) (*gptj.GPTJ, error) {
 	defer ml.mu.Unlock()
 
 	// Check if we already have a loaded model
-	if !ml.ExistsInModelPath(modelName) {
+	file := ml.modelFile(modelName)
+	if !ml.ExistsInModelPath(file) {
 		return nil, fmt.Errorf("model does not exist")
 	}
 
 	if m, ok := ml.gptmodels[modelName]; ok {
 		log.Debug().Msgf("Model already loaded in memory: %s", modelName)
+		ml.touch(modelName)
 		return m, nil
 	}
 
 	// Load the model and keep it in memory for later use
-	modelFile := filepath.Join(ml.ModelPath, modelName)
+	modelFile := filepath.Join(ml.ModelPath, file)
 	log.Debug().Msgf("Loading model in memory from file: %s", modelFile)
 
 	model, err := gptj.New(modelFile)
@@ -212,11 +629,15 @@ func (ml *ModelLoader) LoadGPTJModel(modelName string) (*gptj.GPTJ, error) {
 	}
 
 	// If there is a prompt template, load it
-	if err := ml.loadTemplateIfExists(modelName, modelFile); err != nil {
+	if err := ml.loadTemplateIfExists(file, modelFile); err != nil {
 		return nil, err
 	}
 
 	ml.gptmodels[modelName] = model
+	ml.register(modelName, model, func() {
+		delete(ml.gptmodels, modelName)
+		model.Free()
+	})
 	return model, err
 }
 
@@ -227,17 +648,19 @@ func (ml *ModelLoader) LoadRWKV(modelName, tokenFile string, threads uint32) (*r
 	log.Debug().Msgf("Loading model name: %s", modelName)
 
 	// Check if we already have a loaded model
-	if !ml.ExistsInModelPath(modelName) {
+	file := ml.modelFile(modelName)
+	if !ml.ExistsInModelPath(file) {
 		return nil, fmt.Errorf("model does not exist")
 	}
 
 	if m, ok := ml.rwkv[modelName]; ok {
 		log.Debug().Msgf("Model already loaded in memory: %s", modelName)
+		ml.touch(modelName)
 		return m, nil
 	}
 
 	// Load the model and keep it in memory for later use
-	modelFile := filepath.Join(ml.ModelPath, modelName)
+	modelFile := filepath.Join(ml.ModelPath, file)
 	tokenPath := filepath.Join(ml.ModelPath, tokenFile)
 	log.Debug().Msgf("Loading model in memory from file: %s", modelFile)
 
@@ -247,6 +670,66 @@ func (ml *ModelLoader) LoadRWKV(modelName, tokenFile string, threads uint32) (*r
 	}
 
 	ml.rwkv[modelName] = model
+	ml.register(modelName, model, func() {
+		delete(ml.rwkv, modelName)
+		model.Context.Free()
+	})
+	return model, nil
+}
+
+// LoadRWKVTokenizer returns the tokenizer of the tokenFile of a rwkv model,
+// without loading the model. It is read once and kept in memory, being small.
+func (ml *ModelLoader) LoadRWKVTokenizer(tokenFile string) (*rwkv.Tokenizer, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if tk, ok := ml.rwkvTokenizers[tokenFile]; ok {
+		return tk, nil
+	}
+	if !ml.ExistsInModelPath(tokenFile) {
+		return nil, fmt.Errorf("tokenizer %s does not exist", tokenFile)
+	}
+
+	tk, err := rwkv.LoadTokeniser(filepath.Join(ml.ModelPath, tokenFile))
+	if err != nil {
+		return nil, err
+	}
+	ml.rwkvTokenizers[tokenFile] = &tk
+	return &tk, nil
+}
+
+func (ml *ModelLoader) LoadWhisperModel(modelName string) (whisper.Model, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	log.Debug().Msgf("Loading model name: %s", modelName)
+
+	// Check if we already have a loaded model
+	file := ml.modelFile(modelName)
+	if !ml.ExistsInModelPath(file) {
+		return nil, fmt.Errorf("model does not exist")
+	}
+
+	if m, ok := ml.whisperModels[modelName]; ok {
+		log.Debug().Msgf("Model already loaded in memory: %s", modelName)
+		ml.touch(modelName)
+		return m, nil
+	}
+
+	// Load the model and keep it in memory for later use
+	modelFile := filepath.Join(ml.ModelPath, file)
+	log.Debug().Msgf("Loading model in memory from file: %s", modelFile)
+
+	model, err := whisper.New(modelFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ml.whisperModels[modelName] = model
+	ml.register(modelName, model, func() {
+		delete(ml.whisperModels, modelName)
+		model.Close()
+	})
 	return model, nil
 }
 
@@ -257,17 +740,19 @@ func (ml *ModelLoader) LoadLLaMAModel(modelName string, opts ...llama.ModelOptio
 	log.Debug().Msgf("Loading model name: %s", modelName)
 
 	// Check if we already have a loaded model
-	if !ml.ExistsInModelPath(modelName) {
+	file := ml.modelFile(modelName)
+	if !ml.ExistsInModelPath(file) {
 		return nil, fmt.Errorf("model does not exist")
 	}
 
 	if m, ok := ml.models[modelName]; ok {
 		log.Debug().Msgf("Model already loaded in memory: %s", modelName)
+		ml.touch(modelName)
 		return m, nil
 	}
 
 	// Load the model and keep it in memory for later use
-	modelFile := filepath.Join(ml.ModelPath, modelName)
+	modelFile := filepath.Join(ml.ModelPath, file)
 	log.Debug().Msgf("Loading model in memory from file: %s", modelFile)
 
 	model, err := llama.New(modelFile, opts...)
@@ -276,10 +761,14 @@ func (ml *ModelLoader) LoadLLaMAModel(modelName string, opts ...llama.ModelOptio
 	}
 
 	// If there is a prompt template, load it
-	if err := ml.loadTemplateIfExists(modelName, modelFile); err != nil {
+	if err := ml.loadTemplateIfExists(file, modelFile); err != nil {
 		return nil, err
 	}
 
 	ml.models[modelName] = model
+	ml.register(modelName, model, func() {
+		delete(ml.models, modelName)
+		model.Free()
+	})
 	return model, err
 }
@@ -0,0 +1,225 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ModelLoader", func() {
+	Context("eviction", func() {
+		var ml *ModelLoader
+		var freed []string
+
+		load := func(name string) {
+			ml.mu.Lock()
+			defer ml.mu.Unlock()
+			ml.register(name, name, func() { freed = append(freed, name) })
+		}
+
+		BeforeEach(func() {
+			ml = NewModelLoader(GinkgoT().TempDir())
+			freed = []string{}
+		})
+
+		It("keeps all the models by default", func() {
+			load("a")
+			load("b")
+			load("c")
+			Expect(freed).To(BeEmpty())
+		})
+		It("frees the least recently used models past the limit", func() {
+			ml.SetMaxLoadedModels(2)
+			load("a")
+			load("b")
+			_, exists := ml.LoadedModel("a")
+			Expect(exists).To(BeTrue())
+			load("c")
+			Expect(freed).To(Equal([]string{"b"}))
+
+			_, exists = ml.LoadedModel("b")
+			Expect(exists).To(BeFalse())
+		})
+		It("doesn't free the models in use until they are released", func() {
+			ml.SetMaxLoadedModels(1)
+			release := ml.Use("a")
+			load("a")
+			load("b")
+			Expect(freed).To(BeEmpty())
+
+			release()
+			Expect(freed).To(Equal([]string{"a"}))
+			// releasing twice is harmless
+			release()
+			_, exists := ml.LoadedModel("b")
+			Expect(exists).To(BeTrue())
+		})
+		It("unloads the idle models not in use", func() {
+			load("a")
+			load("b")
+			load("c")
+			release := ml.Use("c")
+			ml.loaded["a"].lastUsed = time.Now().Add(-time.Hour)
+			ml.loaded["c"].lastUsed = time.Now().Add(-time.Hour)
+
+			ml.UnloadIdle(time.Minute)
+			Expect(freed).To(Equal([]string{"a"}))
+			Expect(ml.IsLoaded("b")).To(BeTrue())
+			Expect(ml.IsLoaded("c")).To(BeTrue())
+
+			// the models are idle from the end of their last request
+			release()
+			ml.UnloadIdle(time.Minute)
+			Expect(freed).To(Equal([]string{"a"}))
+		})
+		It("unloads all the models not in use", func() {
+			release := ml.Use("b")
+			load("a")
+			load("b")
+			load("c")
+
+			ml.UnloadAll()
+			Expect(freed).To(ConsistOf("a", "c"))
+			Expect(ml.LoadedModels()).To(Equal(1))
+
+			release()
+			ml.UnloadAll()
+			Expect(freed).To(ConsistOf("a", "b", "c"))
+		})
+	})
+
+	Context("load retries", func() {
+		var ml *ModelLoader
+		var attempts int
+
+		BeforeEach(func() {
+			ml = NewModelLoader(GinkgoT().TempDir())
+			ml.SetLoadRetries(2, time.Millisecond)
+			attempts = 0
+			Expect(os.WriteFile(filepath.Join(ml.ModelPath, "model.bin"), nil, 0600)).To(Succeed())
+		})
+
+		failing := func(failures int) func() (interface{}, error) {
+			return func() (interface{}, error) {
+				attempts++
+				if attempts <= failures {
+					return nil, fmt.Errorf("busy")
+				}
+				return "model", nil
+			}
+		}
+
+		It("retry the transient failures", func() {
+			m, err := ml.RetryLoad("model.bin", failing(2))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m).To(Equal("model"))
+			Expect(attempts).To(Equal(3))
+		})
+		It("give up after the retries", func() {
+			_, err := ml.RetryLoad("model.bin", failing(3))
+			Expect(err).To(MatchError("busy"))
+			Expect(attempts).To(Equal(3))
+		})
+		It("don't retry the missing models", func() {
+			_, err := ml.RetryLoad("missing.bin", failing(3))
+			Expect(err).To(MatchError("busy"))
+			Expect(attempts).To(Equal(1))
+		})
+	})
+
+	Context("prediction locks", func() {
+		It("are shared by the predictions on a model only", func() {
+			ml := NewModelLoader(GinkgoT().TempDir())
+			Expect(ml.PredictionLock("a")).To(BeIdenticalTo(ml.PredictionLock("a")))
+			Expect(ml.PredictionLock("a")).ToNot(BeIdenticalTo(ml.PredictionLock("b")))
+		})
+	})
+
+	Context("replicas", func() {
+		It("are acquired up to their number, on the file of the model", func() {
+			ml := NewModelLoader(GinkgoT().TempDir())
+			names := map[string]bool{}
+			for i := 0; i < 2; i++ {
+				name, release, err := ml.AcquireReplica(context.Background(), "model.bin", 2)
+				Expect(err).ToNot(HaveOccurred())
+				DeferCleanup(release)
+				Expect(ml.ModelFile(name)).To(Equal("model.bin"))
+				names[name] = true
+			}
+			Expect(names).To(HaveLen(2))
+			Expect(names).To(HaveKey("model.bin"))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, _, err := ml.AcquireReplica(ctx, "model.bin", 2)
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+		})
+	})
+
+	Context("templates", func() {
+		var ml *ModelLoader
+
+		BeforeEach(func() {
+			ml = NewModelLoader(GinkgoT().TempDir())
+		})
+
+		render := func(tmpl string, in interface{}) string {
+			Expect(os.WriteFile(filepath.Join(ml.ModelPath, "model.bin.tmpl"), []byte(tmpl), 0600)).To(Succeed())
+			out, err := ml.TemplatePrefix("model.bin", in)
+			Expect(err).ToNot(HaveOccurred())
+			return out
+		}
+
+		It("have the helper functions", func() {
+			in := map[string]interface{}{"Input": "  Hello World  ", "System": ""}
+			Expect(render(`{{.Input | trim | upper}}|{{.System | default "Be brief."}}|{{.Input | trim | replace "World" "you" | lower}}|{{join ", " (split " " (trim .Input))}}|{{if .Input | contains "World"}}yes{{end}}|{{now | date "2006"}}`, in)).
+				To(Equal("HELLO WORLD|Be brief.|hello you|Hello, World|yes|" + time.Now().Format("2006")))
+		})
+		It("have the functions added to the loader", func() {
+			ml.AddTemplateFuncs(template.FuncMap{"shout": func(s string) string { return s + "!" }})
+			Expect(render(`{{.Input | shout}}`, map[string]string{"Input": "Hi"})).To(Equal("Hi!"))
+		})
+		DescribeTable("are built in for the common chat formats",
+			func(name string, in map[string]interface{}, expected string) {
+				out, err := ml.TemplatePrefix(name, in)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(out).To(Equal(expected))
+			},
+			Entry("chatml", "chatml", map[string]interface{}{"Messages": []map[string]string{{"Role": "system", "Content": "Be brief."}, {"Role": "user", "Content": "Hi"}}},
+				"<|im_start|>system\nBe brief.<|im_end|>\n<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\n"),
+			Entry("llama2", "llama2", map[string]interface{}{"Messages": []map[string]string{{"Role": "system", "Content": "Be brief."}, {"Role": "user", "Content": "Hi"}, {"Role": "assistant", "Content": "Hello"}, {"Role": "user", "Content": "Bye"}}},
+				"<s>[INST] <<SYS>>\nBe brief.\n<</SYS>>\n\nHi [/INST] Hello </s><s>[INST] Bye [/INST]"),
+			Entry("alpaca", "alpaca", map[string]interface{}{"Input": "Hi"},
+				"### Instruction:\nHi\n\n### Response:\n"),
+			Entry("vicuna", "vicuna", map[string]interface{}{"Messages": []map[string]string{{"Role": "system", "Content": "Be brief."}, {"Role": "user", "Content": "Hi"}}},
+				"Be brief.\n\nUSER: Hi\nASSISTANT:"),
+		)
+		It("are overridden by the template files", func() {
+			Expect(os.WriteFile(filepath.Join(ml.ModelPath, "chatml.tmpl"), []byte("custom {{.Input}}"), 0600)).To(Succeed())
+			out, err := ml.TemplatePrefix("chatml", map[string]string{"Input": "Hi"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out).To(Equal("custom Hi"))
+		})
+		It("are looked up in the directory of the config first", func() {
+			chat, other := filepath.Join(ml.ModelPath, "chat"), filepath.Join(ml.ModelPath, "other")
+			Expect(os.Mkdir(chat, 0755)).To(Succeed())
+			Expect(os.Mkdir(other, 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(chat, "chatml.tmpl"), []byte("chat {{.Input}}"), 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(other, "chatml.tmpl"), []byte("other {{.Input}}"), 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(ml.ModelPath, "chatml.tmpl"), []byte("root {{.Input}}"), 0600)).To(Succeed())
+			in := map[string]string{"Input": "Hi"}
+
+			for dir, expected := range map[string]string{chat: "chat Hi", other: "other Hi", GinkgoT().TempDir(): "root Hi", "": "root Hi"} {
+				out, err := ml.TemplatePrefixIn(dir, "chatml", in)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(out).To(Equal(expected))
+			}
+		})
+	})
+})
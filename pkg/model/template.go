@@ -0,0 +1,108 @@
+package model
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateFuncs are the functions available in the prompt templates. The
+// value they apply to comes last, so they can be chained in pipelines, e.g.
+// {{.Input | trim | default "Hello"}}.
+var TemplateFuncs = template.FuncMap{
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"join":       func(sep string, elems []string) string { return strings.Join(elems, sep) },
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	"default":    defaultValue,
+	"now":        time.Now,
+	"date":       func(layout string, t time.Time) string { return t.Format(layout) },
+}
+
+// BuiltinTemplates are the chat templates of the common formats, available by
+// name without a template file. A template file of the same name overrides
+// them. They render the messages of the chat requests, or the input of the
+// other ones as a single user message.
+var BuiltinTemplates = map[string]string{
+	"chatml": `{{- if .Messages}}{{range .Messages}}<|im_start|>{{.Role}}
+{{.Content}}<|im_end|>
+{{end}}{{else}}<|im_start|>user
+{{.Input}}<|im_end|>
+{{end}}<|im_start|>assistant
+`,
+	"llama2": `{{- if .Messages}}{{$system := false}}{{range .Messages}}
+{{- if eq .Role "system"}}<s>[INST] <<SYS>>
+{{.Content}}
+<</SYS>>
+
+{{$system = true}}
+{{- else if eq .Role "user"}}{{if $system}}{{$system = false}}{{else}}<s>[INST] {{end}}{{.Content}} [/INST]
+{{- else}} {{.Content}} </s>
+{{- end}}{{end}}{{else}}<s>[INST] {{.Input}} [/INST]{{end}}`,
+	"alpaca": `{{- if .Messages}}{{range .Messages}}
+{{- if eq .Role "system"}}{{.Content}}
+
+{{else if eq .Role "user"}}### Instruction:
+{{.Content}}
+
+{{else}}### Response:
+{{.Content}}
+
+{{end}}{{end}}{{else}}### Instruction:
+{{.Input}}
+
+{{end}}### Response:
+`,
+	"vicuna": `{{- if .Messages}}{{range .Messages}}
+{{- if eq .Role "system"}}{{.Content}}
+
+{{else if eq .Role "user"}}USER: {{.Content}}
+{{else}}ASSISTANT: {{.Content}}</s>
+{{end}}{{end}}{{else}}USER: {{.Input}}
+{{end}}ASSISTANT:`,
+}
+
+// defaultValue returns value, or def when value is empty
+func defaultValue(def, value interface{}) interface{} {
+	if value == nil || reflect.ValueOf(value).IsZero() {
+		return def
+	}
+	return value
+}
+
+// EvaluateTemplate renders the template text with in, like the prompt
+// templates of the loader with their functions, without keeping it.
+func (ml *ModelLoader) EvaluateTemplate(text string, in interface{}) (string, error) {
+	ml.mu.Lock()
+	tmpl, err := template.New("inline").Funcs(TemplateFuncs).Funcs(ml.templateFuncs).Parse(text)
+	ml.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, in); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// AddTemplateFuncs makes the functions available in the prompt templates of
+// the loader, along TemplateFuncs, overriding the ones of the same name. The
+// templates already loaded are not affected.
+func (ml *ModelLoader) AddTemplateFuncs(funcs template.FuncMap) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	for name, f := range funcs {
+		ml.templateFuncs[name] = f
+	}
+}
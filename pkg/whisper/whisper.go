@@ -0,0 +1,132 @@
+package whisper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/ggerganov/whisper.cpp/bindings/go/pkg/whisper"
+	wav "github.com/go-audio/wav"
+)
+
+type Segment struct {
+	Id     int     `json:"id"`
+	Start  float64 `json:"start"`
+	End    float64 `json:"end"`
+	Text   string  `json:"text"`
+	Tokens []int   `json:"tokens"`
+}
+
+type Result struct {
+	Language string    `json:"language,omitempty"`
+	Duration float64   `json:"duration"`
+	Text     string    `json:"text"`
+	Segments []Segment `json:"segments"`
+}
+
+// audioToWav converts the audio file to a 16kHz mono wav file as expected by
+// whisper. It shells out to ffmpeg, which needs to be available in the PATH,
+// and which is killed once ctx is done.
+func audioToWav(ctx context.Context, src, dst string) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", src, "-format", "s16le", "-ar", fmt.Sprint(whisper.SampleRate), "-ac", "1", "-acodec", "pcm_s16le", dst)
+	cmd.Env = os.Environ()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error: %w out: %s", err, out)
+	}
+	return nil
+}
+
+// Transcript transcribes the audio file in the language, detected if empty.
+// With translate, the speech is translated to English instead. It stops with
+// the error of ctx once done, but whisper can't be interrupted while it
+// processes the audio, so it returns once it is processed.
+func Transcript(ctx context.Context, model whisper.Model, audiopath, language string, translate bool, threads uint) (Result, error) {
+	res := Result{}
+
+	dir, err := os.MkdirTemp("", "whisper")
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(dir)
+
+	convertedPath := filepath.Join(dir, "converted.wav")
+	if err := audioToWav(ctx, audiopath, convertedPath); err != nil {
+		if ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+		return res, err
+	}
+
+	// Open samples
+	fh, err := os.Open(convertedPath)
+	if err != nil {
+		return res, err
+	}
+	defer fh.Close()
+
+	// Read samples
+	d := wav.NewDecoder(fh)
+	buf, err := d.FullPCMBuffer()
+	if err != nil {
+		return res, err
+	}
+	data := buf.AsFloat32Buffer().Data
+	res.Duration = float64(len(data)) / float64(whisper.SampleRate)
+
+	// Process samples
+	wctx, err := model.NewContext()
+	if err != nil {
+		return res, err
+	}
+
+	wctx.SetThreads(threads)
+
+	if language == "" {
+		language = "auto"
+	}
+	if err := wctx.SetLanguage(language); err != nil {
+		return res, err
+	}
+	wctx.SetTranslate(translate)
+
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	if err := wctx.Process(data, nil); err != nil {
+		return res, err
+	}
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	res.Language = wctx.Language()
+
+	for {
+		s, err := wctx.NextSegment()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+
+		tokens := []int{}
+		for _, t := range s.Tokens {
+			tokens = append(tokens, t.Id)
+		}
+
+		res.Segments = append(res.Segments, Segment{
+			Id:     s.Num,
+			Start:  s.Start.Seconds(),
+			End:    s.End.Seconds(),
+			Text:   s.Text,
+			Tokens: tokens,
+		})
+		res.Text += s.Text
+	}
+
+	return res, nil
+}